@@ -0,0 +1,242 @@
+package x402pay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(new(adminAPI))
+}
+
+// adminAPI is a module that serves x402 endpoints on Caddy's admin API.
+type adminAPI struct {
+	walletsApp     *X402WalletsApp
+	facilitatorApp *X402FacilitatorApp
+}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.x402",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Provision sets up the admin API module. Apps that are not configured are
+// left nil and their endpoints report an empty state.
+func (a *adminAPI) Provision(ctx caddy.Context) error {
+	if app, err := ctx.AppIfConfigured("x402.wallets"); err == nil {
+		a.walletsApp = app.(*X402WalletsApp)
+	}
+	if app, err := ctx.AppIfConfigured("x402.facilitator"); err == nil {
+		a.facilitatorApp = app.(*X402FacilitatorApp)
+	}
+	return nil
+}
+
+// Routes returns the admin routes for the x402 apps.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/x402/wallets",
+			Handler: caddy.AdminHandlerFunc(a.handleWallets),
+		},
+		{
+			Pattern: "/x402/gas",
+			Handler: caddy.AdminHandlerFunc(a.handleGas),
+		},
+		{
+			Pattern: "/x402/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/x402/transactions",
+			Handler: caddy.AdminHandlerFunc(a.handleTransactions),
+		},
+		{
+			Pattern: "/x402/settlements",
+			Handler: caddy.AdminHandlerFunc(a.handleSettlements),
+		},
+		{
+			Pattern: "/x402/settlements/",
+			Handler: caddy.AdminHandlerFunc(a.handleSettlements),
+		},
+	}
+}
+
+// handleWallets returns the address and spending of every shared wallet.
+func (a *adminAPI) handleWallets(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	statuses := []walletStatus{}
+	if a.walletsApp != nil {
+		for _, wallet := range a.walletsApp.wallets {
+			statuses = append(statuses, wallet.status())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return writeAdminJSON(w, statuses)
+}
+
+// handleGas returns the facilitator's last observed gas balance per network.
+func (a *adminAPI) handleGas(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	states := []gasState{}
+	if a.facilitatorApp != nil && a.facilitatorApp.GasMonitor != nil {
+		states = a.facilitatorApp.GasMonitor.snapshot()
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Network < states[j].Network })
+
+	return writeAdminJSON(w, states)
+}
+
+// handleHealth returns the result of the facilitator's latest RPC probes.
+// It responds with 503 when the facilitator is not ready, so that it can be
+// polled directly by monitoring.
+func (a *adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	health := facilitatorHealth{Networks: []networkHealth{}}
+	if a.facilitatorApp != nil {
+		health = a.facilitatorApp.health()
+	}
+	if !health.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return writeAdminJSON(w, health)
+}
+
+// handleTransactions returns the facilitator's pending transactions.
+func (a *adminAPI) handleTransactions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	states := []txState{}
+	if a.facilitatorApp != nil {
+		for _, transactor := range a.facilitatorApp.transactors {
+			states = append(states, transactor.snapshot()...)
+		}
+	}
+	sort.SliceStable(states, func(i, j int) bool { return states[i].Network < states[j].Network })
+
+	return writeAdminJSON(w, states)
+}
+
+// handleSettlements inspects and replays journaled settlements:
+//
+//	GET  /x402/settlements[?state=pending|settled|dead]
+//	GET  /x402/settlements/<id>
+//	POST /x402/settlements/<id>/replay
+//	POST /x402/settlements/replay    (every dead-lettered settlement or leg)
+func (a *adminAPI) handleSettlements(w http.ResponseWriter, r *http.Request) error {
+	if a.facilitatorApp == nil || a.facilitatorApp.SettlementQueue == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("settlement queue is not configured"),
+		}
+	}
+	queue := a.facilitatorApp.SettlementQueue
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/x402/settlements"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		return writeAdminJSON(w, queue.list(settlementState(r.URL.Query().Get("state"))))
+
+	case r.Method == http.MethodGet && action == "":
+		rec, err := queue.get(r.Context(), id)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("settlement %s: %v", id, err),
+			}
+		}
+		return writeAdminJSON(w, rec)
+
+	case r.Method == http.MethodPost && id == "replay" && action == "":
+		replayed := []settlementRecord{}
+		for _, dead := range queue.list("") {
+			if dead.State != settlementDead && !dead.hasDeadLegs() {
+				continue
+			}
+			rec, err := queue.replay(r.Context(), dead.ID)
+			if err != nil {
+				return caddy.APIError{
+					HTTPStatus: http.StatusConflict,
+					Err:        err,
+				}
+			}
+			replayed = append(replayed, *rec)
+		}
+		return writeAdminJSON(w, replayed)
+
+	case r.Method == http.MethodPost && action == "replay":
+		rec, err := queue.replay(r.Context(), id)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusConflict,
+				Err:        err,
+			}
+		}
+		return writeAdminJSON(w, rec)
+
+	case r.Method != http.MethodGet && r.Method != http.MethodPost:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown settlements endpoint: %s", r.URL.Path),
+		}
+	}
+}
+
+// writeAdminJSON writes v as the JSON body of an admin API response.
+func writeAdminJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed to encode response: %w", err),
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
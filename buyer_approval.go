@@ -0,0 +1,212 @@
+package x402pay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultApprovalTimeout is how long the buyer waits for a decision when no
+// timeout is configured.
+const defaultApprovalTimeout = time.Minute
+
+// PaymentApproval configures a human-in-the-loop check for large payments.
+// Payments above Threshold are described to an approval endpoint, and are
+// only signed once it approves them. The endpoint is either an HTTP service
+// reached at URL or a Caddy HTTP handler invoked in-process.
+type PaymentApproval struct {
+	// Threshold is the amount, in token base units, above which a payment
+	// needs approval. Empty means every payment needs approval.
+	Threshold string `json:"threshold,omitempty"`
+
+	// URL of the approval service. It receives a POST with an
+	// approvalRequest and must answer with an approvalResponse; it may hold
+	// the request open until a human has decided.
+	URL string `json:"url,omitempty"`
+
+	// HandlerRaw is a Caddy HTTP handler used as the approval endpoint
+	// instead of URL. It receives the same request and must write the same
+	// response as the approval service.
+	HandlerRaw json.RawMessage `json:"handler,omitempty" caddy:"namespace=http.handlers inline_key=handler"`
+
+	// Timeout is how long to wait for a decision before denying the payment.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Runtime fields
+	threshold *big.Int
+	handler   caddyhttp.MiddlewareHandler
+	client    *http.Client
+}
+
+// approvalRequest describes a payment awaiting approval.
+type approvalRequest struct {
+	Method              string                    `json:"method"`
+	URL                 string                    `json:"url"`
+	Wallet              string                    `json:"wallet,omitempty"`
+	Payer               string                    `json:"payer"`
+	Amount              string                    `json:"amount"`
+	PaymentRequirements types.PaymentRequirements `json:"paymentRequirements"`
+}
+
+// approvalResponse is the decision returned by the approval endpoint.
+type approvalResponse struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// provision sets up the approval endpoint.
+func (a *PaymentApproval) provision(ctx caddy.Context) error {
+	a.threshold = new(big.Int)
+	if a.Threshold != "" {
+		threshold, ok := new(big.Int).SetString(a.Threshold, 10)
+		if !ok || threshold.Sign() < 0 {
+			return fmt.Errorf("invalid approval threshold: %s", a.Threshold)
+		}
+		a.threshold = threshold
+	}
+
+	if a.Timeout <= 0 {
+		a.Timeout = caddy.Duration(defaultApprovalTimeout)
+	}
+
+	switch {
+	case a.HandlerRaw != nil && a.URL != "":
+		return fmt.Errorf("approval url and handler are mutually exclusive")
+	case a.HandlerRaw != nil:
+		mod, err := ctx.LoadModule(a, "HandlerRaw")
+		if err != nil {
+			return fmt.Errorf("loading approval handler: %w", err)
+		}
+		a.handler = mod.(caddyhttp.MiddlewareHandler)
+	case a.URL != "":
+		a.client = &http.Client{Timeout: time.Duration(a.Timeout)}
+	default:
+		return fmt.Errorf("approval requires a url or a handler")
+	}
+	return nil
+}
+
+// required reports whether paying amount needs approval.
+func (a *PaymentApproval) required(amount *big.Int) bool {
+	return a != nil && amount.Cmp(a.threshold) > 0
+}
+
+// approve asks the approval endpoint about a payment and returns an error
+// unless it was explicitly approved within the timeout.
+func (a *PaymentApproval) approve(r *http.Request, req approvalRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encoding approval request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(a.Timeout))
+	defer cancel()
+
+	var (
+		status int
+		resp   []byte
+	)
+	if a.handler != nil {
+		status, resp, err = a.callHandler(ctx, r, body)
+	} else {
+		status, resp, err = a.callURL(ctx, body)
+	}
+	if err != nil {
+		return fmt.Errorf("approval endpoint unavailable: %w", err)
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("approval endpoint answered with status %d", status)
+	}
+
+	var decision approvalResponse
+	if err := json.Unmarshal(resp, &decision); err != nil {
+		return fmt.Errorf("invalid approval response: %w", err)
+	}
+	if !decision.Approved {
+		if decision.Reason != "" {
+			return fmt.Errorf("payment denied: %s", decision.Reason)
+		}
+		return fmt.Errorf("payment denied")
+	}
+	return nil
+}
+
+// callURL posts the approval request to the approval service.
+func (a *PaymentApproval) callURL(ctx context.Context, body []byte) (int, []byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// callHandler runs the approval request through the configured Caddy handler.
+// The request is derived from the one being paid for so that the handler
+// has the usual Caddy request context available.
+func (a *PaymentApproval) callHandler(ctx context.Context, r *http.Request, body []byte) (int, []byte, error) {
+	httpReq := r.Clone(ctx)
+	httpReq.Method = http.MethodPost
+	httpReq.Header = http.Header{"Content-Type": []string{"application/json"}}
+	httpReq.Body = io.NopCloser(bytes.NewReader(body))
+	httpReq.ContentLength = int64(len(body))
+
+	rec := &approvalRecorder{header: make(http.Header)}
+	noop := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	done := make(chan error, 1)
+	go func() { done <- a.handler.ServeHTTP(rec, httpReq, noop) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, nil, err
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		return rec.status, rec.body.Bytes(), nil
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// approvalRecorder collects the response written by an approval handler.
+type approvalRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *approvalRecorder) Header() http.Header { return rec.header }
+
+func (rec *approvalRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *approvalRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
@@ -0,0 +1,244 @@
+package x402pay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/utils"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultBalanceCacheTTL is how long an observed balance is trusted when
+	// no cache_ttl is configured.
+	defaultBalanceCacheTTL = 30 * time.Second
+
+	// balanceQueryTimeout bounds a single balance lookup.
+	balanceQueryTimeout = 5 * time.Second
+)
+
+// errInsufficientFunds is returned by BalanceCheck.ensure when the wallet
+// cannot cover a payment.
+var errInsufficientFunds = errors.New("insufficient funds")
+
+// BalanceCheck makes the buyer look up the wallet's token balance on the
+// chain network's RPC before signing, so that payments the wallet cannot
+// cover are refused up front rather than failing at settlement. Lookups are
+// cached, and the cached balance is debited as payments go through. If the
+// RPC cannot be reached the payment proceeds unchecked.
+//
+// Upto payments are collected with transferFrom against an allowance, so
+// for them the allowance the wallet already grants the spender is checked
+// too: one that exceeds the payment means the spender's permit is skipped
+// at settlement and it can still draw the rest, which is warned about.
+type BalanceCheck struct {
+	// CacheTTL is how long an observed balance is trusted. Defaults to 30s.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// LowBalance is a low-water mark, in token base units. When the balance
+	// drops below it a warning is logged, once per crossing, and the
+	// low_balance metric is set.
+	LowBalance string `json:"low_balance,omitempty"`
+
+	// Runtime fields
+	lowBalance *big.Int
+	logger     *zap.Logger
+
+	mu       sync.Mutex
+	clients  map[string]*ethclient.Client
+	balances map[string]cachedBalance
+	low      map[string]bool
+}
+
+type cachedBalance struct {
+	balance *big.Int
+	fetched time.Time
+}
+
+// provision sets up the balance check.
+func (b *BalanceCheck) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if b.CacheTTL <= 0 {
+		b.CacheTTL = caddy.Duration(defaultBalanceCacheTTL)
+	}
+	if b.LowBalance != "" {
+		lowBalance, ok := new(big.Int).SetString(b.LowBalance, 10)
+		if !ok || lowBalance.Sign() < 0 {
+			return fmt.Errorf("invalid low_balance: %s", b.LowBalance)
+		}
+		b.lowBalance = lowBalance
+	}
+	b.logger = logger
+	b.clients = make(map[string]*ethclient.Client)
+	b.balances = make(map[string]cachedBalance)
+	b.low = make(map[string]bool)
+
+	return initX402Metrics(ctx.GetMetricsRegistry())
+}
+
+// cleanup closes RPC connections. Requests still in flight dial afresh.
+func (b *BalanceCheck) cleanup() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, client := range b.clients {
+		client.Close()
+	}
+	b.clients = make(map[string]*ethclient.Client)
+}
+
+// ensure returns errInsufficientFunds if owner's balance of token on network
+// is known to be lower than amount. Other errors mean the balance could not
+// be determined.
+func (b *BalanceCheck) ensure(ctx context.Context, network *ChainNetworkConfig, token, owner string, amount *big.Int) error {
+	balance, err := b.balance(ctx, network, token, owner)
+	if err != nil {
+		return err
+	}
+	if balance.Cmp(amount) < 0 {
+		x402Metrics.buyerInsufficient.WithLabelValues(network.Name, owner).Inc()
+		return fmt.Errorf("%w: balance %s, need %s", errInsufficientFunds, balance, amount)
+	}
+	return nil
+}
+
+// checkAllowance looks up the allowance owner grants spender on token
+// before an upto payment of amount is signed, warning if the spender could
+// draw more than the payment authorizes.
+func (b *BalanceCheck) checkAllowance(ctx context.Context, network *ChainNetworkConfig, token, owner, spender string, amount *big.Int) error {
+	client, err := b.client(ctx, network)
+	if err != nil {
+		return err
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, balanceQueryTimeout)
+	defer cancel()
+	allowance, err := callUint(queryCtx, client, common.HexToAddress(token), "allowance",
+		common.HexToAddress(owner), common.HexToAddress(spender))
+	if err != nil {
+		return fmt.Errorf("querying token allowance on %s: %w", network.Name, err)
+	}
+
+	f, _ := new(big.Float).SetInt(allowance).Float64()
+	x402Metrics.buyerAllowance.WithLabelValues(network.Name, owner, common.HexToAddress(spender).Hex()).Set(f)
+	if allowance.Cmp(amount) > 0 {
+		b.logger.Warn("spender already holds a larger allowance than the payment authorizes",
+			zap.String("network", network.Name),
+			zap.String("address", owner),
+			zap.String("spender", spender),
+			zap.String("allowance", allowance.String()),
+			zap.String("amount", amount.String()),
+		)
+	}
+	return nil
+}
+
+// debit subtracts a payment from the cached balance, if any.
+func (b *BalanceCheck) debit(network, token, owner string, amount *big.Int) {
+	if b == nil {
+		return
+	}
+	key := balanceKey(network, token, owner)
+
+	b.mu.Lock()
+	cached, ok := b.balances[key]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	balance := new(big.Int).Sub(cached.balance, amount)
+	if balance.Sign() < 0 {
+		balance.SetInt64(0)
+	}
+	b.balances[key] = cachedBalance{balance: balance, fetched: cached.fetched}
+	b.mu.Unlock()
+
+	b.observe(network, owner, balance)
+}
+
+// balance returns owner's balance of token, from cache when fresh.
+func (b *BalanceCheck) balance(ctx context.Context, network *ChainNetworkConfig, token, owner string) (*big.Int, error) {
+	key := balanceKey(network.Name, token, owner)
+
+	b.mu.Lock()
+	cached, ok := b.balances[key]
+	b.mu.Unlock()
+	if ok && time.Since(cached.fetched) < time.Duration(b.CacheTTL) {
+		return cached.balance, nil
+	}
+
+	client, err := b.client(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, balanceQueryTimeout)
+	defer cancel()
+	balance, err := utils.GetTokenBalanceWithContext(queryCtx, client, common.HexToAddress(token), common.HexToAddress(owner))
+	if err != nil {
+		return nil, fmt.Errorf("querying token balance on %s: %w", network.Name, err)
+	}
+
+	b.mu.Lock()
+	b.balances[key] = cachedBalance{balance: balance, fetched: time.Now()}
+	b.mu.Unlock()
+
+	b.observe(network.Name, owner, balance)
+	return balance, nil
+}
+
+// observe records a balance in the metrics and warns when it drops below
+// the low-water mark.
+func (b *BalanceCheck) observe(network, owner string, balance *big.Int) {
+	f, _ := new(big.Float).SetInt(balance).Float64()
+	x402Metrics.buyerTokenBalance.WithLabelValues(network, owner).Set(f)
+
+	if b.lowBalance == nil {
+		return
+	}
+	low := balance.Cmp(b.lowBalance) < 0
+	key := network + "/" + owner
+	b.mu.Lock()
+	crossed := low != b.low[key]
+	b.low[key] = low
+	b.mu.Unlock()
+
+	if !low {
+		x402Metrics.buyerLowBalance.WithLabelValues(network, owner).Set(0)
+		return
+	}
+	x402Metrics.buyerLowBalance.WithLabelValues(network, owner).Set(1)
+	if crossed {
+		b.logger.Warn("buyer wallet balance is low",
+			zap.String("network", network),
+			zap.String("address", owner),
+			zap.String("balance", balance.String()),
+			zap.String("low_balance", b.lowBalance.String()),
+		)
+	}
+}
+
+// client returns an RPC client for network, dialing it on first use.
+func (b *BalanceCheck) client(ctx context.Context, network *ChainNetworkConfig) (*ethclient.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if client, ok := b.clients[network.Name]; ok {
+		return client, nil
+	}
+	client, _, err := dialChainNetwork(ctx, *network, b.logger)
+	if err != nil {
+		return nil, err
+	}
+	b.clients[network.Name] = client
+	return client, nil
+}
+
+// balanceKey identifies a cached balance.
+func balanceKey(network, token, owner string) string {
+	return network + "/" + common.HexToAddress(token).Hex() + "/" + common.HexToAddress(owner).Hex()
+}
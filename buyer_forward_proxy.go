@@ -0,0 +1,238 @@
+package x402pay
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	// defaultForwardProxyTimeout bounds the wait for the response headers
+	// of an outbound request when no timeout is configured.
+	defaultForwardProxyTimeout = 2 * time.Minute
+
+	// defaultForwardProxyMaxBody is the largest request body proxied when
+	// no max_body_size is configured. Bodies are held in memory so that
+	// they can be sent again with a payment.
+	defaultForwardProxyMaxBody = 1 << 20
+)
+
+// ForwardProxy lets x402buyer pay for arbitrary URLs instead of only for the
+// upstream reached through the next handler. The target is taken either from
+// an absolute-form request URI, as sent by clients using the handler as their
+// HTTP_PROXY, or from a query parameter such as /proxy?url=https://... .
+// CONNECT tunnels are not supported since the buyer must see the traffic to
+// pay for it.
+type ForwardProxy struct {
+	// Param is the query parameter holding the target URL. Defaults to "url".
+	Param string `json:"param,omitempty"`
+
+	// AllowHosts are the hosts that may be proxied to, and is required so
+	// that the buyer does not pay for whoever can reach it. Entries are
+	// exact host names or wildcards of the form "*.example.com"; "*" allows
+	// any host.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+
+	// AllowPrivate permits connecting to loopback, private and link-local
+	// addresses, which are refused by default so that the proxy cannot be
+	// used to reach internal services.
+	AllowPrivate bool `json:"allow_private,omitempty"`
+
+	// Timeout bounds the wait for the response headers of each outbound
+	// request. The response body may then take as long as it needs, so
+	// that streams pass through. Defaults to 2m.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// MaxBodySize is the largest request body, in bytes, that is proxied.
+	// Defaults to 1 MiB.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// Runtime fields
+	client *http.Client
+}
+
+// hopHeaders are hop-by-hop headers that must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// provision sets up the outbound HTTP client.
+func (p *ForwardProxy) provision() error {
+	if p.Param == "" {
+		p.Param = "url"
+	}
+	if len(p.AllowHosts) == 0 {
+		return fmt.Errorf("forward_proxy requires allow_hosts; use * to allow any host")
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = caddy.Duration(defaultForwardProxyTimeout)
+	}
+	if p.MaxBodySize <= 0 {
+		p.MaxBodySize = defaultForwardProxyMaxBody
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !p.AllowPrivate {
+		dialer.Control = refusePrivateAddress
+	}
+
+	p.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			ResponseHeaderTimeout: time.Duration(p.Timeout),
+		},
+		// Redirects are the client's business, not ours
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+// resolveTarget determines the URL a request should be proxied to.
+func (p *ForwardProxy) resolveTarget(r *http.Request) (*url.URL, error) {
+	var target *url.URL
+	if r.URL.IsAbs() {
+		target = &url.URL{
+			Scheme:   r.URL.Scheme,
+			Host:     r.URL.Host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+	} else {
+		raw := r.URL.Query().Get(p.Param)
+		if raw == "" {
+			return nil, fmt.Errorf("no target URL: expected an absolute request URI or the %q query parameter", p.Param)
+		}
+		var err error
+		target, err = url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target URL: %w", err)
+		}
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported target scheme %q", target.Scheme)
+	}
+	if target.Hostname() == "" {
+		return nil, fmt.Errorf("target URL has no host")
+	}
+	if !p.hostAllowed(target.Hostname()) {
+		return nil, fmt.Errorf("host %s is not allowed", target.Hostname())
+	}
+	return target, nil
+}
+
+// hostAllowed reports whether host matches AllowHosts.
+func (p *ForwardProxy) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range p.AllowHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerFor returns a handler that sends requests to target. It stands in
+// for the next handler so that the buyer's payment flow is unchanged.
+func (p *ForwardProxy) handlerFor(target *url.URL) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		outReq, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), r.Body)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		outReq.Header = r.Header.Clone()
+		removeHopHeaders(outReq.Header)
+		outReq.ContentLength = r.ContentLength
+
+		resp, err := p.client.Do(outReq)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadGateway, err)
+		}
+		defer resp.Body.Close()
+
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		removeHopHeaders(w.Header())
+		w.WriteHeader(resp.StatusCode)
+
+		// Flush as we go so that event streams reach the client promptly
+		_, err = io.Copy(flushWriter{w: w, rc: http.NewResponseController(w)}, resp.Body)
+		return err
+	})
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including those named by the
+// Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// flushWriter flushes after every write.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		_ = fw.rc.Flush()
+	}
+	return n, err
+}
+
+// refusePrivateAddress is a net.Dialer Control function that refuses to
+// connect to non-public addresses. It runs after name resolution, so host
+// names resolving to internal addresses are caught as well.
+func refusePrivateAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected dial address %s", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
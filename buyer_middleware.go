@@ -2,10 +2,13 @@ package x402pay
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"strconv"
 	"time"
@@ -31,11 +34,41 @@ type X402BuyerMiddleware struct {
 	MaxAmountPay  string `json:"max_amount_pay,omitempty"`
 	MaxRetries    int    `json:"max_retries,omitempty"`
 
+	// Wallet names a wallet defined in the x402.wallets app to pay with,
+	// instead of a private key of this handler's own.
+	Wallet string `json:"wallet,omitempty"`
+
+	// QuoteCacheTTL is how long payment requirements quoted by an upstream
+	// resource are remembered. While a quote is fresh, requests to the same
+	// method, host and path are sent with a pre-signed payment instead of
+	// first waiting for a 402. Zero disables the cache.
+	QuoteCacheTTL caddy.Duration `json:"quote_cache_ttl,omitempty"`
+
+	// Approval, if set, holds payments above a threshold until an approval
+	// endpoint agrees to them.
+	Approval *PaymentApproval `json:"approval,omitempty"`
+
+	// ForwardProxy, if set, makes the buyer fetch and pay for arbitrary
+	// target URLs itself rather than going through the next handler.
+	ForwardProxy *ForwardProxy `json:"forward_proxy,omitempty"`
+
+	// BalanceCheck, if set, makes the buyer check the wallet's token balance
+	// before signing and refuse payments it cannot cover.
+	BalanceCheck *BalanceCheck `json:"balance_check,omitempty"`
+
+	// Identify sends the wallet address with every request, signed for
+	// the host requested, so that sellers granting a free tier per wallet
+	// can count its requests.
+	Identify bool `json:"identify,omitempty"`
+
 	// Runtime fields
 	privateKey         *ecdsa.PrivateKey
+	wallet             *buyerWallet
 	parsedMaxAmountPay int64
+	quotes             *quoteCache
 	ChainNetworks      []ChainNetworkConfig
 	ctx                caddy.Context
+	rpcClients         *chainClients
 }
 
 // CaddyModule returns the Caddy module information.
@@ -50,14 +83,40 @@ func (X402BuyerMiddleware) CaddyModule() caddy.ModuleInfo {
 func (m *X402BuyerMiddleware) Provision(ctx caddy.Context) error {
 	m.ctx = ctx
 
-	if m.PrivateKeyHex == "" {
-		return fmt.Errorf("buyer private key is indispensable")
+	if err := applyPresets(m.ChainNetworks); err != nil {
+		return err
 	}
-	privateKey, err := crypto.HexToECDSA(m.PrivateKeyHex)
-	if err != nil {
-		return fmt.Errorf("invalid buyer private key: %w", err)
+
+	switch {
+	case m.Wallet != "" && m.PrivateKeyHex != "":
+		return fmt.Errorf("private_key and wallet are mutually exclusive")
+
+	case m.Wallet != "":
+		appVal, err := ctx.App("x402.wallets")
+		if err != nil {
+			return fmt.Errorf("failed to get x402.wallets app: %w", err)
+		}
+		walletsApp, ok := appVal.(*X402WalletsApp)
+		if !ok {
+			return fmt.Errorf("x402.wallets app is not of type *X402WalletsApp")
+		}
+		m.wallet, err = walletsApp.getWallet(m.Wallet)
+		if err != nil {
+			return err
+		}
+
+	case m.PrivateKeyHex != "":
+		privateKey, err := crypto.HexToECDSA(m.PrivateKeyHex)
+		if err != nil {
+			return fmt.Errorf("invalid buyer private key: %w", err)
+		}
+		// A handler-local wallet without any spending limits
+		m.wallet = newBuyerWallet("", privateKey, nil, 0, 0)
+
+	default:
+		return fmt.Errorf("buyer private key or wallet is indispensable")
 	}
-	m.privateKey = privateKey
+	m.privateKey = m.wallet.privateKey
 
 	// Parse max_amount_pay if specified
 	if m.MaxAmountPay == "" {
@@ -74,11 +133,35 @@ func (m *X402BuyerMiddleware) Provision(ctx caddy.Context) error {
 		m.MaxRetries = 1
 	}
 
+	m.quotes = newQuoteCache(time.Duration(m.QuoteCacheTTL))
+	m.rpcClients = newChainClients(ctx.Logger(m))
+
+	if m.Approval != nil {
+		if err := m.Approval.provision(ctx); err != nil {
+			return err
+		}
+	}
+
+	if m.ForwardProxy != nil {
+		if err := m.ForwardProxy.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.BalanceCheck != nil {
+		if err := m.BalanceCheck.provision(ctx, ctx.Logger(m)); err != nil {
+			return err
+		}
+	}
+
 	ctx.Logger(m).Info("provisioning x402 buyer middleware",
 		zap.Int("max_retries", m.MaxRetries),
+		zap.Duration("quote_cache_ttl", time.Duration(m.QuoteCacheTTL)),
 		zap.Int64("max_amount_pay", m.parsedMaxAmountPay),
 		zap.Int("chain_networks_count", len(m.ChainNetworks)),
 		zap.String("buyer_private_key_set", fmt.Sprintf("%t", m.PrivateKeyHex != "")),
+		zap.String("wallet", m.Wallet),
+		zap.String("wallet_address", m.wallet.address()),
 	)
 
 	return nil
@@ -89,11 +172,26 @@ func (m *X402BuyerMiddleware) Validate() error {
 	if m.privateKey == nil {
 		return fmt.Errorf("buyer private key is required")
 	}
+	if m.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+	return nil
+}
+
+// Cleanup releases resources held by the middleware.
+func (m *X402BuyerMiddleware) Cleanup() error {
+	if m.BalanceCheck != nil {
+		m.BalanceCheck.cleanup()
+	}
+	m.rpcClients.close()
 	return nil
 }
 
 func (m *X402BuyerMiddleware) getRequestBodyByLimit(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	maxBytes := int64(1024 * 8)
+	if m.ForwardProxy != nil {
+		maxBytes = m.ForwardProxy.MaxBodySize
+	}
 	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
 	buf, err := io.ReadAll(r.Body)
@@ -105,88 +203,359 @@ func (m *X402BuyerMiddleware) getRequestBodyByLimit(w http.ResponseWriter, r *ht
 }
 
 // ServeHTTP implements the caddyhttp.MiddlewareHandler interface.
+//
+// The request is forwarded to the next handler; whenever it answers with 402
+// Payment Required the buyer signs a payment and retries, up to MaxRetries
+// paid attempts. Rejected payments are classified so that expired or
+// unsettled authorizations are simply re-signed, mismatched ones are
+// re-quoted, and unrecoverable ones stop immediately.
 func (m *X402BuyerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	originalBodyBytes, err := m.getRequestBodyByLimit(w, r)
 	if err != nil {
 		return err
 	}
-	r.Body = io.NopCloser(bytes.NewReader(originalBodyBytes))
 
-	// Use response capture to intercept the response
-	rec := &responseCapture{ResponseWriter: w, statusCode: http.StatusOK}
+	if m.Identify {
+		identity, err := signIdentity(m.privateKey, r.Host, time.Now())
+		if err != nil {
+			return m.writeError(w, http.StatusInternalServerError, "identity_failed", err.Error())
+		}
+		r.Header.Set(headerPaymentIdentity, identity)
+	}
+
+	quoteKey := quoteCacheKey(r, originalBodyBytes)
+	resourceURL := r.URL.String()
 
-	// Call next handler
-	err = next.ServeHTTP(rec, r)
-	if err != nil {
-		return m.flushResponse(rec, w)
+	// In forward proxy mode the target comes from the request itself
+	if m.ForwardProxy != nil {
+		target, err := m.ForwardProxy.resolveTarget(r)
+		if err != nil {
+			return m.writeError(w, http.StatusBadRequest, "invalid_proxy_target", err.Error())
+		}
+		next = m.ForwardProxy.handlerFor(target)
+		quoteKey = r.Method + " " + target.Host + target.Path
+		resourceURL = target.String()
 	}
 
-	// Check if the response is 402 Payment Required
-	if rec.statusCode != http.StatusPaymentRequired {
-		return m.flushResponse(rec, w)
+	var (
+		requirements *types.PaymentRequirements
+		attempts     []paymentAttempt
+		paid         bool
+		prepaid      bool
+		authorized   *big.Int // amount held on the wallet for the payment in flight
+		paidFor      *types.PaymentRequirements
+		approved     *big.Int // largest amount approved during this request
+	)
+
+	// A payment still in flight when we return was accepted, or at least
+	// may have been, so it counts as spent
+	defer func() {
+		if authorized != nil {
+			m.wallet.finish(authorized, true)
+			m.BalanceCheck.debit(paidFor.Network, paidFor.Asset, m.wallet.address(), authorized)
+		}
+	}()
+
+	// Pay up front if the upstream quoted this resource recently
+	if requirements, authorized = m.prepay(r, quoteKey); requirements != nil {
+		paidFor = requirements
+		attempts = append(attempts, paymentAttempt{
+			Attempt: 1,
+			Amount:  requirements.MaxAmountRequired,
+			Network: requirements.Network,
+		})
+		paid = true
+		prepaid = true
 	}
 
-	m.ctx.Logger(m).Info("received 402 Payment Required, attempting automatic payment")
+	// Snapshot the response headers so that headers set by a rejected 402
+	// response do not leak into the retried one
+	baseHeader := w.Header().Clone()
+
+	for {
+		r.Body = io.NopCloser(bytes.NewReader(originalBodyBytes))
+
+		// Paid responses metered as streams are topped up as they go
+		stream := &streamPayer{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			m:                     m,
+			r:                     r,
+			next:                  next,
+			requirements:          paidFor,
+			accepted: func() {
+				if authorized != nil {
+					m.wallet.finish(authorized, true)
+					m.BalanceCheck.debit(paidFor.Network, paidFor.Asset, m.wallet.address(), authorized)
+					authorized = nil
+				}
+			},
+		}
+		// Only 402 responses are buffered; anything else, including streams
+		// and upgraded connections, passes straight through to the client
+		var buf bytes.Buffer
+		rec := caddyhttp.NewResponseRecorder(stream, &buf, bufferPaymentRequired)
+
+		// Call next handler
+		if err := next.ServeHTTP(rec, r); err != nil {
+			return err
+		}
 
-	// Parse payment requirements from response body
-	var paymentResp paymentRequiredResponse
-	if err := json.Unmarshal(rec.body.Bytes(), &paymentResp); err != nil {
-		m.ctx.Logger(m).Error("failed to parse 402 response",
-			zap.Error(err),
+		// Check if the response is 402 Payment Required
+		if !rec.Buffered() {
+			return stream.finish()
+		}
+
+		// Parse payment requirements from response body
+		var paymentResp paymentRequiredResponse
+		if err := parsePaymentRequired(buf.Bytes(), &paymentResp); err != nil {
+			m.ctx.Logger(m).Error("failed to parse 402 response",
+				zap.Error(err),
+			)
+			// Return the original 402 response
+			return rec.WriteResponse()
+		}
+
+		quoted := paymentResp.PaymentRequirements.Scheme != ""
+		if quoted {
+			requirements = &paymentResp.PaymentRequirements
+			m.quotes.put(quoteKey, requirements)
+		}
+
+		if paid {
+			// Whatever we write next replaces the rejected 402 entirely
+			resetHeader(w.Header(), baseHeader)
+
+			m.wallet.finish(authorized, false)
+			authorized = nil
+
+			if !quoted {
+				// The quote we paid against was rejected; don't reuse it
+				m.quotes.invalidate(quoteKey)
+			}
+
+			failure := classifyPaymentFailure(&paymentResp)
+			last := &attempts[len(attempts)-1]
+			last.Failure = failure
+			last.Message = paymentResp.Message
+
+			m.ctx.Logger(m).Warn("payment rejected by upstream",
+				zap.Int("attempt", last.Attempt),
+				zap.String("failure", string(failure)),
+				zap.String("message", paymentResp.Message),
+			)
+
+			// A payment signed from a cached quote is speculative and does
+			// not count against the retry budget
+			budget := m.MaxRetries
+			if prepaid {
+				budget++
+			}
+			if !failure.retryable() || len(attempts) >= budget {
+				return m.writePaymentFailure(w, failure, attempts)
+			}
+
+			if failure.requiresRequote() && !quoted {
+				// Drop the rejected payment and ask the upstream for a fresh quote.
+				r.Header.Del("X-Payment")
+				requirements = nil
+				paid = false
+				continue
+			}
+		}
+
+		if requirements == nil {
+			// Nothing we know how to pay for
+			return rec.WriteResponse()
+		}
+		resetHeader(w.Header(), baseHeader)
+
+		m.ctx.Logger(m).Info("received 402 Payment Required, attempting automatic payment",
+			zap.Int("attempt", len(attempts)+1),
 		)
-		// Return the original 402 response
-		return m.flushResponse(rec, w)
-	}
 
-	// Check if max amount is specified and validate
-	if m.parsedMaxAmountPay > 0 {
-		requiredAmount, err := strconv.ParseInt(paymentResp.PaymentRequirements.MaxAmountRequired, 10, 64)
+		// Check if max amount is specified and validate
+		if m.parsedMaxAmountPay > 0 {
+			requiredAmount, err := strconv.ParseInt(requirements.MaxAmountRequired, 10, 64)
+			if err != nil {
+				m.ctx.Logger(m).Error("failed to parse max_amount_required from payment requirements",
+					zap.Error(err),
+				)
+				return m.writeError(w, http.StatusBadRequest, "invalid_payment_requirements", "Invalid max_amount_required in payment requirements")
+			}
+
+			if requiredAmount > m.parsedMaxAmountPay {
+				m.ctx.Logger(m).Warn("required payment amount exceeds max_amount_pay",
+					zap.Int64("required", requiredAmount),
+					zap.Int64("max_allowed", m.parsedMaxAmountPay),
+				)
+				return m.writeError(w, http.StatusPaymentRequired, "amount_limit_exceeded",
+					fmt.Sprintf("Required payment amount %d exceeds max allowed amount %d", requiredAmount, m.parsedMaxAmountPay))
+			}
+		}
+
+		amount, ok := new(big.Int).SetString(requirements.MaxAmountRequired, 10)
+		if !ok || amount.Sign() < 0 {
+			return m.writeError(w, http.StatusBadRequest, "invalid_payment_requirements", "Invalid max_amount_required in payment requirements")
+		}
+
+		// Large payments wait for approval before anything is signed
+		if m.Approval.required(amount) && (approved == nil || amount.Cmp(approved) > 0) {
+			m.ctx.Logger(m).Info("payment requires approval",
+				zap.String("amount", amount.String()),
+			)
+			err := m.Approval.approve(r, approvalRequest{
+				Method:              r.Method,
+				URL:                 resourceURL,
+				Wallet:              m.Wallet,
+				Payer:               m.wallet.address(),
+				Amount:              amount.String(),
+				PaymentRequirements: *requirements,
+			})
+			if err != nil {
+				m.ctx.Logger(m).Warn("payment was not approved",
+					zap.String("amount", amount.String()),
+					zap.Error(err),
+				)
+				return m.writeError(w, http.StatusPaymentRequired, "payment_not_approved", err.Error())
+			}
+			approved = amount
+		}
+
+		// Refuse payments the wallet cannot cover before signing them
+		if err := m.checkBalance(r.Context(), requirements, amount); err != nil {
+			if errors.Is(err, errInsufficientFunds) {
+				m.ctx.Logger(m).Warn("wallet cannot cover payment",
+					zap.String("network", requirements.Network),
+					zap.Error(err),
+				)
+				return m.writeError(w, http.StatusPaymentRequired, string(failureInsufficientFunds), err.Error())
+			}
+			m.ctx.Logger(m).Warn("could not check wallet balance, paying unchecked",
+				zap.Error(err),
+			)
+		}
+
+		// Create payment payload
+		paymentPayload, err := m.createPaymentPayload(r.Context(), requirements)
 		if err != nil {
-			m.ctx.Logger(m).Error("failed to parse max_amount_required from payment requirements",
+			m.ctx.Logger(m).Error("failed to create payment payload",
 				zap.Error(err),
 			)
-			return m.writeError(w, http.StatusBadRequest, "invalid_payment_requirements", "Invalid max_amount_required in payment requirements")
+			return m.writeError(w, http.StatusInternalServerError, "payment_creation_failed",
+				fmt.Sprintf("Failed to create payment: %s", err.Error()))
+		}
+
+		// Serialize payment payload to JSON
+		paymentJSON, err := json.Marshal(paymentPayload)
+		if err != nil {
+			m.ctx.Logger(m).Error("failed to marshal payment payload",
+				zap.Error(err),
+			)
+			return m.writeError(w, http.StatusInternalServerError, "payment_serialization_failed",
+				fmt.Sprintf("Failed to serialize payment: %s", err.Error()))
 		}
 
-		if requiredAmount > m.parsedMaxAmountPay {
-			m.ctx.Logger(m).Warn("required payment amount exceeds max_amount_pay",
-				zap.Int64("required", requiredAmount),
-				zap.Int64("max_allowed", m.parsedMaxAmountPay),
+		// Hold the amount on the wallet until the upstream answers
+		if err := m.wallet.authorize(r.Context(), amount); err != nil {
+			m.ctx.Logger(m).Warn("wallet refused payment",
+				zap.String("wallet", m.Wallet),
+				zap.Error(err),
 			)
-			return m.writeError(w, http.StatusPaymentRequired, "amount_limit_exceeded",
-				fmt.Sprintf("Required payment amount %d exceeds max allowed amount %d", requiredAmount, m.parsedMaxAmountPay))
+			if errors.Is(err, errBudgetExceeded) {
+				return m.writeError(w, http.StatusPaymentRequired, "wallet_budget_exceeded",
+					fmt.Sprintf("Payment of %s would exceed the wallet budget", amount))
+			}
+			return m.writeError(w, http.StatusServiceUnavailable, "wallet_busy", err.Error())
 		}
+		authorized = amount
+		paidFor = requirements
+
+		attempts = append(attempts, paymentAttempt{
+			Attempt: len(attempts) + 1,
+			Amount:  requirements.MaxAmountRequired,
+			Network: requirements.Network,
+		})
+
+		m.ctx.Logger(m).Info("payment payload created, retrying request with payment",
+			zap.Int("attempt", len(attempts)),
+			zap.ByteString("originalBodyBytes", originalBodyBytes),
+			zap.ByteString("X-Payment", paymentJSON),
+		)
+
+		r.Header.Set("X-Payment", string(paymentJSON))
+		paid = true
+	}
+}
+
+// prepay attaches an X-Payment header signed against the cached quote for
+// key and returns the requirements it paid along with the amount held on the
+// wallet, or nils if there is no usable quote.
+func (m *X402BuyerMiddleware) prepay(r *http.Request, key string) (*types.PaymentRequirements, *big.Int) {
+	requirements := m.quotes.get(key)
+	if requirements == nil {
+		return nil, nil
+	}
+
+	amount, ok := new(big.Int).SetString(requirements.MaxAmountRequired, 10)
+	if !ok || amount.Sign() < 0 ||
+		(m.parsedMaxAmountPay > 0 && amount.Cmp(big.NewInt(m.parsedMaxAmountPay)) > 0) {
+		m.quotes.invalidate(key)
+		return nil, nil
+	}
+
+	// Payments needing approval go through the regular 402 flow, as do
+	// payments the wallet may not be able to cover
+	if m.Approval.required(amount) || m.checkBalance(r.Context(), requirements, amount) != nil {
+		return nil, nil
 	}
 
-	// Create payment payload
-	paymentPayload, err := m.createPaymentPayload(&paymentResp.PaymentRequirements)
+	paymentPayload, err := m.createPaymentPayload(r.Context(), requirements)
 	if err != nil {
-		m.ctx.Logger(m).Error("failed to create payment payload",
+		m.ctx.Logger(m).Warn("failed to pre-sign payment from cached quote",
 			zap.Error(err),
 		)
-		return m.writeError(w, http.StatusInternalServerError, "payment_creation_failed",
-			fmt.Sprintf("Failed to create payment: %s", err.Error()))
+		return nil, nil
 	}
-
-	// Serialize payment payload to JSON
 	paymentJSON, err := json.Marshal(paymentPayload)
 	if err != nil {
-		m.ctx.Logger(m).Error("failed to marshal payment payload",
-			zap.Error(err),
-		)
-		return m.writeError(w, http.StatusInternalServerError, "payment_serialization_failed",
-			fmt.Sprintf("Failed to serialize payment: %s", err.Error()))
+		return nil, nil
 	}
 
-	m.ctx.Logger(m).Info("payment payload created, retrying request with payment",
-		zap.ByteString("originalBodyBytes", originalBodyBytes),
-		zap.ByteString("X-Payment", paymentJSON),
-	)
+	// Fall back to the regular 402 flow if the wallet can't take it now;
+	// that path reports the reason to the client
+	if err := m.wallet.authorize(r.Context(), amount); err != nil {
+		return nil, nil
+	}
 
-	r.Body = io.NopCloser(bytes.NewReader(originalBodyBytes))
+	m.ctx.Logger(m).Debug("attaching pre-signed payment from cached quote",
+		zap.String("resource", key),
+		zap.String("amount", requirements.MaxAmountRequired),
+	)
 	r.Header.Set("X-Payment", string(paymentJSON))
+	return requirements, amount
+}
+
+// writePaymentFailure writes the structured error returned when the buyer
+// stops trying to pay for a resource.
+func (m *X402BuyerMiddleware) writePaymentFailure(w http.ResponseWriter, failure paymentFailure, attempts []paymentAttempt) error {
+	errType := "payment_retries_exhausted"
+	message := fmt.Sprintf("Payment was rejected after %d attempt(s)", len(attempts))
+	if !failure.retryable() {
+		errType = "payment_not_retryable"
+		message = fmt.Sprintf("Payment was rejected with non-retryable reason %s", failure)
+	}
 
-	return next.ServeHTTP(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPaymentRequired)
+	return json.NewEncoder(w).Encode(paymentFailureResponse{
+		ErrorResponse: types.ErrorResponse{
+			Error:   errType,
+			Message: message,
+			Code:    http.StatusPaymentRequired,
+		},
+		Reason:   failure,
+		Attempts: attempts,
+	})
 }
 
 // writeError writes an error response to the writer.
@@ -200,19 +569,43 @@ func (m *X402BuyerMiddleware) writeError(w http.ResponseWriter, status int, errT
 	})
 }
 
-// createPaymentPayload creates a payment payload using the configured private key.
-func (m *X402BuyerMiddleware) createPaymentPayload(requirements *types.PaymentRequirements) (*types.PaymentPayload, error) {
-	// Find chain network configuration by network name
-	var chainNetwork *ChainNetworkConfig
-	for i := range m.ChainNetworks {
-		if m.ChainNetworks[i].Name == requirements.Network {
-			chainNetwork = &m.ChainNetworks[i]
-			break
-		}
+// checkBalance verifies that the wallet holds enough of the required token,
+// and for upto payments checks the allowance it grants the spender, if
+// balance checks are enabled.
+func (m *X402BuyerMiddleware) checkBalance(ctx context.Context, requirements *types.PaymentRequirements, amount *big.Int) error {
+	if m.BalanceCheck == nil {
+		return nil
 	}
+	chainNetwork, err := m.findChainNetwork(requirements.Network)
+	if err != nil {
+		return err
+	}
+	if err := m.BalanceCheck.ensure(ctx, chainNetwork, requirements.Asset, m.wallet.address(), amount); err != nil {
+		return err
+	}
+	if spender, _ := requirements.Extra["spender"].(string); requirements.Scheme == schemeUpto && spender != "" {
+		return m.BalanceCheck.checkAllowance(ctx, chainNetwork, requirements.Asset, m.wallet.address(), spender, amount)
+	}
+	return nil
+}
+
+// findChainNetwork returns the chain network configuration by network name.
+func (m *X402BuyerMiddleware) findChainNetwork(name string) (*ChainNetworkConfig, error) {
+	network, ok := lookupChainNetwork(m.ChainNetworks, name)
+	if !ok {
+		return nil, fmt.Errorf("chain network %s not found in configuration", name)
+	}
+	return &network, nil
+}
 
-	if chainNetwork == nil {
-		return nil, fmt.Errorf("chain network %s not found in configuration", requirements.Network)
+// createPaymentPayload creates a payment payload using the configured private key.
+func (m *X402BuyerMiddleware) createPaymentPayload(ctx context.Context, requirements *types.PaymentRequirements) (*types.PaymentPayload, error) {
+	chainNetwork, err := m.findChainNetwork(requirements.Network)
+	if err != nil {
+		return nil, err
+	}
+	if requirements.Scheme == schemeUpto {
+		return m.createUptoPayload(ctx, requirements, chainNetwork)
 	}
 
 	// Generate payment payload
@@ -222,14 +615,27 @@ func (m *X402BuyerMiddleware) createPaymentPayload(requirements *types.PaymentRe
 	validBefore := now + validDuration
 	walletAddress := crypto.PubkeyToAddress(m.privateKey.PublicKey)
 
-	// Generate nonce
+	// Generate nonce; nanosecond precision keeps retries within the same
+	// second from reusing an authorization nonce
 	nonce := fmt.Sprintf(
 		"0x%x",
-		crypto.Keccak256Hash([]byte(fmt.Sprintf("%d-%s-%s", now, walletAddress.Hex(), requirements.PayTo))).Hex(),
+		crypto.Keccak256Hash([]byte(fmt.Sprintf("%d-%s-%s", time.Now().UnixNano(), walletAddress.Hex(), requirements.PayTo))).Hex(),
 	)
 
+	// Sign for the token's EIP-712 domain as configured locally, rather
+	// than as the seller describes it, if the asset is known
+	signed := *requirements
+	if asset, ok := chainNetwork.asset(requirements.Asset); ok && requirements.Asset != "" {
+		if asset.Name != "" {
+			signed.TokenName = asset.Name
+		}
+		if asset.Version != "" {
+			signed.TokenVersion = asset.Version
+		}
+	}
+
 	return client.CreatePaymentPayload(
-		requirements,
+		&signed,
 		m.privateKey,
 		validAfter,
 		validBefore,
@@ -238,62 +644,20 @@ func (m *X402BuyerMiddleware) createPaymentPayload(requirements *types.PaymentRe
 	)
 }
 
-// flushResponse writes the captured response to the actual writer.
-func (m *X402BuyerMiddleware) flushResponse(rec *responseCapture, w http.ResponseWriter) error {
-	// Copy headers
-	for k, v := range rec.Header() {
-		w.Header()[k] = v
-	}
-
-	// Write status code
-	w.WriteHeader(rec.statusCode)
-
-	// Write body
-	if _, err := w.Write(rec.body.Bytes()); err != nil {
-		return fmt.Errorf("failed to write response body: %w", err)
-	}
-
-	return nil
-}
-
-// responseCapture is a response writer that captures the response status code and body
-// without writing to the underlying writer until flushResponse is called.
-type responseCapture struct {
-	http.ResponseWriter
-	statusCode int
-	body       bytes.Buffer
-	written    bool
-	headers    http.Header
+// bufferPaymentRequired is a caddyhttp.ShouldBufferFunc that holds back
+// only 402 responses, which the buyer may need to answer with a payment.
+func bufferPaymentRequired(status int, _ http.Header) bool {
+	return status == http.StatusPaymentRequired
 }
 
-// WriteHeader captures the status code without writing to the underlying writer.
-func (r *responseCapture) WriteHeader(statusCode int) {
-	if !r.written {
-		r.statusCode = statusCode
-		r.written = true
+// resetHeader replaces the contents of h with a copy of base.
+func resetHeader(h, base http.Header) {
+	for k := range h {
+		delete(h, k)
 	}
-	// Don't write to underlying writer - wait for flushResponse
-}
-
-// Write captures the body without writing to the underlying writer.
-func (r *responseCapture) Write(data []byte) (int, error) {
-	if !r.written {
-		r.statusCode = http.StatusOK
-		r.written = true
-	}
-	return r.body.Write(data)
-}
-
-// Header returns the headers for this response.
-func (r *responseCapture) Header() http.Header {
-	if r.headers == nil {
-		r.headers = make(http.Header)
-		// Copy existing headers from underlying writer
-		for k, v := range r.ResponseWriter.Header() {
-			r.headers[k] = v
-		}
+	for k, v := range base {
+		h[k] = append([]string(nil), v...)
 	}
-	return r.headers
 }
 
 // paymentRequiredResponse represents the 402 Payment Required response.
@@ -302,12 +666,24 @@ type paymentRequiredResponse struct {
 	Message             string                    `json:"message"`
 	Code                int                       `json:"code"`
 	PaymentRequirements types.PaymentRequirements `json:"paymentRequirements"`
+	InvalidReason       string                    `json:"invalidReason,omitempty"`
+	ErrorReason         string                    `json:"errorReason,omitempty"`
+}
+
+// parsePaymentRequired parses a 402 response body, which JSON-RPC servers
+// may shape as a JSON-RPC error carrying the usual response as its data.
+func parsePaymentRequired(body []byte, resp *paymentRequiredResponse) error {
+	if data, ok := jsonRPCPaymentRequiredData(body); ok {
+		body = data
+	}
+	return json.Unmarshal(body, resp)
 }
 
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*X402BuyerMiddleware)(nil)
 	_ caddy.Validator             = (*X402BuyerMiddleware)(nil)
+	_ caddy.CleanerUpper          = (*X402BuyerMiddleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*X402BuyerMiddleware)(nil)
 	_ caddyfile.Unmarshaler       = (*X402BuyerMiddleware)(nil)
 )
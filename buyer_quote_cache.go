@@ -0,0 +1,118 @@
+package x402pay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+)
+
+// maxQuoteCacheEntries bounds the number of quotes kept per buyer so that a
+// client hitting many distinct paths cannot grow the cache without limit.
+const maxQuoteCacheEntries = 4096
+
+// quoteCache remembers the last payment requirements quoted by an upstream
+// resource so that subsequent requests can be paid up front, skipping the
+// unpaid round trip that would otherwise return 402. A nil *quoteCache is a
+// valid, always-empty cache.
+type quoteCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]quoteCacheEntry
+}
+
+type quoteCacheEntry struct {
+	requirements types.PaymentRequirements
+	expires      time.Time
+}
+
+// newQuoteCache returns a cache holding quotes for ttl, or nil if ttl is not
+// positive, which disables caching.
+func newQuoteCache(ttl time.Duration) *quoteCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &quoteCache{
+		ttl:     ttl,
+		entries: make(map[string]quoteCacheEntry),
+	}
+}
+
+// quoteCacheKey identifies the upstream resource a request is for. Calls to
+// a JSON-RPC endpoint are told apart by the methods they call, and GraphQL
+// requests by their queries, since they may be priced differently.
+func quoteCacheKey(r *http.Request, body []byte) string {
+	key := r.Method + " " + r.Host + r.URL.Path
+	if req, ok := parseJSONRPC(body); ok {
+		names := make([]string, len(req.calls))
+		for i, call := range req.calls {
+			names[i] = call.name()
+		}
+		key += " " + strings.Join(names, ",")
+	} else if reqs, ok, _ := readGraphQL(r, body); ok {
+		query, _ := json.Marshal(reqs)
+		sum := sha256.Sum256(query)
+		key += " graphql:" + hex.EncodeToString(sum[:8])
+	}
+	return key
+}
+
+// get returns a copy of the cached requirements for key, if still fresh.
+func (c *quoteCache) get(key string) *types.PaymentRequirements {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	requirements := entry.requirements
+	return &requirements
+}
+
+// put stores the requirements quoted for key.
+func (c *quoteCache) put(key string, requirements *types.PaymentRequirements) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= maxQuoteCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxQuoteCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = quoteCacheEntry{
+		requirements: *requirements,
+		expires:      now.Add(c.ttl),
+	}
+}
+
+// invalidate drops the quote cached for key.
+func (c *quoteCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
@@ -0,0 +1,86 @@
+package x402pay
+
+import (
+	"strings"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+)
+
+// paymentFailure classifies why a seller rejected a payment the buyer submitted.
+type paymentFailure string
+
+const (
+	failureInvalidSignature  paymentFailure = "invalid_signature"
+	failureExpired           paymentFailure = "authorization_expired"
+	failureInsufficientFunds paymentFailure = "insufficient_funds"
+	failureSettlement        paymentFailure = "settlement_failed"
+	failureRequirements      paymentFailure = "requirements_mismatch"
+	failureUnknown           paymentFailure = "unknown"
+)
+
+// failureMarkers maps reason codes reported by x402 sellers and facilitators
+// to a failure class. Order matters: more specific markers come first.
+var failureMarkers = []struct {
+	marker  string
+	failure paymentFailure
+}{
+	{"invalid_signature", failureInvalidSignature},
+	{"authorization_expired", failureExpired},
+	{"authorization_not_yet_valid", failureExpired},
+	{"insufficient_funds", failureInsufficientFunds},
+	{"insufficient_value", failureRequirements},
+	{"recipient_mismatch", failureRequirements},
+	{"scheme/network mismatch", failureRequirements},
+	{"unsupported_scheme", failureRequirements},
+	{"unsupported_network", failureRequirements},
+	{"facilitator_insufficient_gas", failureSettlement},
+	{"transaction_failed", failureSettlement},
+	{"transaction_reverted", failureSettlement},
+	{"confirmation_failed", failureSettlement},
+	{"settlement failed", failureSettlement},
+}
+
+// classifyPaymentFailure inspects a 402 response received after a payment was
+// attached and determines what went wrong.
+func classifyPaymentFailure(resp *paymentRequiredResponse) paymentFailure {
+	text := strings.ToLower(resp.Error + " " + resp.Message + " " + resp.InvalidReason + " " + resp.ErrorReason)
+	for _, fm := range failureMarkers {
+		if strings.Contains(text, fm.marker) {
+			return fm.failure
+		}
+	}
+	return failureUnknown
+}
+
+// retryable reports whether paying again can possibly succeed.
+func (f paymentFailure) retryable() bool {
+	return f != failureInsufficientFunds
+}
+
+// requiresRequote reports whether the buyer should fetch fresh payment
+// requirements before signing again, rather than re-signing the last quote.
+func (f paymentFailure) requiresRequote() bool {
+	switch f {
+	case failureInvalidSignature, failureRequirements, failureUnknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// paymentAttempt records the outcome of a single paid retry.
+type paymentAttempt struct {
+	Attempt int            `json:"attempt"`
+	Amount  string         `json:"amount"`
+	Network string         `json:"network"`
+	Failure paymentFailure `json:"failure,omitempty"`
+	Message string         `json:"message,omitempty"`
+}
+
+// paymentFailureResponse is the structured error returned to the client when
+// the buyer gives up on paying for a resource.
+type paymentFailureResponse struct {
+	types.ErrorResponse
+	Reason   paymentFailure   `json:"reason"`
+	Attempts []paymentAttempt `json:"attempts"`
+}
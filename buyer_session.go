@@ -0,0 +1,263 @@
+package x402pay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"go.uber.org/zap"
+)
+
+// Hijack takes over the connection of an upgraded response. If the seller
+// meters the WebSocket session, the connection pays for it as it goes.
+func (s *streamPayer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(s.ResponseWriterWrapper.ResponseWriter).Hijack()
+	if err != nil || s.Header().Get(headerPaymentSessionUnit) == "" {
+		return conn, brw, err
+	}
+	if s.accepted != nil {
+		s.accepted()
+	}
+	s.m.ctx.Logger(s.m).Debug("paid connection is a metered WebSocket session",
+		zap.String("unit", s.Header().Get(headerPaymentSessionUnit)),
+		zap.String("allowance", s.Header().Get(headerPaymentSessionAllowance)),
+	)
+
+	session := newSessionPayer(s.m, s.r, conn)
+	if buffered := brw.Reader.Buffered(); buffered > 0 {
+		data, _ := brw.Peek(buffered)
+		session.pending = session.in.feed(data)
+	}
+	if err := brw.Writer.Flush(); err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	return session, bufio.NewReadWriter(bufio.NewReader(session), bufio.NewWriter(session)), nil
+}
+
+// sessionPayer is the client side of a WebSocket session metered by the
+// seller. It answers the seller's x402-payment-required messages with
+// x402-payment messages of its own, and keeps control messages from the
+// client.
+type sessionPayer struct {
+	net.Conn
+	m      *X402BuyerMiddleware
+	logger *zap.Logger
+
+	// ctx outlives the upgrade request but not the session
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// in follows what the client sends; pending is what is left of it to
+	// pass on. Only Read uses them.
+	in      wsFrameFilter
+	pending []byte
+	reads   chan sessionRead
+	inject  chan []byte
+
+	// out follows what the seller sends
+	writeMu sync.Mutex
+	out     wsFrameFilter
+
+	// held are the amounts of payments waiting for the seller's answer,
+	// oldest first
+	mu     sync.Mutex
+	held   []heldPayment
+	closed bool
+}
+
+// heldPayment is a session payment held on the wallet.
+type heldPayment struct {
+	amount       *big.Int
+	requirements *types.PaymentRequirements
+}
+
+// sessionRead is the result of a read from the client.
+type sessionRead struct {
+	data []byte
+	err  error
+}
+
+func newSessionPayer(m *X402BuyerMiddleware, r *http.Request, conn net.Conn) *sessionPayer {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	s := &sessionPayer{
+		Conn:   conn,
+		m:      m,
+		logger: m.ctx.Logger(m),
+		ctx:    ctx,
+		cancel: cancel,
+		reads:  make(chan sessionRead),
+		inject: make(chan []byte, 4),
+	}
+	s.out = wsFrameFilter{holdLimit: wsControlLimit, inspect: s.control}
+	go s.pump()
+	return s
+}
+
+// pump reads from the client, so that Read can send payments while the
+// client is quiet.
+func (s *sessionPayer) pump() {
+	for {
+		buf := make([]byte, 32<<10)
+		n, err := s.Conn.Read(buf)
+		select {
+		case s.reads <- sessionRead{data: buf[:n], err: err}:
+		case <-s.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read passes on what the client sends, with our payments in between its
+// messages.
+func (s *sessionPayer) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		inject := s.inject
+		if !s.in.atMessageBoundary() {
+			inject = nil
+		}
+		select {
+		case frame := <-inject:
+			s.pending = frame
+		case read := <-s.reads:
+			if len(read.data) > 0 {
+				s.pending = s.in.feed(read.data)
+			}
+			if read.err != nil && len(s.pending) == 0 {
+				return 0, read.err
+			}
+		case <-s.ctx.Done():
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Write passes on what the seller sends, minus control messages.
+func (s *sessionPayer) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.Conn.Write(s.out.feed(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the session. Payments the seller has not answered may have
+// been taken, so they count as spent.
+func (s *sessionPayer) Close() error {
+	s.mu.Lock()
+	held := s.held
+	s.held = nil
+	s.closed = true
+	s.mu.Unlock()
+	for _, payment := range held {
+		s.finish(payment, true)
+	}
+	s.cancel()
+	return s.Conn.Close()
+}
+
+// control takes x402 control messages out of what the seller sends.
+func (s *sessionPayer) control(payload []byte) bool {
+	switch wsControlType(payload) {
+	case wsPaymentRequired:
+		// Paying may take a while; the session goes on meanwhile
+		go s.pay(payload)
+	case wsPaymentAccepted:
+		s.answered(true, payload)
+	case wsPaymentRejected:
+		s.answered(false, payload)
+	default:
+		return false
+	}
+	return true
+}
+
+// pay answers a payment request from the seller.
+func (s *sessionPayer) pay(payload []byte) {
+	var request struct {
+		PaymentRequirements types.PaymentRequirements `json:"paymentRequirements"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		s.logger.Warn("invalid WebSocket payment request", zap.Error(err))
+		return
+	}
+	requirements := &request.PaymentRequirements
+	amount, paymentJSON, err := s.m.signTopUp(s.ctx, requirements)
+	if err != nil {
+		s.logger.Warn("failed to pay for WebSocket session", zap.Error(err))
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.m.wallet.finish(amount, false)
+		return
+	}
+	s.held = append(s.held, heldPayment{amount: amount, requirements: requirements})
+	s.mu.Unlock()
+
+	frame := wsControlFrame(map[string]any{
+		"type":    wsPayment,
+		"payment": json.RawMessage(paymentJSON),
+	}, true)
+	select {
+	case s.inject <- frame:
+	case <-s.ctx.Done():
+	}
+}
+
+// answered finishes the oldest payment the seller has not answered yet.
+func (s *sessionPayer) answered(accepted bool, payload []byte) {
+	s.mu.Lock()
+	if len(s.held) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	payment := s.held[0]
+	s.held = s.held[1:]
+	s.mu.Unlock()
+
+	s.finish(payment, accepted)
+	if accepted {
+		s.logger.Info("topped up WebSocket session",
+			zap.String("amount", payment.amount.String()),
+		)
+		return
+	}
+	var rejection struct {
+		Error string `json:"error"`
+	}
+	_ = json.Unmarshal(payload, &rejection)
+	s.logger.Warn("WebSocket session payment rejected",
+		zap.String("amount", payment.amount.String()),
+		zap.String("error", rejection.Error),
+	)
+}
+
+// finish releases a payment held on the wallet.
+func (s *sessionPayer) finish(payment heldPayment, spent bool) {
+	s.m.wallet.finish(payment.amount, spent)
+	if spent {
+		s.m.BalanceCheck.debit(payment.requirements.Network, payment.requirements.Asset, s.m.wallet.address(), payment.amount)
+	}
+}
+
+// Interface guards
+var (
+	_ http.Hijacker = (*streamPayer)(nil)
+	_ net.Conn      = (*sessionPayer)(nil)
+)
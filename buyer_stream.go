@@ -0,0 +1,295 @@
+package x402pay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// errStreamEnded means the seller no longer serves the stream a top-up was
+// meant for. Nothing was charged for the top-up.
+var errStreamEnded = errors.New("stream has ended")
+
+// streamPayer passes a paid response through to the client and, if the
+// seller meters it as a stream, keeps it going by topping up: event streams
+// are topped up when the seller's x402-payment-required event comes by,
+// which is not passed on, and other responses as soon as the allowance
+// paid for has been received.
+type streamPayer struct {
+	*caddyhttp.ResponseWriterWrapper
+	m    *X402BuyerMiddleware
+	r    *http.Request
+	next caddyhttp.Handler
+
+	// requirements are what the stream was first paid with; byte streams
+	// are topped up with the same. accepted is called once the seller has
+	// accepted that payment, whether or not the response is a stream.
+	requirements *types.PaymentRequirements
+	accepted     func()
+
+	active    bool
+	sse       bool
+	ended     bool
+	id        string
+	allowance int64
+	received  int64
+	paidUpTo  int64
+
+	// Event stream parsing state
+	block     []byte
+	lineEmpty bool
+}
+
+// WriteHeader picks up the stream announcement of a paid response.
+func (s *streamPayer) WriteHeader(status int) {
+	// Only 402 responses are held back, so any other final response, or an
+	// upgrade, means the seller took the payment: it stops holding one of
+	// the wallet's concurrency slots however long the response goes on
+	if s.accepted != nil && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		s.accepted()
+	}
+
+	id := s.Header().Get(headerPaymentStream)
+	if id != "" && status >= 200 && status < 300 && !s.active {
+		s.active = true
+		s.id = id
+		s.sse = strings.HasPrefix(s.Header().Get("Content-Type"), "text/event-stream")
+		s.allowance, _ = strconv.ParseInt(s.Header().Get(headerPaymentStreamAllowance), 10, 64)
+		s.paidUpTo = s.allowance
+		s.lineEmpty = true
+		s.m.ctx.Logger(s.m).Debug("paid response is a metered stream",
+			zap.String("stream", id),
+			zap.String("unit", s.Header().Get(headerPaymentStreamUnit)),
+			zap.Int64("allowance", s.allowance),
+		)
+	}
+	s.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// Write passes p on, topping up the stream as needed.
+func (s *streamPayer) Write(p []byte) (int, error) {
+	if !s.active {
+		return s.ResponseWriterWrapper.Write(p)
+	}
+	if s.sse {
+		return s.writeEvents(p)
+	}
+
+	n, err := s.ResponseWriterWrapper.Write(p)
+	s.received += int64(n)
+	if err != nil || s.ended || s.allowance <= 0 || s.received < s.paidUpTo {
+		return n, err
+	}
+
+	// The seller pauses here until it is paid again, unless the response
+	// happens to end exactly at the allowance
+	if err := s.topUp(s.requirements); err != nil {
+		if errors.Is(err, errStreamEnded) {
+			s.ended = true
+			return n, nil
+		}
+		return n, err
+	}
+	s.paidUpTo += s.allowance
+	return n, nil
+}
+
+// writeEvents passes on complete events, answering the seller's payment
+// requests instead of passing them on.
+func (s *streamPayer) writeEvents(p []byte) (int, error) {
+	start := 0
+	for i, c := range p {
+		if c == '\r' {
+			continue
+		}
+		if c != '\n' {
+			s.lineEmpty = false
+			continue
+		}
+		if !s.lineEmpty {
+			s.lineEmpty = true
+			continue
+		}
+
+		// A blank line ends the block
+		s.block = append(s.block, p[start:i+1]...)
+		start = i + 1
+		block := s.block
+		s.block = nil
+		if err := s.handleBlock(block); err != nil {
+			return start, err
+		}
+	}
+	s.block = append(s.block, p[start:]...)
+	return len(p), nil
+}
+
+// handleBlock passes on a complete block of an event stream, or pays for
+// the stream if the block is a payment request.
+func (s *streamPayer) handleBlock(block []byte) error {
+	var event, data string
+	for _, line := range strings.Split(string(block), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if value, ok := strings.CutPrefix(line, "event:"); ok {
+			event = strings.TrimSpace(value)
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data += strings.TrimPrefix(value, " ")
+		}
+	}
+	if event != streamPaymentRequiredEvent {
+		_, err := s.ResponseWriterWrapper.Write(block)
+		return err
+	}
+
+	var request struct {
+		Stream              string                    `json:"stream"`
+		PaymentRequirements types.PaymentRequirements `json:"paymentRequirements"`
+	}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		return fmt.Errorf("invalid %s event: %w", streamPaymentRequiredEvent, err)
+	}
+	if request.Stream == "" {
+		request.Stream = s.id
+	}
+	s.id = request.Stream
+	return s.topUp(&request.PaymentRequirements)
+}
+
+// finish passes on what is left of an event stream that did not end with
+// a blank line.
+func (s *streamPayer) finish() error {
+	if len(s.block) == 0 {
+		return nil
+	}
+	block := s.block
+	s.block = nil
+	_, err := s.ResponseWriterWrapper.Write(block)
+	return err
+}
+
+// ReadFrom copies through Write, so that the copy is metered.
+func (s *streamPayer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{s}, r)
+}
+
+// topUp pays for more of the stream.
+func (s *streamPayer) topUp(requirements *types.PaymentRequirements) error {
+	if requirements == nil {
+		return fmt.Errorf("no payment requirements to top up stream %s with", s.id)
+	}
+	err := s.m.payTopUp(s.r, s.next, s.id, requirements)
+	if err != nil && !errors.Is(err, errStreamEnded) {
+		s.m.ctx.Logger(s.m).Warn("failed to top up stream",
+			zap.String("stream", s.id),
+			zap.Error(err),
+		)
+	}
+	return err
+}
+
+// payTopUp sends a payment for the stream with the given ID to the same
+// resource r requested, through next.
+func (m *X402BuyerMiddleware) payTopUp(r *http.Request, next caddyhttp.Handler, id string, requirements *types.PaymentRequirements) error {
+	ctx := r.Context()
+	amount, paymentJSON, err := m.signTopUp(ctx, requirements)
+	if err != nil {
+		return err
+	}
+
+	// The top-up goes out as a request of its own, with its own body and
+	// headers, but on the stream's context so that it is abandoned if the
+	// client goes away
+	req := r.Clone(ctx)
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.Header.Del("Content-Length")
+	req.Header.Set("X-Payment", string(paymentJSON))
+	req.Header.Set(headerPaymentStream, id)
+	rec := &topUpRecorder{header: make(http.Header)}
+	server, _ := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), rec, server)
+
+	err = next.ServeHTTP(rec, req)
+	accepted := err == nil && rec.status == http.StatusOK
+	m.wallet.finish(amount, accepted)
+	switch {
+	case accepted:
+		m.BalanceCheck.debit(requirements.Network, requirements.Asset, m.wallet.address(), amount)
+		m.ctx.Logger(m).Info("topped up stream",
+			zap.String("stream", id),
+			zap.String("amount", amount.String()),
+		)
+		return nil
+	case err != nil:
+		return err
+	case rec.status == http.StatusGone:
+		return errStreamEnded
+	default:
+		return fmt.Errorf("top-up rejected with status %d: %s", rec.status, bytes.TrimSpace(rec.body.Bytes()))
+	}
+}
+
+// signTopUp checks a top-up against the limits of the wallet, signs it and
+// holds its amount on the wallet. The caller must finish the hold.
+func (m *X402BuyerMiddleware) signTopUp(ctx context.Context, requirements *types.PaymentRequirements) (*big.Int, []byte, error) {
+	amount, ok := new(big.Int).SetString(requirements.MaxAmountRequired, 10)
+	if !ok || amount.Sign() < 0 {
+		return nil, nil, fmt.Errorf("invalid top-up amount %q", requirements.MaxAmountRequired)
+	}
+	if m.parsedMaxAmountPay > 0 && amount.Cmp(big.NewInt(m.parsedMaxAmountPay)) > 0 {
+		return nil, nil, fmt.Errorf("top-up of %s exceeds max_amount_pay %d", amount, m.parsedMaxAmountPay)
+	}
+	if err := m.checkBalance(ctx, requirements, amount); errors.Is(err, errInsufficientFunds) {
+		return nil, nil, err
+	}
+
+	paymentPayload, err := m.createPaymentPayload(ctx, requirements)
+	if err != nil {
+		return nil, nil, err
+	}
+	paymentJSON, err := json.Marshal(paymentPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := m.wallet.authorize(ctx, amount); err != nil {
+		return nil, nil, err
+	}
+	return amount, paymentJSON, nil
+}
+
+// topUpRecorder records the response to a top-up.
+type topUpRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (t *topUpRecorder) Header() http.Header {
+	return t.header
+}
+
+func (t *topUpRecorder) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+}
+
+func (t *topUpRecorder) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	return t.body.Write(p)
+}
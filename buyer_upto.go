@@ -0,0 +1,116 @@
+package x402pay
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"go.uber.org/zap"
+)
+
+// createUptoPayload signs an upto scheme payment: a permit letting the
+// facilitator named in the requirements move up to the maximum price from
+// the wallet. The seller only collects what the response actually cost.
+func (m *X402BuyerMiddleware) createUptoPayload(ctx context.Context, requirements *types.PaymentRequirements, chainNetwork *ChainNetworkConfig) (*types.PaymentPayload, error) {
+	spender, _ := requirements.Extra["spender"].(string)
+	if !common.IsHexAddress(spender) {
+		return nil, fmt.Errorf("upto payment requirements name no spender")
+	}
+
+	// Sign for the token's EIP-712 domain as configured locally, if the
+	// asset is known, as for exact payments
+	name, version := requirements.TokenName, requirements.TokenVersion
+	if asset, ok := chainNetwork.asset(requirements.Asset); ok && requirements.Asset != "" {
+		if asset.Name != "" {
+			name = asset.Name
+		}
+		if asset.Version != "" {
+			version = asset.Version
+		}
+	}
+
+	client, err := m.rpcClients.get(ctx, chainNetwork)
+	if err != nil {
+		return nil, err
+	}
+	owner := crypto.PubkeyToAddress(m.privateKey.PublicKey)
+	queryCtx, cancel := context.WithTimeout(ctx, balanceQueryTimeout)
+	nonce, err := permitNonce(queryCtx, client, requirements.Asset, owner.Hex())
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("getting permit nonce: %w", err)
+	}
+
+	permit := uptoPermit{
+		Owner:    owner.Hex(),
+		Spender:  common.HexToAddress(spender).Hex(),
+		Value:    strings.TrimSpace(requirements.MaxAmountRequired),
+		Nonce:    nonce.String(),
+		Deadline: fmt.Sprint(time.Now().Add(uptoPermitValidity).Unix()),
+	}
+	signature, err := signPermit(permit, chainNetwork.ID, requirements.Asset, name, version, m.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing permit: %w", err)
+	}
+
+	return &types.PaymentPayload{
+		X402Version: 1,
+		Scheme:      schemeUpto,
+		Network:     requirements.Network,
+		Payload: uptoEVMPayload{
+			Signature: signature,
+			Permit:    permit,
+		},
+	}, nil
+}
+
+// chainClients dials RPC clients for chain networks on first use and keeps
+// them for later requests.
+type chainClients struct {
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	clients map[string]*ethclient.Client
+}
+
+func newChainClients(logger *zap.Logger) *chainClients {
+	return &chainClients{
+		logger:  logger,
+		clients: make(map[string]*ethclient.Client),
+	}
+}
+
+// get returns an RPC client for network, dialing it on first use.
+func (c *chainClients) get(ctx context.Context, network *ChainNetworkConfig) (*ethclient.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.clients[network.Name]; ok {
+		return client, nil
+	}
+	client, _, err := dialChainNetwork(ctx, *network, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[network.Name] = client
+	return client, nil
+}
+
+// close closes the RPC clients.
+func (c *chainClients) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, client := range c.clients {
+		client.Close()
+	}
+	c.clients = make(map[string]*ethclient.Client)
+}
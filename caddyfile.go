@@ -2,18 +2,23 @@ package x402pay
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
 	httpcaddyfile.RegisterGlobalOption("chain_network", parseChainNetworkGlobal)
 	httpcaddyfile.RegisterGlobalOption("x402.facilitator", parseX402Facilitator)
+	httpcaddyfile.RegisterGlobalOption("x402.wallets", parseX402Wallets)
 	httpcaddyfile.RegisterHandlerDirective("x402seller", parseX402Seller)
 	httpcaddyfile.RegisterHandlerDirective("x402buyer", parseX402Buyer)
+	httpcaddyfile.RegisterHandlerDirective("x402health", parseX402Health)
 }
 
 // Global storage for chain networks parsed from Caddyfile
@@ -72,6 +77,101 @@ func parseX402Facilitator(d *caddyfile.Dispenser, _ any) (any, error) {
 	}, nil
 }
 
+// parseX402Wallets parses the x402.wallets app configuration.
+// Syntax: x402.wallets { ... }
+func parseX402Wallets(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := &X402WalletsApp{}
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+
+	return httpcaddyfile.App{
+		Name:  "x402.wallets",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler for X402WalletsApp. Syntax:
+//
+//	x402.wallets {
+//	    wallet <name> {
+//	        private_key {$X402_AGENT_PRIVATE_KEY}
+//	        budget 50000000
+//	        budget_window 24h
+//	        max_concurrent 4
+//	    }
+//	}
+func (m *X402WalletsApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.Err("expected directive name")
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "wallet":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wallet := WalletConfig{Name: d.Val()}
+			if err := parseWallet(d, &wallet); err != nil {
+				return err
+			}
+			m.Wallets = append(m.Wallets, wallet)
+
+		default:
+			return d.Errf("unknown subdirective: %s", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// parseWallet parses a wallet block.
+func parseWallet(d *caddyfile.Dispenser, config *WalletConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "private_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.PrivateKey = d.Val()
+
+		case "budget":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Budget = d.Val()
+
+		case "budget_window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			window, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid budget_window: %v", err)
+			}
+			config.BudgetWindow = caddy.Duration(window)
+
+		case "max_concurrent":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var maxConcurrent int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &maxConcurrent); err != nil {
+				return d.Errf("invalid max_concurrent: %v", err)
+			}
+			config.MaxConcurrent = maxConcurrent
+
+		default:
+			return d.Errf("unknown wallet subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
 // parseX402Seller parses the x402seller handler directive.
 func parseX402Seller(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m X402SellerMiddleware
@@ -84,8 +184,37 @@ func parseX402Seller(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error
 //	x402.facilitator {
 //	    private_key 0x...
 //	    supported_schemes exact
-//	    gas_limit 21000
-//	    gas_price 10
+//	    gas_limit 150000
+//	    gas_price 1000000000
+//	    validate_online
+//	    gas_monitor {
+//	        interval 1m
+//	        low_water_mark 10000000000000000
+//	        refuse_when_low
+//	    }
+//	    health_check {
+//	        interval 15s
+//	        timeout 5s
+//	        max_block_age 2m|off
+//	    }
+//	    nonce_manager {
+//	        stuck_after 2m
+//	        fee_bump 20
+//	        max_replacements 5
+//	        check_interval 15s
+//	    }
+//	    settlement_queue {
+//	        workers 1
+//	        max_attempts 5
+//	        retry_backoff 10s
+//	        retention 168h
+//	        directory /var/lib/caddy/x402 | storage <module> { ... }
+//	        batch {
+//	            max_size 20
+//	            max_wait 30s
+//	            multicall [<address>]
+//	        }
+//	    }
 //	}
 func (m *X402FacilitatorApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	// When called from RegisterGlobalOption, the Dispenser is already positioned
@@ -119,6 +248,12 @@ func (m *X402FacilitatorApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			m.SupportedSchemes = args
 
+		case "validate_online":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ValidateOnline = true
+
 		case "gas_limit":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -139,6 +274,42 @@ func (m *X402FacilitatorApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			m.GasPrice = gasPrice
 
+		case "gas_monitor":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.GasMonitor = new(GasMonitor)
+			if err := parseGasMonitor(d, m.GasMonitor); err != nil {
+				return err
+			}
+
+		case "health_check":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.HealthCheck = new(HealthCheck)
+			if err := parseHealthCheck(d, m.HealthCheck); err != nil {
+				return err
+			}
+
+		case "nonce_manager":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.NonceManager = new(NonceManager)
+			if err := parseNonceManager(d, m.NonceManager); err != nil {
+				return err
+			}
+
+		case "settlement_queue":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SettlementQueue = new(SettlementQueue)
+			if err := parseSettlementQueue(d, m.SettlementQueue); err != nil {
+				return err
+			}
+
 		default:
 			return d.Errf("unknown subdirective: %s", d.Val())
 		}
@@ -147,177 +318,1284 @@ func (m *X402FacilitatorApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
-// parseChainNetwork parses a chain_network block.
-func parseChainNetwork(d *caddyfile.Dispenser, config *ChainNetworkConfig) error {
+// parseGasMonitor parses a gas_monitor block.
+func parseGasMonitor(d *caddyfile.Dispenser, config *GasMonitor) error {
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
-		case "rpc":
+		case "interval":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			config.RPC = d.Val()
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid gas_monitor interval: %v", err)
+			}
+			config.Interval = caddy.Duration(interval)
 
-		case "id":
+		case "low_water_mark":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			var chainID uint64
-			if _, err := fmt.Sscanf(d.Val(), "%d", &chainID); err != nil {
-				return d.Errf("invalid chain id: %v", err)
+			config.LowWaterMark = d.Val()
+
+		case "refuse_when_low":
+			if d.NextArg() {
+				return d.ArgErr()
 			}
-			config.ID = chainID
+			config.RefuseWhenLow = true
 
-		case "token_address":
+		default:
+			return d.Errf("unknown gas_monitor subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseHealthCheck parses a health_check block.
+func parseHealthCheck(d *caddyfile.Dispenser, config *HealthCheck) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "interval":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			config.TokenAddress = d.Val()
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid health_check interval: %v", err)
+			}
+			config.Interval = caddy.Duration(interval)
 
-		case "token_name":
+		case "timeout":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			config.TokenName = d.Val()
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid health_check timeout: %v", err)
+			}
+			config.Timeout = caddy.Duration(timeout)
 
-		case "token_version":
+		case "max_block_age":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			config.TokenVersion = d.Val()
+			if d.Val() == "off" {
+				config.MaxBlockAge = -1
+				break
+			}
+			maxAge, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid health_check max_block_age: %v", err)
+			}
+			config.MaxBlockAge = caddy.Duration(maxAge)
 
-		case "token_decimals":
+		default:
+			return d.Errf("unknown health_check subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseNonceManager parses a nonce_manager block.
+func parseNonceManager(d *caddyfile.Dispenser, config *NonceManager) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "stuck_after":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			var decimals int64
-			if _, err := fmt.Sscanf(d.Val(), "%d", &decimals); err != nil {
-				return d.Errf("invalid token_decimals: %v", err)
+			stuckAfter, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid nonce_manager stuck_after: %v", err)
 			}
-			config.TokenDecimals = decimals
+			config.StuckAfter = caddy.Duration(stuckAfter)
 
-		case "token_type":
+		case "fee_bump":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			config.TokenType = d.Val()
+			var bump int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &bump); err != nil {
+				return d.Errf("invalid nonce_manager fee_bump: %v", err)
+			}
+			config.FeeBump = bump
+
+		case "max_replacements":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var replacements int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &replacements); err != nil {
+				return d.Errf("invalid nonce_manager max_replacements: %v", err)
+			}
+			config.MaxReplacements = replacements
+
+		case "check_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid nonce_manager check_interval: %v", err)
+			}
+			config.CheckInterval = caddy.Duration(interval)
 
 		default:
-			return d.Errf("unknown chain_network subdirective: %s", d.Val())
+			return d.Errf("unknown nonce_manager subdirective: %s", d.Val())
 		}
 	}
 	return nil
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler for X402SellerMiddleware. Syntax:
-//
-//	x402seller [<pattern>] {
-//	    scheme exact
-//	    network localhost
-//	    resource premium-data-api
-//	    description "Access to premium market data"
-//	    max_amount_required 1000000
-//	    pay_to 0x93866dBB587db8b9f2C36570Ae083E3F9814e508
-//	}
-func (m *X402SellerMiddleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume directive name
-	if d.NextArg() {
-		return d.ArgErr()
-	}
-
-	for d.NextBlock(0) {
+// parseSettlementQueue parses a settlement_queue block.
+func parseSettlementQueue(d *caddyfile.Dispenser, config *SettlementQueue) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
-		case "scheme":
+		case "workers":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.Scheme = d.Val()
+			var workers int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &workers); err != nil {
+				return d.Errf("invalid settlement_queue workers: %v", err)
+			}
+			config.Workers = workers
 
-		case "network":
+		case "max_attempts":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.Network = d.Val()
+			var attempts int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &attempts); err != nil {
+				return d.Errf("invalid settlement_queue max_attempts: %v", err)
+			}
+			config.MaxAttempts = attempts
 
-		case "resource":
+		case "retry_backoff":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.Resource = d.Val()
+			backoff, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid settlement_queue retry_backoff: %v", err)
+			}
+			config.RetryBackoff = caddy.Duration(backoff)
 
-		case "description":
+		case "retention":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.Description = d.Val()
+			retention, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid settlement_queue retention: %v", err)
+			}
+			config.Retention = caddy.Duration(retention)
 
-		case "max_amount_required":
+		case "directory":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.MaxAmountRequired = d.Val()
+			config.Directory = d.Val()
 
-		case "pay_to":
+		case "storage":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.PayTo = d.Val()
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "caddy.storage."+name)
+			if err != nil {
+				return err
+			}
+			if _, ok := unm.(caddy.StorageConverter); !ok {
+				return d.Errf("module caddy.storage.%s is not a caddy.StorageConverter", name)
+			}
+			config.StorageRaw = caddyconfig.JSONModuleObject(unm, "module", name, nil)
+
+		case "batch":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Batch = new(SettlementBatch)
+			if err := parseSettlementBatch(d, config.Batch); err != nil {
+				return err
+			}
 
 		default:
-			return d.Errf("unknown subdirective: %s", d.Val())
+			return d.Errf("unknown settlement_queue subdirective: %s", d.Val())
 		}
 	}
-
 	return nil
 }
 
-// parseX402Buyer parses the x402buyer handler directive.
-func parseX402Buyer(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var m X402BuyerMiddleware
-	// Import global chain networks
-	if len(globalChainNetworks) > 0 {
-		m.ChainNetworks = make([]ChainNetworkConfig, len(globalChainNetworks))
-		copy(m.ChainNetworks, globalChainNetworks)
+// parseSettlementBatch parses a settlement_queue batch block.
+func parseSettlementBatch(d *caddyfile.Dispenser, config *SettlementBatch) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "max_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var size int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &size); err != nil {
+				return d.Errf("invalid batch max_size: %v", err)
+			}
+			config.MaxSize = size
+
+		case "max_wait":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			wait, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid batch max_wait: %v", err)
+			}
+			config.MaxWait = caddy.Duration(wait)
+
+		case "multicall":
+			config.Multicall = defaultMulticallAddress
+			if d.NextArg() {
+				config.Multicall = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		default:
+			return d.Errf("unknown batch subdirective: %s", d.Val())
+		}
 	}
-	err := m.UnmarshalCaddyfile(h.Dispenser)
-	return &m, err
+	return nil
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler for X402BuyerMiddleware. Syntax:
+// parseChainNetwork parses a chain_network block. Networks named like a
+// built-in preset, or naming one with "preset <name>", only need the
+// fields that differ from it. The rpc subdirective may
+// be repeated and may list several URLs, optionally with a per-endpoint
+// timeout:
 //
-//	x402buyer {
-//	    private_key {$X402_BUYER_PRIVATE_KEY}
-//	    max_amount_pay 2000000
-//	    max_retries 1
+//	rpc <urls...> {
+//	    timeout 5s
 //	}
-func (m *X402BuyerMiddleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume directive name
-	if d.NextArg() {
-		return d.ArgErr()
-	}
-
-	for d.NextBlock(0) {
+//	rpc_policy first_healthy|round_robin|lowest_latency
+//	rpc_timeout 10s
+//	rpc_retries 2
+//	confirmations 12
+//
+// Tokens besides the network's own token_address are added with asset,
+// which may be repeated:
+//
+//	asset <symbol> <address> {
+//	    name "EURC"
+//	    version 2
+//	    decimals 6
+//	    type ERC20
+//	}
+func parseChainNetwork(d *caddyfile.Dispenser, config *ChainNetworkConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
-		case "private_key":
+		case "preset":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.PrivateKeyHex = d.Val()
+			config.Preset = d.Val()
 
-		case "max_amount_pay":
+		case "rpc":
+			urls := d.RemainingArgs()
+			if len(urls) == 0 {
+				return d.ArgErr()
+			}
+			var timeout caddy.Duration
+			for rpcNesting := d.Nesting(); d.NextBlock(rpcNesting); {
+				switch d.Val() {
+				case "timeout":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid rpc timeout: %v", err)
+					}
+					timeout = caddy.Duration(dur)
+
+				default:
+					return d.Errf("unknown rpc subdirective: %s", d.Val())
+				}
+			}
+			if config.RPC == "" && timeout == 0 {
+				config.RPC = urls[0]
+				urls = urls[1:]
+			}
+			for _, u := range urls {
+				config.RPCEndpoints = append(config.RPCEndpoints, RPCEndpoint{URL: u, Timeout: timeout})
+			}
+
+		case "rpc_policy":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			m.MaxAmountPay = d.Val()
+			config.RPCPolicy = d.Val()
 
-		case "max_retries":
+		case "rpc_timeout":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			var maxRetries int
-			if _, err := fmt.Sscanf(d.Val(), "%d", &maxRetries); err != nil {
-				return d.Errf("invalid max_retries: %v", err)
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid rpc_timeout: %v", err)
 			}
-			m.MaxRetries = maxRetries
+			config.RPCTimeout = caddy.Duration(timeout)
+
+		case "rpc_retries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var retries int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &retries); err != nil {
+				return d.Errf("invalid rpc_retries: %v", err)
+			}
+			config.RPCRetries = retries
+
+		case "id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var chainID uint64
+			if _, err := fmt.Sscanf(d.Val(), "%d", &chainID); err != nil {
+				return d.Errf("invalid chain id: %v", err)
+			}
+			config.ID = chainID
+
+		case "token_address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.TokenAddress = d.Val()
+
+		case "token_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.TokenName = d.Val()
+
+		case "token_version":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.TokenVersion = d.Val()
+
+		case "token_decimals":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var decimals int64
+			if _, err := fmt.Sscanf(d.Val(), "%d", &decimals); err != nil {
+				return d.Errf("invalid token_decimals: %v", err)
+			}
+			config.TokenDecimals = decimals
+
+		case "token_type":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.TokenType = d.Val()
+
+		case "token_symbol":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.TokenSymbol = d.Val()
+
+		case "asset":
+			var asset ChainAsset
+			if !d.Args(&asset.Symbol, &asset.Address) {
+				return d.ArgErr()
+			}
+			if err := parseChainAsset(d, &asset); err != nil {
+				return err
+			}
+			config.Assets = append(config.Assets, asset)
+
+		case "gas_low_water_mark":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.GasLowWaterMark = d.Val()
+
+		case "confirmations":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var confirmations int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &confirmations); err != nil {
+				return d.Errf("invalid confirmations: %v", err)
+			}
+			config.Confirmations = confirmations
+
+		default:
+			return d.Errf("unknown chain_network subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseChainAsset parses the block of a chain_network asset.
+func parseChainAsset(d *caddyfile.Dispenser, asset *ChainAsset) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			asset.Name = d.Val()
+
+		case "version":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			asset.Version = d.Val()
+
+		case "decimals":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var decimals int64
+			if _, err := fmt.Sscanf(d.Val(), "%d", &decimals); err != nil {
+				return d.Errf("invalid asset decimals: %v", err)
+			}
+			asset.Decimals = decimals
+
+		case "type":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			asset.Type = d.Val()
+
+		default:
+			return d.Errf("unknown asset subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler for X402SellerMiddleware. Syntax:
+//
+//	x402seller [<pattern>] {
+//	    scheme exact|upto
+//	    network localhost
+//	    resource premium-data-api
+//	    description "Access to premium market data"
+//	    max_amount_required 1000000
+//	    pay_to 0x93866dBB587db8b9f2C36570Ae083E3F9814e508
+//	    asset USDC
+//	    settlement sync|optimistic
+//	    usage_header X-Usage-Cost
+//	    stream {
+//	        unit bytes|events
+//	        allowance 65536
+//	        topup_timeout 30s
+//	    }
+//	    session {
+//	        unit duration|messages
+//	        allowance <duration>|<messages>
+//	        grace 10s
+//	    }
+//	    jsonrpc {
+//	        method <method> <amount>
+//	        tool <tool> <amount>
+//	        default <amount>
+//	    }
+//	    graphql {
+//	        operation <name>|query|mutation|subscription <amount>
+//	        field [<parent>.]<field> <amount>
+//	        default_field <amount>
+//	        depth_multiplier 1.5
+//	        list_arguments first last limit
+//	        max_depth 32
+//	    }
+//	    rate_card <file> {
+//	        format json|yaml|csv
+//	        check_interval 5s
+//	    }
+//	    free_tier {
+//	        requests 100
+//	        window 24h
+//	        identity ip|header <name>|wallet
+//	        max_clients 100000
+//	        store memory|storage
+//	        directory <path>
+//	        storage <module> { ... }
+//	    }
+//	    split {
+//	        mode transfer|contract
+//	        contract <address>
+//	        payee <address> <percent>%|<amount>
+//	    }
+//	}
+//
+// Under the upto scheme max_amount_required is the most a request may
+// cost; the upstream reports the actual cost in the usage header or
+// trailer, and only that is settled once the response is done.
+//
+// With a stream block, each payment of max_amount_required buys allowance
+// units of the response, and the buyer tops up in-band whenever they run
+// out. A session block does the same for WebSocket connections upgraded
+// from a paid request, with x402 control messages sent over the socket.
+//
+// A jsonrpc block prices JSON-RPC request bodies, batches included, by
+// method, and MCP tools/call requests by tool; methods priced 0, such as
+// tools/list, are served without payment. Unpaid requests get the payment
+// requirements in a JSON-RPC error.
+//
+// A graphql block prices GraphQL requests instead: each operation costs
+// its base price plus what the fields it selects cost, weighted by how
+// deep they are nested and by the list sizes asked for above them, and
+// the total is what the buyer is asked to pay. Queries nested deeper than
+// max_depth, 32 by default, are refused.
+//
+// A rate_card names a file of rates matching requests by path pattern,
+// method and host, which set their price and optionally network, asset and
+// pay_to. The file is reloaded when it changes; if it no longer loads, the
+// previous rates stay in effect.
+//
+// A free_tier block serves each client that many requests per window
+// without payment, telling clients apart by IP address, by a header such
+// as an API key, or by the wallet address of an X-Payment-Identity header
+// signed for the host requested. A wallet identity only proves
+// the client holds the key, and new keys are free to make. Counts are kept
+// in memory, or with store storage in Caddy's storage, a directory, or a
+// storage module, shared by every instance using it. At most max_clients
+// clients are counted at once; beyond that, new clients pay.
+//
+// A split block shares each payment between the payees listed, each
+// taking a percentage or a fixed amount in turn, and pay_to, which gets
+// the rest. In transfer mode the facilitator collects the payment and pays
+// the payees once it is settled; in contract mode the payment goes to a
+// splitter contract. Each share is recorded as a leg of the payment in the
+// settlement queue's journal.
+func (m *X402SellerMiddleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "scheme":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Scheme = d.Val()
+
+		case "network":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Network = d.Val()
+
+		case "resource":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Resource = d.Val()
+
+		case "description":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Description = d.Val()
+
+		case "max_amount_required":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.MaxAmountRequired = d.Val()
+
+		case "pay_to":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.PayTo = d.Val()
+
+		case "asset":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Asset = d.Val()
+
+		case "settlement":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Settlement = d.Val()
+
+		case "usage_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.UsageHeader = d.Val()
+
+		case "stream":
+			m.Stream = new(PaymentStream)
+			if err := parsePaymentStream(d, m.Stream); err != nil {
+				return err
+			}
+
+		case "session":
+			m.Session = new(PaymentSession)
+			if err := parsePaymentSession(d, m.Session); err != nil {
+				return err
+			}
+
+		case "jsonrpc":
+			m.JSONRPC = new(JSONRPCPricing)
+			if err := parseJSONRPCPricing(d, m.JSONRPC); err != nil {
+				return err
+			}
+
+		case "graphql":
+			m.GraphQL = new(GraphQLPricing)
+			if err := parseGraphQLPricing(d, m.GraphQL); err != nil {
+				return err
+			}
+
+		case "rate_card":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RateCard = &RateCard{File: d.Val()}
+			if err := parseRateCard(d, m.RateCard); err != nil {
+				return err
+			}
+
+		case "free_tier":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.FreeTier = new(FreeTier)
+			if err := parseFreeTier(d, m.FreeTier); err != nil {
+				return err
+			}
+
+		case "split":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Split = new(RevenueSplit)
+			if err := parseRevenueSplit(d, m.Split); err != nil {
+				return err
+			}
+
+		default:
+			return d.Errf("unknown subdirective: %s", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// parseRevenueSplit parses the block of a seller split.
+func parseRevenueSplit(d *caddyfile.Dispenser, config *RevenueSplit) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Mode = d.Val()
+
+		case "contract":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Contract = d.Val()
+
+		case "payee":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			payee := SplitPayee{Address: args[0]}
+			if percent, ok := strings.CutSuffix(args[1], "%"); ok {
+				payee.Percent = percent
+			} else {
+				payee.Amount = args[1]
+			}
+			config.Payees = append(config.Payees, payee)
+
+		default:
+			return d.Errf("unknown split subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseFreeTier parses the block of a seller free_tier.
+func parseFreeTier(d *caddyfile.Dispenser, config *FreeTier) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "requests":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if _, err := fmt.Sscanf(d.Val(), "%d", &config.Requests); err != nil {
+				return d.Errf("invalid free_tier requests: %v", err)
+			}
+
+		case "window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			window, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid free_tier window: %v", err)
+			}
+			config.Window = caddy.Duration(window)
+
+		case "identity":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Identity = d.Val()
+			if config.Identity == "header" {
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				config.Header = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "max_clients":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if _, err := fmt.Sscanf(d.Val(), "%d", &config.MaxClients); err != nil {
+				return d.Errf("invalid free_tier max_clients: %v", err)
+			}
+
+		case "store":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Store = d.Val()
+
+		case "directory":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Directory = d.Val()
+
+		case "storage":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "caddy.storage."+name)
+			if err != nil {
+				return err
+			}
+			if _, ok := unm.(caddy.StorageConverter); !ok {
+				return d.Errf("module caddy.storage.%s is not a caddy.StorageConverter", name)
+			}
+			config.StorageRaw = caddyconfig.JSONModuleObject(unm, "module", name, nil)
+
+		default:
+			return d.Errf("unknown free_tier subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseRateCard parses the block of a seller rate_card.
+func parseRateCard(d *caddyfile.Dispenser, config *RateCard) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Format = d.Val()
+
+		case "check_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid rate_card check_interval: %v", err)
+			}
+			config.CheckInterval = caddy.Duration(interval)
+
+		default:
+			return d.Errf("unknown rate_card subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseGraphQLPricing parses a seller graphql block.
+func parseGraphQLPricing(d *caddyfile.Dispenser, config *GraphQLPricing) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "operation":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if config.Operations == nil {
+				config.Operations = make(map[string]string)
+			}
+			config.Operations[args[0]] = args[1]
+
+		case "field":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if config.Fields == nil {
+				config.Fields = make(map[string]string)
+			}
+			config.Fields[args[0]] = args[1]
+
+		case "default_field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.DefaultField = d.Val()
+
+		case "depth_multiplier":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.DepthMultiplier = d.Val()
+
+		case "list_arguments":
+			config.ListArguments = d.RemainingArgs()
+			if len(config.ListArguments) == 0 {
+				return d.ArgErr()
+			}
+
+		case "max_depth":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var maxDepth int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &maxDepth); err != nil {
+				return d.Errf("invalid graphql max_depth: %v", err)
+			}
+			config.MaxDepth = maxDepth
+
+		default:
+			return d.Errf("unknown graphql subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseJSONRPCPricing parses a seller jsonrpc block.
+func parseJSONRPCPricing(d *caddyfile.Dispenser, config *JSONRPCPricing) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "method":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if config.Methods == nil {
+				config.Methods = make(map[string]string)
+			}
+			config.Methods[args[0]] = args[1]
+
+		case "tool":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if config.Tools == nil {
+				config.Tools = make(map[string]string)
+			}
+			config.Tools[args[0]] = args[1]
+
+		case "default":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Default = d.Val()
+
+		default:
+			return d.Errf("unknown jsonrpc subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parsePaymentSession parses a seller session block.
+func parsePaymentSession(d *caddyfile.Dispenser, config *PaymentSession) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "unit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Unit = d.Val()
+
+		case "allowance":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			// A duration of session time, or a number of messages
+			if duration, err := caddy.ParseDuration(d.Val()); err == nil {
+				config.Duration = caddy.Duration(duration)
+				continue
+			}
+			var allowance int64
+			if _, err := fmt.Sscanf(d.Val(), "%d", &allowance); err != nil {
+				return d.Errf("invalid session allowance %q: expected a duration or a number of messages", d.Val())
+			}
+			config.Allowance = allowance
+
+		case "grace":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			grace, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid session grace: %v", err)
+			}
+			config.Grace = caddy.Duration(grace)
+
+		default:
+			return d.Errf("unknown session subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parsePaymentStream parses a seller stream block.
+func parsePaymentStream(d *caddyfile.Dispenser, config *PaymentStream) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "unit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Unit = d.Val()
+
+		case "allowance":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var allowance int64
+			if _, err := fmt.Sscanf(d.Val(), "%d", &allowance); err != nil {
+				return d.Errf("invalid stream allowance: %v", err)
+			}
+			config.Allowance = allowance
+
+		case "topup_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid stream topup_timeout: %v", err)
+			}
+			config.TopUpTimeout = caddy.Duration(timeout)
+
+		default:
+			return d.Errf("unknown stream subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseX402Buyer parses the x402buyer handler directive.
+func parseX402Buyer(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m X402BuyerMiddleware
+	// Import global chain networks
+	if len(globalChainNetworks) > 0 {
+		m.ChainNetworks = make([]ChainNetworkConfig, len(globalChainNetworks))
+		copy(m.ChainNetworks, globalChainNetworks)
+	}
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler for X402BuyerMiddleware. Syntax:
+//
+//	x402buyer {
+//	    private_key {$X402_BUYER_PRIVATE_KEY} | wallet <name>
+//	    max_amount_pay 2000000
+//	    max_retries 1
+//	    quote_cache_ttl 5m
+//	    approval {
+//	        threshold 500000
+//	        url http://127.0.0.1:9402/approve | handler <module> { ... }
+//	        timeout 2m
+//	    }
+//	    balance_check {
+//	        cache_ttl 30s
+//	        low_balance 5000000
+//	    }
+//	    forward_proxy {
+//	        param url
+//	        allow_hosts api.example.com *.example.net
+//	        allow_private
+//	        timeout 30s
+//	        max_body_size 1MiB
+//	    }
+//	    identify
+//	}
+//
+// A forward_proxy only proxies to the hosts in allow_hosts; "allow_hosts *"
+// allows any. Its timeout bounds the wait for response headers, not how
+// long a response may stream.
+//
+// Approval requests go to the url, or through an HTTP handler module given
+// with handler, such as "handler reverse_proxy 127.0.0.1:9402".
+//
+// With identify, every request carries the wallet address in a signed
+// X-Payment-Identity header, for sellers with a free tier per wallet.
+func (m *X402BuyerMiddleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "private_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.PrivateKeyHex = d.Val()
+
+		case "wallet":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Wallet = d.Val()
+
+		case "max_amount_pay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.MaxAmountPay = d.Val()
+
+		case "max_retries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var maxRetries int
+			if _, err := fmt.Sscanf(d.Val(), "%d", &maxRetries); err != nil {
+				return d.Errf("invalid max_retries: %v", err)
+			}
+			m.MaxRetries = maxRetries
+
+		case "quote_cache_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid quote_cache_ttl: %v", err)
+			}
+			m.QuoteCacheTTL = caddy.Duration(ttl)
+
+		case "balance_check":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.BalanceCheck = new(BalanceCheck)
+			if err := parseBalanceCheck(d, m.BalanceCheck); err != nil {
+				return err
+			}
+
+		case "forward_proxy":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ForwardProxy = new(ForwardProxy)
+			if err := parseForwardProxy(d, m.ForwardProxy); err != nil {
+				return err
+			}
+
+		case "approval":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Approval = new(PaymentApproval)
+			if err := parsePaymentApproval(d, m.Approval); err != nil {
+				return err
+			}
+
+		case "identify":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Identify = true
+
+		default:
+			return d.Errf("unknown subdirective: %s", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// parsePaymentApproval parses an approval block.
+func parsePaymentApproval(d *caddyfile.Dispenser, config *PaymentApproval) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Threshold = d.Val()
+
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.URL = d.Val()
+
+		case "handler":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers."+name)
+			if err != nil {
+				return err
+			}
+			if _, ok := unm.(caddyhttp.MiddlewareHandler); !ok {
+				return d.Errf("module http.handlers.%s is not an HTTP handler", name)
+			}
+			config.HandlerRaw = caddyconfig.JSONModuleObject(unm, "handler", name, nil)
+
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid approval timeout: %v", err)
+			}
+			config.Timeout = caddy.Duration(timeout)
+
+		default:
+			return d.Errf("unknown approval subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseForwardProxy parses a forward_proxy block.
+func parseForwardProxy(d *caddyfile.Dispenser, config *ForwardProxy) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "param":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Param = d.Val()
+
+		case "allow_hosts":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			config.AllowHosts = append(config.AllowHosts, args...)
+
+		case "allow_private":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config.AllowPrivate = true
+
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid forward_proxy timeout: %v", err)
+			}
+			config.Timeout = caddy.Duration(timeout)
+
+		case "max_body_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid forward_proxy max_body_size: %v", err)
+			}
+			config.MaxBodySize = int64(size)
+
+		default:
+			return d.Errf("unknown forward_proxy subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseBalanceCheck parses a balance_check block.
+func parseBalanceCheck(d *caddyfile.Dispenser, config *BalanceCheck) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "cache_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid balance_check cache_ttl: %v", err)
+			}
+			config.CacheTTL = caddy.Duration(ttl)
+
+		case "low_balance":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.LowBalance = d.Val()
+
+		default:
+			return d.Errf("unknown balance_check subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseX402Health parses the x402health directive.
+func parseX402Health(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m X402HealthHandler
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler for X402HealthHandler. Syntax:
+//
+//	x402health [<pattern>] [ready|live] {
+//	    networks <names...>
+//	}
+func (m *X402HealthHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		m.Mode = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "networks":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.Networks = append(m.Networks, args...)
 
 		default:
 			return d.Errf("unknown subdirective: %s", d.Val())
@@ -0,0 +1,195 @@
+package x402pay
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ChainAsset is a token accepted for payments on a chain network. Sellers
+// refer to it by symbol or address.
+type ChainAsset struct {
+	// Symbol names the asset, e.g. USDC. Symbols are matched
+	// case-insensitively and must be unique within a network.
+	Symbol string `json:"symbol,omitempty"`
+
+	// Address is the token contract address.
+	Address string `json:"address,omitempty"`
+
+	// Name and Version are the token's EIP-712 domain name and version.
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	// Decimals is the number of decimals of the token.
+	Decimals int64 `json:"decimals,omitempty"`
+
+	// Type is the token standard. Defaults to ERC20.
+	Type string `json:"type,omitempty"`
+}
+
+// assets returns the assets accepted on the network. The network's own
+// token, if any, comes first and is the default asset.
+func (c ChainNetworkConfig) assets() []ChainAsset {
+	var assets []ChainAsset
+	if c.TokenAddress != "" {
+		assets = append(assets, ChainAsset{
+			Symbol:   c.TokenSymbol,
+			Address:  c.TokenAddress,
+			Name:     c.TokenName,
+			Version:  c.TokenVersion,
+			Decimals: c.TokenDecimals,
+			Type:     c.TokenType,
+		})
+	}
+	return append(assets, c.Assets...)
+}
+
+// asset looks up an asset by symbol or address. The empty reference
+// selects the default asset.
+func (c ChainNetworkConfig) asset(ref string) (ChainAsset, bool) {
+	assets := c.assets()
+	if len(assets) == 0 {
+		return ChainAsset{}, false
+	}
+	if ref == "" {
+		return assets[0], true
+	}
+	for _, asset := range assets {
+		if strings.EqualFold(asset.Address, ref) || (asset.Symbol != "" && strings.EqualFold(asset.Symbol, ref)) {
+			return asset, true
+		}
+	}
+	return ChainAsset{}, false
+}
+
+// validateAssets checks that the network's assets are well-formed and can
+// be told apart.
+func (c ChainNetworkConfig) validateAssets() error {
+	assets := c.assets()
+	if len(assets) == 0 {
+		return fmt.Errorf("chain network %s: no token_address or asset configured", c.Name)
+	}
+	symbols := make(map[string]bool)
+	addresses := make(map[string]bool)
+	for _, asset := range assets {
+		if asset.Address == "" {
+			return fmt.Errorf("chain network %s: asset %s has no address", c.Name, asset.Symbol)
+		}
+		if !common.IsHexAddress(asset.Address) {
+			return fmt.Errorf("chain network %s: invalid token address %q", c.Name, asset.Address)
+		}
+		if !supportedTokenType(asset.Type) {
+			return fmt.Errorf("chain network %s: unsupported token type %q for %s: expected ERC20", c.Name, asset.Type, asset.Address)
+		}
+		if asset.Decimals < 0 {
+			return fmt.Errorf("chain network %s: token decimals of %s must be non-negative", c.Name, asset.Address)
+		}
+		address := strings.ToLower(asset.Address)
+		if addresses[address] {
+			return fmt.Errorf("chain network %s: asset %s is configured twice", c.Name, asset.Address)
+		}
+		addresses[address] = true
+
+		if asset.Symbol == "" {
+			continue
+		}
+		symbol := strings.ToUpper(asset.Symbol)
+		if symbols[symbol] {
+			return fmt.Errorf("chain network %s: asset symbol %s is used twice", c.Name, asset.Symbol)
+		}
+		symbols[symbol] = true
+	}
+	return nil
+}
+
+// supportedTokenType reports whether tokens of the given type can be
+// settled. Only EIP-3009 ERC20 tokens are, which is also the default.
+func supportedTokenType(tokenType string) bool {
+	return tokenType == "" || strings.EqualFold(tokenType, "ERC20")
+}
+
+// assetNetworkKey is the name under which a network's non-default asset
+// is registered with the facilitator library, which only knows one token
+// per network.
+func assetNetworkKey(network string, asset ChainAsset) string {
+	return network + "/" + strings.ToLower(asset.Address)
+}
+
+// findChainNetwork returns the configuration of a chain network.
+func (m *X402FacilitatorApp) findChainNetwork(name string) (ChainNetworkConfig, bool) {
+	for _, chainNetwork := range m.ChainNetworks {
+		if chainNetwork.Name == name {
+			return chainNetwork, true
+		}
+	}
+	return ChainNetworkConfig{}, false
+}
+
+// createPaymentRequirements builds the payment requirements of a resource
+// priced in the given asset of network. Under the upto scheme, amount is
+// the most a request may cost.
+func (m *X402FacilitatorApp) createPaymentRequirements(scheme, resource, description, network, assetRef, payTo, amount string) (*types.PaymentRequirements, error) {
+	chainNetwork, ok := m.findChainNetwork(network)
+	if !ok {
+		return nil, fmt.Errorf("chain network %s not found", network)
+	}
+	asset, ok := chainNetwork.asset(assetRef)
+	if !ok {
+		return nil, fmt.Errorf("asset %s not found on chain network %s", assetRef, network)
+	}
+
+	requirements, err := m.facilitator.CreatePaymentRequirements(resource, description, network, payTo, amount)
+	if err != nil {
+		return nil, err
+	}
+	requirements.Asset = asset.Address
+	requirements.TokenName = asset.Name
+	requirements.TokenVersion = asset.Version
+	requirements.AssetType = asset.Type
+	if requirements.AssetType == "" {
+		requirements.AssetType = "ERC20"
+	}
+	if scheme == schemeUpto {
+		// The buyer permits the facilitator to move the maximum
+		requirements.Scheme = schemeUpto
+		if requirements.Extra == nil {
+			requirements.Extra = make(map[string]interface{})
+		}
+		requirements.Extra["spender"] = m.facilitatorAddress().Hex()
+	}
+	return requirements, nil
+}
+
+// libraryRequest returns req as the facilitator library has to see it:
+// payments in a non-default asset are addressed to the network the asset
+// is registered under. ok is false if the asset is not accepted on the
+// network.
+func (m *X402FacilitatorApp) libraryRequest(req *types.VerifyRequest) (*types.VerifyRequest, bool) {
+	chainNetwork, found := m.findChainNetwork(req.PaymentRequirements.Network)
+	if !found {
+		// The library reports unknown networks itself
+		return req, true
+	}
+	asset, ok := chainNetwork.asset(req.PaymentRequirements.Asset)
+	if !ok {
+		return nil, false
+	}
+	if asset.Address == chainNetwork.assets()[0].Address {
+		return req, true
+	}
+	routed := *req
+	routed.PaymentRequirements.Network = assetNetworkKey(chainNetwork.Name, asset)
+	return &routed, true
+}
+
+// tokenAddress returns the address of the token a payment is made in.
+func (m *X402FacilitatorApp) tokenAddress(requirements types.PaymentRequirements) string {
+	if requirements.Asset != "" {
+		return requirements.Asset
+	}
+	chainNetwork, _ := m.findChainNetwork(requirements.Network)
+	asset, _ := chainNetwork.asset("")
+	return asset.Address
+}
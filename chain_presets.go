@@ -0,0 +1,234 @@
+package x402pay
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// chainNetworkPresets are the well-known chain networks that can be used
+// by name without a chain_network block. Each comes with a public RPC
+// endpoint, which is fine for trying things out but should be overridden
+// in production, and the chain's canonical USDC.
+var chainNetworkPresets = map[string]ChainNetworkConfig{
+	"base": {
+		RPC:           "https://mainnet.base.org",
+		ID:            8453,
+		TokenAddress:  "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913",
+		TokenName:     "USD Coin",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"base-sepolia": {
+		RPC:           "https://sepolia.base.org",
+		ID:            84532,
+		TokenAddress:  "0x036CbD53842c5426634e7929541eC2318f3dCF7e",
+		TokenName:     "USDC",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"polygon": {
+		RPC:           "https://polygon-rpc.com",
+		ID:            137,
+		TokenAddress:  "0x3c499c542cEF5E3811e1192ce70d8cC03d5c3359",
+		TokenName:     "USD Coin",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"polygon-amoy": {
+		RPC:           "https://rpc-amoy.polygon.technology",
+		ID:            80002,
+		TokenAddress:  "0x41E94Eb019C0762f9Bfcf9Fb1E58725BfB0e7582",
+		TokenName:     "USDC",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"avalanche": {
+		RPC:           "https://api.avax.network/ext/bc/C/rpc",
+		ID:            43114,
+		TokenAddress:  "0xB97EF9Ef8734C71904D8002F8b6Bc66Dd9c48a6E",
+		TokenName:     "USD Coin",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"avalanche-fuji": {
+		RPC:           "https://api.avax-test.network/ext/bc/C/rpc",
+		ID:            43113,
+		TokenAddress:  "0x5425890298aed601595a70AB815c96711a31Bc65",
+		TokenName:     "USD Coin",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"ethereum": {
+		RPC:           "https://ethereum-rpc.publicnode.com",
+		ID:            1,
+		TokenAddress:  "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48",
+		TokenName:     "USD Coin",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"ethereum-sepolia": {
+		RPC:           "https://ethereum-sepolia-rpc.publicnode.com",
+		ID:            11155111,
+		TokenAddress:  "0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238",
+		TokenName:     "USDC",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"arbitrum": {
+		RPC:           "https://arb1.arbitrum.io/rpc",
+		ID:            42161,
+		TokenAddress:  "0xaf88d065e77c8cC2239327C5EDb3A432268e5831",
+		TokenName:     "USD Coin",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+	"arbitrum-sepolia": {
+		RPC:           "https://sepolia-rollup.arbitrum.io/rpc",
+		ID:            421614,
+		TokenAddress:  "0x75faf114eafb1BDbe2F0316DF893fd58CE46AA4d",
+		TokenName:     "USD Coin",
+		TokenVersion:  "2",
+		TokenDecimals: 6,
+		TokenType:     "ERC20",
+		TokenSymbol:   "USDC",
+	},
+}
+
+// chainNetworkPreset returns the preset chain network of the given name.
+func chainNetworkPreset(name string) (ChainNetworkConfig, bool) {
+	preset, ok := chainNetworkPresets[strings.ToLower(name)]
+	if !ok {
+		return ChainNetworkConfig{}, false
+	}
+	preset.Name = name
+	return preset, true
+}
+
+// presetNames lists the names of the preset chain networks.
+func presetNames() []string {
+	names := make([]string, 0, len(chainNetworkPresets))
+	for name := range chainNetworkPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withPreset fills the fields c leaves unset from its preset, which is the
+// one named by Preset or, failing that, the one named like the network.
+// Networks without a preset are returned unchanged.
+func (c ChainNetworkConfig) withPreset() (ChainNetworkConfig, error) {
+	name := c.Preset
+	if name == "" {
+		name = c.Name
+	}
+	preset, ok := chainNetworkPreset(name)
+	if !ok {
+		if c.Preset != "" {
+			return c, fmt.Errorf("chain network %s: unknown preset %q (known presets: %s)",
+				c.Name, c.Preset, strings.Join(presetNames(), ", "))
+		}
+		return c, nil
+	}
+
+	if c.RPC == "" && len(c.RPCEndpoints) == 0 {
+		c.RPC = preset.RPC
+	}
+	if c.ID == 0 {
+		c.ID = preset.ID
+	}
+	if c.TokenAddress == "" {
+		c.TokenAddress = preset.TokenAddress
+	}
+	if c.TokenName == "" {
+		c.TokenName = preset.TokenName
+	}
+	if c.TokenVersion == "" {
+		c.TokenVersion = preset.TokenVersion
+	}
+	if c.TokenDecimals == 0 {
+		c.TokenDecimals = preset.TokenDecimals
+	}
+	if c.TokenType == "" {
+		c.TokenType = preset.TokenType
+	}
+	if c.TokenSymbol == "" {
+		c.TokenSymbol = preset.TokenSymbol
+	}
+	return c, nil
+}
+
+// applyPresets fills in every network of networks from its preset.
+func applyPresets(networks []ChainNetworkConfig) error {
+	for i := range networks {
+		network, err := networks[i].withPreset()
+		if err != nil {
+			return err
+		}
+		networks[i] = network
+	}
+	return nil
+}
+
+// lookupChainNetwork finds a network by name among networks, falling back
+// to the presets.
+func lookupChainNetwork(networks []ChainNetworkConfig, name string) (ChainNetworkConfig, bool) {
+	for _, network := range networks {
+		if network.Name == name {
+			return network, true
+		}
+	}
+	return chainNetworkPreset(name)
+}
+
+// useChainNetwork makes sure the app serves the named network, adding it
+// from the presets if it is not configured. It reports whether the network
+// is available. Sellers call it while they are provisioned, after the app
+// was validated, so an added network is validated here; validate_online
+// covers it once the app starts.
+func (m *X402FacilitatorApp) useChainNetwork(name string) (bool, error) {
+	if _, ok := m.findChainNetwork(name); ok {
+		return true, nil
+	}
+	preset, ok := chainNetworkPreset(name)
+	if !ok {
+		return false, nil
+	}
+	if err := m.validateChainNetwork(preset); err != nil {
+		return false, err
+	}
+	if m.GasMonitor != nil {
+		if err := m.GasMonitor.addNetwork(preset); err != nil {
+			return false, err
+		}
+	}
+	m.HealthCheck.addNetwork(preset)
+	m.ChainNetworks = append(m.ChainNetworks, preset)
+	m.logger.Info("using preset chain network",
+		zap.String("network", name),
+		zap.Uint64("chain_id", preset.ID),
+		zap.String("rpc", preset.RPC),
+	)
+	return true, nil
+}
@@ -1,11 +1,22 @@
 package x402pay
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
 
 	"github.com/agent-guide/go-x402-facilitator/pkg/facilitator"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"go.uber.org/zap"
 )
 
@@ -19,12 +30,51 @@ type X402FacilitatorApp struct {
 	// Facilitator configuration
 	PrivateKey       string               `json:"private_key,omitempty"`
 	SupportedSchemes []string             `json:"supported_schemes,omitempty"`
-	GasLimit         uint64               `json:"gas_limit,omitempty"`
-	GasPrice         uint64               `json:"gas_price,omitempty"`
 	ChainNetworks    []ChainNetworkConfig `json:"chain_networks,omitempty"`
 
+	// GasLimit, if set, is the gas limit of every transaction the
+	// facilitator sends, instead of an estimate with a 20% margin.
+	GasLimit uint64 `json:"gas_limit,omitempty"`
+
+	// GasPrice, if set, is the gas price in wei of every transaction the
+	// facilitator sends, instead of the price the RPC suggests.
+	// Replacements of stuck transactions still bump it.
+	GasPrice uint64 `json:"gas_price,omitempty"`
+
+	// GasMonitor, if set, watches the facilitator account's native-token
+	// balance on every chain network.
+	GasMonitor *GasMonitor `json:"gas_monitor,omitempty"`
+
+	// HealthCheck configures the background RPC probes behind the health
+	// endpoints. Probes always run; this only tunes them.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
+	// NonceManager tunes how transactions sent by the facilitator are
+	// tracked and replaced when stuck. It always runs; this only tunes it.
+	NonceManager *NonceManager `json:"nonce_manager,omitempty"`
+
+	// SettlementQueue, if set, settles payments of sellers in optimistic
+	// mode in the background, journaling them to storage.
+	SettlementQueue *SettlementQueue `json:"settlement_queue,omitempty"`
+
+	// ValidateOnline checks at startup that every chain network's RPC
+	// reports the configured chain ID and that its tokens' name(),
+	// version() and decimals() match the configuration. Any mismatch
+	// fails the startup.
+	ValidateOnline bool `json:"validate_online,omitempty"`
+
 	// Runtime fields
 	facilitator facilitator.PaymentFacilitator
+	ctx         caddy.Context
+	logger      *zap.Logger
+	events      *caddyevents.App
+	clients     map[string]*ethclient.Client
+	pools       map[string]*rpcPool
+	transactors map[string]*chainTransactor
+	rpcServer   *http.Server
+	rpcBase     string
+	cancel      context.CancelFunc
+	upto        *uptoReservations
 }
 
 // ChainNetworkConfig represents a blockchain network configuration.
@@ -37,6 +87,46 @@ type ChainNetworkConfig struct {
 	TokenVersion  string `json:"token_version,omitempty"`
 	TokenDecimals int64  `json:"token_decimals,omitempty"`
 	TokenType     string `json:"token_type,omitempty"`
+
+	// Preset names a built-in network, such as base or base-sepolia, to
+	// take unset fields from. Networks named like a preset use it without
+	// saying so.
+	Preset string `json:"preset,omitempty"`
+
+	// TokenSymbol lets sellers refer to the network's token by symbol.
+	TokenSymbol string `json:"token_symbol,omitempty"`
+
+	// Assets are further tokens accepted on this network, each with its
+	// own EIP-712 domain. The network's token, if set, is the default
+	// asset; otherwise the first of these is.
+	Assets []ChainAsset `json:"assets,omitempty"`
+
+	// RPCEndpoints are further RPC endpoints used alongside RPC. Requests
+	// fail over between them according to RPCPolicy.
+	RPCEndpoints []RPCEndpoint `json:"rpc_endpoints,omitempty"`
+
+	// RPCPolicy selects the endpoint for each request when several are
+	// configured: first_healthy (default), round_robin or lowest_latency.
+	RPCPolicy string `json:"rpc_policy,omitempty"`
+
+	// RPCTimeout bounds each request to a single endpoint. Defaults to 10s.
+	RPCTimeout caddy.Duration `json:"rpc_timeout,omitempty"`
+
+	// RPCRetries is how many further endpoints a failed read is retried
+	// on. Defaults to 2.
+	RPCRetries int `json:"rpc_retries,omitempty"`
+
+	// Confirmations is how many blocks, counting the one it was mined in,
+	// must be on top of a settlement transaction before the settlement is
+	// final. Until then the settlement queue, which is then required,
+	// watches it for reorgs. The default of 0 takes a settlement as final
+	// once it is mined.
+	Confirmations int `json:"confirmations,omitempty"`
+
+	// GasLowWaterMark is the minimum native-token balance, in wei, the
+	// facilitator account should hold on this network. It overrides the
+	// gas monitor's default low-water mark.
+	GasLowWaterMark string `json:"gas_low_water_mark,omitempty"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -49,7 +139,45 @@ func (X402FacilitatorApp) CaddyModule() caddy.ModuleInfo {
 
 // Provision sets up the module.
 func (m *X402FacilitatorApp) Provision(ctx caddy.Context) error {
-	ctx.Logger(m).Info("provisioning x402 facilitator app",
+	m.ctx = ctx
+	m.logger = ctx.Logger(m)
+	m.upto = &uptoReservations{held: make(map[string]bool)}
+
+	eventsAppIface, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	m.events = eventsAppIface.(*caddyevents.App)
+
+	if err := applyPresets(m.ChainNetworks); err != nil {
+		return err
+	}
+
+	if m.GasMonitor != nil {
+		if err := m.GasMonitor.provision(m.ChainNetworks); err != nil {
+			return err
+		}
+	}
+
+	if m.HealthCheck == nil {
+		m.HealthCheck = new(HealthCheck)
+	}
+	m.HealthCheck.provision(m.ChainNetworks)
+
+	if m.NonceManager == nil {
+		m.NonceManager = new(NonceManager)
+	}
+	if err := m.NonceManager.provision(); err != nil {
+		return err
+	}
+
+	if m.SettlementQueue != nil {
+		if err := m.SettlementQueue.provision(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	m.logger.Info("provisioning x402 facilitator app",
 		zap.String("private_key_set", fmt.Sprintf("%t", m.PrivateKey != "")),
 		zap.Int("chain_networks_count", len(m.ChainNetworks)),
 	)
@@ -61,29 +189,92 @@ func (m *X402FacilitatorApp) Validate() error {
 	if m.PrivateKey == "" {
 		return fmt.Errorf("private_key is required")
 	}
-	if len(m.ChainNetworks) == 0 {
-		return fmt.Errorf("at least one chain_network is required")
+	names := make(map[string]bool)
+	for _, network := range m.ChainNetworks {
+		if names[network.Name] {
+			return fmt.Errorf("chain network %s is configured twice", network.Name)
+		}
+		names[network.Name] = true
+		if err := m.validateChainNetwork(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateChainNetwork checks a network the app serves.
+func (m *X402FacilitatorApp) validateChainNetwork(network ChainNetworkConfig) error {
+	if err := network.validate(); err != nil {
+		return err
+	}
+	// Settlements are watched until final in the settlement journal
+	if network.Confirmations > 1 && m.SettlementQueue == nil {
+		return fmt.Errorf("chain network %s: confirmations require a settlement_queue", network.Name)
 	}
 	return nil
 }
 
 // Start starts the application.
 func (m *X402FacilitatorApp) Start() error {
+	// Sellers may have added preset networks since validation
+	if len(m.ChainNetworks) == 0 {
+		return fmt.Errorf("at least one chain_network is required")
+	}
+
+	// Connect our own RPC clients, pooling networks with several endpoints
+	if err := m.dialChainClients(); err != nil {
+		return err
+	}
+
+	if m.ValidateOnline {
+		if err := m.validateOnline(); err != nil {
+			m.closeChainClients()
+			return fmt.Errorf("online validation failed: %w", err)
+		}
+	}
+
+	if err := m.newChainTransactors(); err != nil {
+		m.closeChainClients()
+		return err
+	}
+
 	// Initialize facilitator
 	if err := m.initFacilitator(); err != nil {
+		m.closeChainClients()
 		return fmt.Errorf("failed to initialize facilitator: %w", err)
 	}
 
+	var monitorCtx context.Context
+	monitorCtx, m.cancel = context.WithCancel(context.Background())
+	if m.GasMonitor != nil {
+		go m.GasMonitor.run(monitorCtx, m)
+	}
+	go m.HealthCheck.run(monitorCtx, m)
+	go m.runNonceManager(monitorCtx)
+	if m.SettlementQueue != nil {
+		go m.SettlementQueue.run(monitorCtx)
+	}
+
 	return nil
 }
 
 // Stop stops the application.
 func (m *X402FacilitatorApp) Stop() error {
+	// Stop background monitoring
+	if m.cancel != nil {
+		m.cancel()
+	}
+	if m.SettlementQueue != nil && m.cancel != nil {
+		<-m.SettlementQueue.stopped
+	}
+
 	// Close facilitator
 	if m.facilitator != nil {
 		m.facilitator.Close()
 	}
 
+	m.closeChainClients()
+
 	return nil
 }
 
@@ -98,19 +289,35 @@ func (m *X402FacilitatorApp) GetFacilitator() facilitator.PaymentFacilitator {
 	return m.facilitator
 }
 
+// health reports the health of the given chain networks, or of all of them.
+func (m *X402FacilitatorApp) health(networks ...string) facilitatorHealth {
+	if m.facilitator == nil {
+		return facilitatorHealth{Networks: []networkHealth{}}
+	}
+	return m.HealthCheck.snapshot(networks...)
+}
+
 // initFacilitator initializes the X402 facilitator instance.
 func (m *X402FacilitatorApp) initFacilitator() error {
 	// Build networks map from configuration
 	networks := make(map[string]facilitator.NetworkConfig)
 	for _, chainNetwork := range m.ChainNetworks {
-		networks[chainNetwork.Name] = facilitator.NetworkConfig{
-			ChainRPC:      chainNetwork.RPC,
-			ChainID:       chainNetwork.ID,
-			TokenAddress:  chainNetwork.TokenAddress,
-			TokenName:     chainNetwork.TokenName,
-			TokenVersion:  chainNetwork.TokenVersion,
-			TokenDecimals: chainNetwork.TokenDecimals,
-			TokenType:     chainNetwork.TokenType,
+		// The library knows one token per network, so further assets are
+		// registered as networks of their own
+		for i, asset := range chainNetwork.assets() {
+			name := chainNetwork.Name
+			if i > 0 {
+				name = assetNetworkKey(chainNetwork.Name, asset)
+			}
+			networks[name] = facilitator.NetworkConfig{
+				ChainRPC:      m.rpcURL(chainNetwork),
+				ChainID:       chainNetwork.ID,
+				TokenAddress:  asset.Address,
+				TokenName:     asset.Name,
+				TokenVersion:  asset.Version,
+				TokenDecimals: asset.Decimals,
+				TokenType:     asset.Type,
+			}
 		}
 	}
 
@@ -127,10 +334,105 @@ func (m *X402FacilitatorApp) initFacilitator() error {
 		return fmt.Errorf("failed to create facilitator: %w", err)
 	}
 
-	m.facilitator = f
+	m.facilitator = &guardedFacilitator{PaymentFacilitator: f, app: m}
 	return nil
 }
 
+// dialChainClients connects an RPC client to every chain network. Networks
+// with several endpoints get a pool, which is also served on a loopback
+// listener for the facilitator library, since it can only dial a URL and
+// not be handed the pool as a transport. The pool is served under a random
+// path so that other local processes cannot send traffic through it.
+func (m *X402FacilitatorApp) dialChainClients() error {
+	m.clients = make(map[string]*ethclient.Client, len(m.ChainNetworks))
+	m.pools = make(map[string]*rpcPool)
+	for _, chainNetwork := range m.ChainNetworks {
+		client, pool, err := dialChainNetwork(context.Background(), chainNetwork, m.logger)
+		if err != nil {
+			m.closeChainClients()
+			return fmt.Errorf("failed to connect to %s rpc: %w", chainNetwork.Name, err)
+		}
+		m.clients[chainNetwork.Name] = client
+		if pool != nil {
+			m.pools[chainNetwork.Name] = pool
+		}
+	}
+	if len(m.pools) == 0 {
+		return nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		m.closeChainClients()
+		return fmt.Errorf("failed to generate rpc pool secret: %w", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		m.closeChainClients()
+		return fmt.Errorf("failed to listen for rpc pool: %w", err)
+	}
+	prefix := "/" + hex.EncodeToString(secret) + "/"
+	mux := http.NewServeMux()
+	for name, pool := range m.pools {
+		mux.Handle(prefix+name, pool)
+	}
+	m.rpcBase = "http://" + ln.Addr().String() + prefix
+	m.rpcServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := m.rpcServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			m.logger.Error("rpc pool listener failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// closeChainClients closes the RPC clients, the pool listener and the
+// pools' connections.
+func (m *X402FacilitatorApp) closeChainClients() {
+	for _, client := range m.clients {
+		client.Close()
+	}
+	m.clients = nil
+	for _, pool := range m.pools {
+		pool.close()
+	}
+	if m.rpcServer != nil {
+		m.rpcServer.Close()
+		m.rpcServer = nil
+	}
+}
+
+// rpcURL returns the URL the facilitator library should dial for network.
+func (m *X402FacilitatorApp) rpcURL(network ChainNetworkConfig) string {
+	if _, ok := m.pools[network.Name]; ok {
+		return m.rpcBase + network.Name
+	}
+	return network.rpcEndpoints()[0].URL
+}
+
+// facilitatorAddress returns the account the facilitator settles from.
+func (m *X402FacilitatorApp) facilitatorAddress() common.Address {
+	privateKey, err := crypto.HexToECDSA(trimHexPrefix(m.PrivateKey))
+	if err != nil {
+		return common.Address{}
+	}
+	return crypto.PubkeyToAddress(privateKey.PublicKey)
+}
+
+// nativeBalance returns the native-token balance of address on network.
+func (m *X402FacilitatorApp) nativeBalance(ctx context.Context, network string, address common.Address) (*big.Int, error) {
+	client, ok := m.clients[network]
+	if !ok {
+		return nil, fmt.Errorf("no rpc client for chain network %s", network)
+	}
+	return client.BalanceAt(ctx, address, nil)
+}
+
+// emit dispatches an event through Caddy's events app.
+func (m *X402FacilitatorApp) emit(eventName string, data map[string]any) {
+	m.events.Emit(m.ctx, eventName, data)
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner     = (*X402FacilitatorApp)(nil)
@@ -0,0 +1,307 @@
+package x402pay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/agent-guide/go-x402-facilitator/pkg/utils"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	defaultBatchMaxSize = 20
+	defaultBatchMaxWait = 30 * time.Second
+
+	// defaultMulticallAddress is where Multicall3 is deployed on most EVM
+	// chains.
+	defaultMulticallAddress = "0xcA11bde05977b3631167028862bE2a173976CA11"
+)
+
+// multicall3ABI is the part of the Multicall3 ABI used for batching.
+const multicall3ABI = `[{"inputs":[{"components":[{"internalType":"address","name":"target","type":"address"},{"internalType":"bool","name":"allowFailure","type":"bool"},{"internalType":"bytes","name":"callData","type":"bytes"}],"internalType":"struct Multicall3.Call3[]","name":"calls","type":"tuple[]"}],"name":"aggregate3","outputs":[{"components":[{"internalType":"bool","name":"success","type":"bool"},{"internalType":"bytes","name":"returnData","type":"bytes"}],"internalType":"struct Multicall3.Result[]","name":"returnData","type":"tuple[]"}],"stateMutability":"payable","type":"function"}]`
+
+// authorizationUsedTopic is the topic of the EIP-3009 AuthorizationUsed
+// event, which the token emits for every authorization it executes.
+var authorizationUsedTopic = crypto.Keccak256Hash([]byte("AuthorizationUsed(address,bytes32)"))
+
+// SettlementBatch makes the settlement queue settle payments in batches
+// instead of one transaction each, which saves gas on micro-payments. A
+// batch for a network is submitted once MaxSize payments are waiting or the
+// oldest has waited MaxWait. Batches go out as a single Multicall3 call if
+// Multicall is set, or else as consecutive transactions sent without
+// waiting for each other. Each payment's outcome is journaled separately.
+type SettlementBatch struct {
+	// MaxSize is the largest number of payments in a batch. Defaults to 20.
+	MaxSize int `json:"max_size,omitempty"`
+
+	// MaxWait is how long a payment may wait for its batch to fill up.
+	// Defaults to 30s.
+	MaxWait caddy.Duration `json:"max_wait,omitempty"`
+
+	// Multicall is the address of a Multicall3 contract to batch through.
+	Multicall string `json:"multicall,omitempty"`
+}
+
+// multicall3Call mirrors the Multicall3 Call3 struct.
+type multicall3Call struct {
+	Target       common.Address
+	AllowFailure bool
+	CallData     []byte
+}
+
+// multicall3Result mirrors the Multicall3 Result struct.
+type multicall3Result struct {
+	Success    bool
+	ReturnData []byte
+}
+
+// batchResult is the outcome of settling one payment of a batch.
+type batchResult struct {
+	Transaction string
+	Payer       string
+	BlockNumber uint64
+	BlockHash   string
+	Err         error
+}
+
+// batchCall is a payment of a batch that passed verification.
+type batchCall struct {
+	index int
+	token common.Address
+	auth  types.Authorization
+	data  []byte
+}
+
+// provision applies defaults.
+func (b *SettlementBatch) provision() error {
+	if b.MaxSize <= 0 {
+		b.MaxSize = defaultBatchMaxSize
+	}
+	if b.MaxWait <= 0 {
+		b.MaxWait = caddy.Duration(defaultBatchMaxWait)
+	}
+	if b.Multicall != "" && !common.IsHexAddress(b.Multicall) {
+		return fmt.Errorf("invalid batch multicall address: %s", b.Multicall)
+	}
+	return nil
+}
+
+// settleBatch settles payments on network together and returns the outcome
+// of each, in order.
+func (m *X402FacilitatorApp) settleBatch(ctx context.Context, network string, reqs []*types.VerifyRequest, batch *SettlementBatch) []batchResult {
+	results := make([]batchResult, len(reqs))
+	transactor, ok := m.transactors[network]
+	if !ok {
+		for i := range results {
+			results[i].Err = fmt.Errorf("unsupported_network: %s", network)
+		}
+		return results
+	}
+
+	// Payments are verified again right before settling, as the library
+	// does for single settlements
+	var calls []batchCall
+	for i, req := range reqs {
+		// Upto payments take a permit and a transfer of their own
+		if req.PaymentRequirements.Scheme == schemeUpto {
+			results[i] = m.settleUpto(ctx, req)
+			continue
+		}
+		call, err := m.prepareBatchCall(ctx, network, req)
+		if auth, ok := exactAuthorization(req.PaymentPayload); ok {
+			results[i].Payer = auth.From
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		call.index = i
+		calls = append(calls, call)
+	}
+	if len(calls) == 0 {
+		return results
+	}
+
+	if batch.Multicall != "" {
+		m.settleMulticall(ctx, transactor, common.HexToAddress(batch.Multicall), calls, results)
+	} else {
+		m.settleSequential(ctx, transactor, calls, results)
+	}
+	return results
+}
+
+// prepareBatchCall verifies a payment and encodes its transfer.
+func (m *X402FacilitatorApp) prepareBatchCall(ctx context.Context, network string, req *types.VerifyRequest) (batchCall, error) {
+	verifyResp, err := m.facilitator.Verify(ctx, req)
+	if err != nil {
+		return batchCall{}, fmt.Errorf("verification_failed: %w", err)
+	}
+	if !verifyResp.IsValid {
+		return batchCall{}, errors.New(verifyResp.InvalidReason)
+	}
+
+	exact, ok := exactEVMPayload(req.PaymentPayload)
+	if !ok {
+		return batchCall{}, errors.New("invalid_payload")
+	}
+	auth := exact.Authorization
+	sig, err := utils.ParseSignature(exact.Signature)
+	if err != nil {
+		return batchCall{}, fmt.Errorf("invalid_signature: %w", err)
+	}
+	data, err := utils.PackTransferWithAuthorization(auth.From, auth.To, auth.Value,
+		auth.ValidAfter, auth.ValidBefore, auth.Nonce, sig.V, sig.R, sig.S)
+	if err != nil {
+		return batchCall{}, fmt.Errorf("invalid_payload: %w", err)
+	}
+
+	token := m.tokenAddress(req.PaymentRequirements)
+	return batchCall{token: common.HexToAddress(token), auth: auth, data: data}, nil
+}
+
+// settleSequential sends one transaction per payment, with consecutive
+// nonces, and then waits for all of them.
+func (m *X402FacilitatorApp) settleSequential(ctx context.Context, transactor *chainTransactor, calls []batchCall, results []batchResult) {
+	sent := make(map[int]*ethtypes.Transaction, len(calls))
+	for _, call := range calls {
+		tx, err := transactor.send(ctx, call.token, call.data)
+		if err != nil {
+			results[call.index].Err = fmt.Errorf("transaction_failed: %w", err)
+			continue
+		}
+		sent[call.index] = tx
+		results[call.index].Transaction = tx.Hash().Hex()
+	}
+
+	for _, call := range calls {
+		tx, ok := sent[call.index]
+		if !ok {
+			continue
+		}
+		receipt, err := transactor.wait(ctx, tx)
+		if err != nil {
+			results[call.index].Err = fmt.Errorf("confirmation_failed: %w", err)
+			continue
+		}
+		if receipt.Status != ethtypes.ReceiptStatusSuccessful {
+			results[call.index].Err = errors.New("transaction_reverted")
+			continue
+		}
+		results[call.index].BlockNumber = receipt.BlockNumber.Uint64()
+		results[call.index].BlockHash = receipt.BlockHash.Hex()
+	}
+}
+
+// settleMulticall settles all payments in a single Multicall3 transaction.
+// The batch is simulated first so that a payment that would fail does not
+// take the others down with it.
+func (m *X402FacilitatorApp) settleMulticall(ctx context.Context, transactor *chainTransactor, multicall common.Address, calls []batchCall, results []batchResult) {
+	parsed, err := abi.JSON(strings.NewReader(multicall3ABI))
+	if err != nil {
+		for _, call := range calls {
+			results[call.index].Err = err
+		}
+		return
+	}
+
+	pack := func(calls []batchCall) ([]byte, error) {
+		mcCalls := make([]multicall3Call, len(calls))
+		for i, call := range calls {
+			mcCalls[i] = multicall3Call{Target: call.token, AllowFailure: true, CallData: call.data}
+		}
+		return parsed.Pack("aggregate3", mcCalls)
+	}
+	fail := func(calls []batchCall, err error) {
+		for _, call := range calls {
+			results[call.index].Err = err
+		}
+	}
+
+	data, err := pack(calls)
+	if err != nil {
+		fail(calls, fmt.Errorf("invalid_payload: %w", err))
+		return
+	}
+	out, err := transactor.client.CallContract(ctx, ethereum.CallMsg{From: transactor.from, To: &multicall, Data: data}, nil)
+	if err != nil {
+		fail(calls, fmt.Errorf("transaction_failed: simulating batch: %w", err))
+		return
+	}
+	var simulated []multicall3Result
+	if err := parsed.UnpackIntoInterface(&simulated, "aggregate3", out); err != nil || len(simulated) != len(calls) {
+		fail(calls, fmt.Errorf("transaction_failed: unexpected multicall result: %v", err))
+		return
+	}
+
+	var passing []batchCall
+	for i, call := range calls {
+		if simulated[i].Success {
+			passing = append(passing, call)
+		} else {
+			results[call.index].Err = errors.New("transaction_reverted: transfer fails in simulation")
+		}
+	}
+	if len(passing) == 0 {
+		return
+	}
+
+	if data, err = pack(passing); err != nil {
+		fail(passing, fmt.Errorf("invalid_payload: %w", err))
+		return
+	}
+	tx, err := transactor.send(ctx, multicall, data)
+	if err != nil {
+		fail(passing, fmt.Errorf("transaction_failed: %w", err))
+		return
+	}
+	for _, call := range passing {
+		results[call.index].Transaction = tx.Hash().Hex()
+	}
+
+	receipt, err := transactor.wait(ctx, tx)
+	if err != nil {
+		fail(passing, fmt.Errorf("confirmation_failed: %w", err))
+		return
+	}
+	if receipt.Status != ethtypes.ReceiptStatusSuccessful {
+		fail(passing, errors.New("transaction_reverted"))
+		return
+	}
+
+	// Calls were allowed to fail individually; the token's events tell
+	// which authorizations were actually executed
+	for _, call := range passing {
+		if !authorizationUsed(receipt, call) {
+			results[call.index].Err = errors.New("transaction_reverted: transfer failed within batch")
+			continue
+		}
+		results[call.index].BlockNumber = receipt.BlockNumber.Uint64()
+		results[call.index].BlockHash = receipt.BlockHash.Hex()
+	}
+}
+
+// authorizationUsed reports whether receipt contains the AuthorizationUsed
+// event of call's authorization.
+func authorizationUsed(receipt *ethtypes.Receipt, call batchCall) bool {
+	authorizer := common.BytesToHash(common.HexToAddress(call.auth.From).Bytes())
+	nonce := common.HexToHash(call.auth.Nonce)
+	for _, log := range receipt.Logs {
+		if log.Address != call.token || len(log.Topics) < 3 || log.Topics[0] != authorizationUsedTopic {
+			continue
+		}
+		if bytes.Equal(log.Topics[1].Bytes(), authorizer.Bytes()) && log.Topics[2] == nonce {
+			return true
+		}
+	}
+	return false
+}
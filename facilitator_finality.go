@@ -0,0 +1,329 @@
+package x402pay
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// finalityCheckInterval is how often settlements awaiting
+	// confirmations are looked at.
+	finalityCheckInterval = 5 * time.Second
+
+	// orphanWatchWindow is how long an orphaned settlement is watched for
+	// its transaction to be mined again, which is common after shallow
+	// reorgs.
+	orphanWatchWindow = time.Hour
+)
+
+// confirmations returns how many confirmations settlements on network
+// need before they are final.
+func (m *X402FacilitatorApp) confirmations(network string) int {
+	for _, chainNetwork := range m.ChainNetworks {
+		if chainNetwork.Name == network {
+			return chainNetwork.Confirmations
+		}
+	}
+	return 0
+}
+
+// tracksFinality reports whether settlements on network are watched until
+// they have enough confirmations.
+func (m *X402FacilitatorApp) tracksFinality(network string) bool {
+	return m.confirmations(network) > 1
+}
+
+// record journals a payment that was settled synchronously, so that its
+// transaction is watched until it is final and the legs of a split
+// payment are paid. A record that cannot be written is kept in memory and
+// written again by watchFinality, and an x402_settlement_unjournaled event
+// is emitted; the error is returned all the same.
+func (q *SettlementQueue) record(ctx context.Context, req *types.VerifyRequest, resp *types.SettleResponse) error {
+	now := time.Now()
+	rec := &settlementRecord{
+		ID:          settlementID(req),
+		State:       settlementConfirming,
+		Network:     req.PaymentRequirements.Network,
+		Payer:       resp.Payer,
+		PayTo:       req.PaymentRequirements.PayTo,
+		Amount:      req.PaymentRequirements.MaxAmountRequired,
+		Resource:    req.PaymentRequirements.Resource,
+		Transaction: resp.Transaction,
+		Attempts:    1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Request:     *req,
+	}
+	if auth, ok := exactAuthorization(req.PaymentPayload); ok && auth.Value != "" {
+		rec.Amount = auth.Value
+	}
+	rec.Legs = splitLegs(req.PaymentRequirements, rec.Amount)
+
+	// The block the settlement was mined in is what a reorg is detected by
+	if client, ok := q.app.clients[rec.Network]; ok {
+		receipt, err := client.TransactionReceipt(ctx, common.HexToHash(rec.Transaction))
+		if err != nil {
+			q.app.logger.Warn("failed to get receipt of settled payment",
+				zap.String("transaction", rec.Transaction),
+				zap.Error(err),
+			)
+		} else {
+			rec.BlockNumber = receipt.BlockNumber.Uint64()
+			rec.BlockHash = receipt.BlockHash.Hex()
+		}
+	}
+	if !q.app.tracksFinality(rec.Network) {
+		rec.State = settlementSettled
+		rec.SettledAt = &now
+	}
+	if err := q.save(ctx, rec); err != nil {
+		q.mu.Lock()
+		q.unjournaled[rec.ID] = rec
+		q.mu.Unlock()
+		data := rec.eventData()
+		data["error"] = err.Error()
+		q.app.emit("x402_settlement_unjournaled", data)
+		return err
+	}
+	q.remember(rec)
+	return nil
+}
+
+// flushUnjournaled writes the records of settled payments that could not
+// be written before.
+func (q *SettlementQueue) flushUnjournaled(ctx context.Context) {
+	q.mu.Lock()
+	recs := make([]*settlementRecord, 0, len(q.unjournaled))
+	for _, rec := range q.unjournaled {
+		recs = append(recs, rec)
+	}
+	q.mu.Unlock()
+
+	for _, rec := range recs {
+		if err := q.save(ctx, rec); err != nil {
+			q.app.logger.Warn("failed to journal settled payment, will retry",
+				zap.String("id", rec.ID),
+				zap.String("transaction", rec.Transaction),
+				zap.Error(err),
+			)
+			continue
+		}
+		q.mu.Lock()
+		delete(q.unjournaled, rec.ID)
+		q.records[rec.ID] = rec
+		q.mu.Unlock()
+		q.app.logger.Info("journaled settled payment",
+			zap.String("id", rec.ID),
+			zap.String("transaction", rec.Transaction),
+		)
+	}
+}
+
+// watchFinality checks settlements awaiting confirmations until ctx is
+// done, journaling those that could not be journaled when settled first.
+func (q *SettlementQueue) watchFinality(ctx context.Context) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(finalityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			q.mu.Lock()
+			for _, rec := range q.unjournaled {
+				q.app.logger.Error("settled payment was never journaled",
+					zap.String("id", rec.ID),
+					zap.String("transaction", rec.Transaction),
+					zap.Int("legs", len(rec.Legs)),
+				)
+			}
+			q.mu.Unlock()
+			return
+		}
+		q.flushUnjournaled(ctx)
+
+		byNetwork := make(map[string][]*settlementRecord)
+		q.mu.Lock()
+		for _, rec := range q.records {
+			watched := rec.State == settlementConfirming ||
+				(rec.State == settlementOrphaned && time.Since(rec.UpdatedAt) < orphanWatchWindow)
+			if watched && !q.inFlight[rec.ID] {
+				copied := *rec
+				byNetwork[rec.Network] = append(byNetwork[rec.Network], &copied)
+			}
+		}
+		q.mu.Unlock()
+
+		for network, recs := range byNetwork {
+			checkCtx, cancel := context.WithTimeout(ctx, balanceQueryTimeout)
+			q.checkFinality(checkCtx, network, recs)
+			cancel()
+		}
+	}
+}
+
+// checkFinality brings the records of settlements on network up to date
+// with the chain: settlements with enough confirmations become final, and
+// those whose transaction was reorged out or reverted are flagged.
+func (q *SettlementQueue) checkFinality(ctx context.Context, network string, recs []*settlementRecord) {
+	client, ok := q.app.clients[network]
+	if !ok {
+		return
+	}
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		q.app.logger.Warn("failed to get latest block for finality check",
+			zap.String("network", network),
+			zap.Error(err),
+		)
+		return
+	}
+	required := uint64(max(q.app.confirmations(network), 1))
+
+	for _, rec := range recs {
+		if rec.Transaction == "" {
+			continue
+		}
+		receipt, err := client.TransactionReceipt(ctx, common.HexToHash(rec.Transaction))
+		switch {
+		case errors.Is(err, ethereum.NotFound):
+			if rec.State == settlementConfirming && q.orphaned(ctx, network, rec) {
+				q.transition(rec, settlementOrphaned, "transaction_orphaned: block "+rec.BlockHash+" was reorged out")
+			}
+			continue
+		case err != nil:
+			q.app.logger.Debug("failed to get settlement receipt",
+				zap.String("id", rec.ID),
+				zap.String("transaction", rec.Transaction),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		blockHash := receipt.BlockHash.Hex()
+		moved := rec.BlockHash != "" && rec.BlockHash != blockHash
+		rec.BlockNumber = receipt.BlockNumber.Uint64()
+		rec.BlockHash = blockHash
+		if head+1 > rec.BlockNumber {
+			rec.Confirmations = int(head + 1 - rec.BlockNumber)
+		}
+		if moved || rec.State == settlementOrphaned {
+			q.app.logger.Warn("settlement transaction moved by reorg",
+				zap.String("id", rec.ID),
+				zap.String("network", network),
+				zap.String("transaction", rec.Transaction),
+				zap.Uint64("block_number", rec.BlockNumber),
+			)
+			q.app.emit("x402_settlement_reorged", rec.eventData())
+		}
+
+		switch {
+		case receipt.Status != ethtypes.ReceiptStatusSuccessful:
+			q.transition(rec, settlementReverted, "transaction_reverted")
+		case !q.authorizationExecuted(rec, receipt):
+			q.transition(rec, settlementReverted, "transaction_reverted: transfer failed within transaction")
+		case uint64(rec.Confirmations) >= required:
+			q.transition(rec, settlementSettled, "")
+		default:
+			q.transition(rec, settlementConfirming, "")
+		}
+	}
+}
+
+// orphaned reports whether the block rec's transaction was mined in is no
+// longer part of the chain. A missing receipt alone is not enough, as
+// lagging RPC endpoints may not know the transaction yet.
+func (q *SettlementQueue) orphaned(ctx context.Context, network string, rec *settlementRecord) bool {
+	if rec.BlockHash == "" {
+		return false
+	}
+	header, err := q.app.clients[network].HeaderByNumber(ctx, new(big.Int).SetUint64(rec.BlockNumber))
+	if err != nil {
+		return false
+	}
+	return header.Hash().Hex() != rec.BlockHash
+}
+
+// authorizationExecuted reports whether receipt shows rec's authorization
+// being used. Payments without an EIP-3009 authorization are taken to be
+// executed if the transaction succeeded.
+func (q *SettlementQueue) authorizationExecuted(rec *settlementRecord, receipt *ethtypes.Receipt) bool {
+	auth, ok := exactAuthorization(rec.Request.PaymentPayload)
+	if !ok {
+		return true
+	}
+	token := q.app.tokenAddress(rec.Request.PaymentRequirements)
+	return authorizationUsed(receipt, batchCall{token: common.HexToAddress(token), auth: auth})
+}
+
+// transition journals rec in state, emitting an event if the state
+// changed. Progress in confirmations alone is only kept in memory.
+func (q *SettlementQueue) transition(rec *settlementRecord, state settlementState, reason string) {
+	q.mu.Lock()
+	current, ok := q.records[rec.ID]
+	unchanged := ok && current.State == state && current.BlockHash == rec.BlockHash
+	if unchanged {
+		current.Confirmations = rec.Confirmations
+	}
+	q.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	now := time.Now()
+	changed := rec.State != state
+	rec.State = state
+	rec.UpdatedAt = now
+	rec.LastError = reason
+	if state == settlementSettled {
+		rec.SettledAt = &now
+	}
+
+	if err := q.save(context.Background(), rec); err != nil {
+		q.app.logger.Error("failed to journal settlement finality",
+			zap.String("id", rec.ID),
+			zap.String("state", string(rec.State)),
+			zap.Error(err),
+		)
+	}
+	q.remember(rec)
+	if !changed {
+		return
+	}
+
+	switch state {
+	case settlementSettled:
+		q.app.logger.Info("payment settlement final",
+			zap.String("id", rec.ID),
+			zap.String("network", rec.Network),
+			zap.String("transaction", rec.Transaction),
+			zap.Int("confirmations", rec.Confirmations),
+		)
+		q.app.emit("x402_settlement_settled", rec.eventData())
+	case settlementReverted:
+		q.app.logger.Error("settlement transaction reverted",
+			zap.String("id", rec.ID),
+			zap.String("network", rec.Network),
+			zap.String("transaction", rec.Transaction),
+			zap.String("error", reason),
+		)
+		q.app.emit("x402_settlement_reverted", rec.eventData())
+	case settlementOrphaned:
+		q.app.logger.Error("settlement transaction orphaned by reorg",
+			zap.String("id", rec.ID),
+			zap.String("network", rec.Network),
+			zap.String("transaction", rec.Transaction),
+			zap.Uint64("block_number", rec.BlockNumber),
+		)
+		q.app.emit("x402_settlement_orphaned", rec.eventData())
+	}
+}
@@ -0,0 +1,196 @@
+package x402pay
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// defaultGasMonitorInterval is how often balances are checked when no
+// interval is configured.
+const defaultGasMonitorInterval = time.Minute
+
+// GasMonitor periodically checks the facilitator account's native-token
+// balance on every chain network, since settlement transactions are paid
+// for from it. A network whose balance falls below its low-water mark is
+// marked unhealthy, a warning is logged and an x402_gas_low event is
+// emitted; x402_gas_recovered is emitted once it is topped up again.
+type GasMonitor struct {
+	// Interval between balance checks. Defaults to 1m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// LowWaterMark is the default minimum balance, in wei, for networks
+	// that do not set gas_low_water_mark themselves.
+	LowWaterMark string `json:"low_water_mark,omitempty"`
+
+	// RefuseWhenLow makes the facilitator reject new verifications on a
+	// network while its balance is below the low-water mark, rather than
+	// accepting payments it may not be able to settle.
+	RefuseWhenLow bool `json:"refuse_when_low,omitempty"`
+
+	// Runtime fields
+	defaultMark *big.Int
+	marks       map[string]*big.Int
+	mu          sync.RWMutex
+	states      map[string]*gasState
+}
+
+// gasState is the last observed gas balance on a network.
+type gasState struct {
+	Network      string    `json:"network"`
+	Address      string    `json:"address"`
+	Balance      string    `json:"balance,omitempty"`
+	LowWaterMark string    `json:"low_water_mark,omitempty"`
+	Healthy      bool      `json:"healthy"`
+	CheckedAt    time.Time `json:"checked_at,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// provision resolves the low-water mark of each network.
+func (g *GasMonitor) provision(networks []ChainNetworkConfig) error {
+	if g.Interval <= 0 {
+		g.Interval = caddy.Duration(defaultGasMonitorInterval)
+	}
+
+	var defaultMark *big.Int
+	if g.LowWaterMark != "" {
+		mark, ok := new(big.Int).SetString(g.LowWaterMark, 10)
+		if !ok || mark.Sign() < 0 {
+			return fmt.Errorf("invalid gas_monitor low_water_mark: %s", g.LowWaterMark)
+		}
+		defaultMark = mark
+	}
+
+	g.defaultMark = defaultMark
+	g.marks = make(map[string]*big.Int)
+	g.states = make(map[string]*gasState)
+	for _, network := range networks {
+		if err := g.addNetwork(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addNetwork starts monitoring network.
+func (g *GasMonitor) addNetwork(network ChainNetworkConfig) error {
+	mark := g.defaultMark
+	if network.GasLowWaterMark != "" {
+		var ok bool
+		mark, ok = new(big.Int).SetString(network.GasLowWaterMark, 10)
+		if !ok || mark.Sign() < 0 {
+			return fmt.Errorf("chain network %s: invalid gas_low_water_mark: %s", network.Name, network.GasLowWaterMark)
+		}
+	}
+	g.marks[network.Name] = mark
+	g.states[network.Name] = &gasState{Network: network.Name, Healthy: true}
+	if mark != nil {
+		g.states[network.Name].LowWaterMark = mark.String()
+	}
+	return nil
+}
+
+// run checks balances every interval until ctx is done.
+func (g *GasMonitor) run(ctx context.Context, app *X402FacilitatorApp) {
+	ticker := time.NewTicker(time.Duration(g.Interval))
+	defer ticker.Stop()
+
+	for {
+		g.checkAll(ctx, app)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkAll checks the facilitator's balance on every network.
+func (g *GasMonitor) checkAll(ctx context.Context, app *X402FacilitatorApp) {
+	address := app.facilitatorAddress()
+	for network := range g.marks {
+		checkCtx, cancel := context.WithTimeout(ctx, balanceQueryTimeout)
+		balance, err := app.nativeBalance(checkCtx, network, address)
+		cancel()
+		g.record(app, network, address, balance, err)
+	}
+}
+
+// record stores the outcome of a balance check and reports transitions.
+func (g *GasMonitor) record(app *X402FacilitatorApp, network string, address common.Address, balance *big.Int, err error) {
+	g.mu.Lock()
+	state := g.states[network]
+	state.Address = address.Hex()
+	state.CheckedAt = time.Now()
+	wasHealthy := state.Healthy
+	if err != nil {
+		// Keep the previous verdict; an unreachable RPC is a different problem
+		state.Error = err.Error()
+		g.mu.Unlock()
+		app.logger.Warn("failed to check facilitator gas balance",
+			zap.String("network", network),
+			zap.Error(err),
+		)
+		return
+	}
+	state.Error = ""
+	state.Balance = balance.String()
+	mark := g.marks[network]
+	state.Healthy = mark == nil || balance.Cmp(mark) >= 0
+	healthy := state.Healthy
+	g.mu.Unlock()
+
+	data := map[string]any{
+		"network": network,
+		"address": address.Hex(),
+		"balance": balance.String(),
+	}
+	switch {
+	case wasHealthy && !healthy:
+		data["low_water_mark"] = mark.String()
+		app.logger.Warn("facilitator gas balance is below low-water mark",
+			zap.String("network", network),
+			zap.String("address", address.Hex()),
+			zap.String("balance", balance.String()),
+			zap.String("low_water_mark", mark.String()),
+		)
+		app.emit("x402_gas_low", data)
+	case !wasHealthy && healthy:
+		app.logger.Info("facilitator gas balance recovered",
+			zap.String("network", network),
+			zap.String("balance", balance.String()),
+		)
+		app.emit("x402_gas_recovered", data)
+	}
+}
+
+// healthy reports whether the facilitator can currently afford gas on network.
+func (g *GasMonitor) healthy(network string) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	state, ok := g.states[network]
+	return !ok || state.Healthy
+}
+
+// snapshot returns the last observed state of every network.
+func (g *GasMonitor) snapshot() []gasState {
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	states := make([]gasState, 0, len(g.states))
+	for _, state := range g.states {
+		states = append(states, *state)
+	}
+	return states
+}
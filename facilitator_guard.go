@@ -0,0 +1,85 @@
+package x402pay
+
+import (
+	"context"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/facilitator"
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+)
+
+// guardedFacilitator wraps the library facilitator so that the app can turn
+// payments away based on its own view of the chains, before any work is
+// done on them, and settle payments itself so that every transaction from
+// the facilitator account goes through its nonce manager.
+type guardedFacilitator struct {
+	facilitator.PaymentFacilitator
+	app *X402FacilitatorApp
+}
+
+// Verify verifies a payment payload unless the app refuses the network.
+func (g *guardedFacilitator) Verify(ctx context.Context, req *types.VerifyRequest) (*types.VerifyResponse, error) {
+	if reason := g.app.refusalReason(req.PaymentRequirements.Network); reason != "" {
+		return &types.VerifyResponse{
+			IsValid:       false,
+			InvalidReason: reason,
+		}, nil
+	}
+	if req.PaymentRequirements.Scheme == schemeUpto {
+		return g.app.verifyUpto(ctx, req, false), nil
+	}
+	routed, ok := g.app.libraryRequest(req)
+	if !ok {
+		return &types.VerifyResponse{
+			IsValid:       false,
+			InvalidReason: "unsupported_asset",
+		}, nil
+	}
+	return g.PaymentFacilitator.Verify(ctx, routed)
+}
+
+// Settle settles a payment with a transaction sent through the app's
+// transactor for the network, so that its nonce is assigned alongside
+// those of batches, upto settlements and split payment legs on the same
+// account, and the nonce manager looks after it until it is mined. Exact
+// payments fall back to the library only on networks without a
+// transactor. Batched settlements do not come through here, see
+// settleBatch.
+func (g *guardedFacilitator) Settle(ctx context.Context, req *types.VerifyRequest) (*types.SettleResponse, error) {
+	network := req.PaymentRequirements.Network
+	if _, ok := g.app.transactors[network]; ok || req.PaymentRequirements.Scheme == schemeUpto {
+		result := g.app.settleBatch(ctx, network, []*types.VerifyRequest{req}, &SettlementBatch{})[0]
+		resp := &types.SettleResponse{
+			Success:     result.Err == nil,
+			Transaction: result.Transaction,
+			Network:     network,
+			Payer:       result.Payer,
+		}
+		if result.Err != nil {
+			resp.ErrorReason = result.Err.Error()
+		}
+		return resp, nil
+	}
+
+	routed, ok := g.app.libraryRequest(req)
+	if !ok {
+		return &types.SettleResponse{
+			Success:     false,
+			ErrorReason: "unsupported_asset",
+			Network:     network,
+		}, nil
+	}
+	resp, err := g.PaymentFacilitator.Settle(ctx, routed)
+	if resp != nil {
+		resp.Network = network
+	}
+	return resp, err
+}
+
+// refusalReason returns why new payments on network should be refused, or
+// the empty string if they may proceed.
+func (m *X402FacilitatorApp) refusalReason(network string) string {
+	if m.GasMonitor != nil && m.GasMonitor.RefuseWhenLow && !m.GasMonitor.healthy(network) {
+		return "facilitator_insufficient_gas"
+	}
+	return ""
+}
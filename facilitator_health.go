@@ -0,0 +1,223 @@
+package x402pay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckInterval = 15 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultMaxBlockAge         = 2 * time.Minute
+)
+
+// HealthCheck configures the background probes the facilitator runs against
+// each chain network's RPC. A network is healthy when its RPC reports the
+// configured chain ID, its latest block keeps advancing, and contract code
+// is present at the configured token address.
+type HealthCheck struct {
+	// Interval between probes. Defaults to 15s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Timeout for each probe. Defaults to 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// MaxBlockAge is how long the latest block number may stay the same
+	// before the chain is considered stalled. Defaults to 2m; a negative
+	// value disables the check, which suits dev chains that only mine on
+	// demand.
+	MaxBlockAge caddy.Duration `json:"max_block_age,omitempty"`
+
+	// Runtime fields
+	mu     sync.RWMutex
+	states map[string]*networkHealth
+}
+
+// networkHealth is the outcome of the latest probe of a chain network.
+type networkHealth struct {
+	Network         string    `json:"network"`
+	Healthy         bool      `json:"healthy"`
+	ChainID         uint64    `json:"chain_id,omitempty"`
+	LatestBlock     uint64    `json:"latest_block,omitempty"`
+	BlockAdvancedAt time.Time `json:"block_advanced_at,omitempty"`
+	TokenCode       bool      `json:"token_code_present"`
+	GasOK           bool      `json:"gas_ok"`
+	CheckedAt       time.Time `json:"checked_at,omitempty"`
+	Errors          []string  `json:"errors,omitempty"`
+
+	// Endpoints is the state of each RPC endpoint of a pooled network.
+	Endpoints []rpcEndpointState `json:"endpoints,omitempty"`
+}
+
+// facilitatorHealth summarizes the health of the facilitator app.
+type facilitatorHealth struct {
+	Ready    bool            `json:"ready"`
+	Networks []networkHealth `json:"networks"`
+}
+
+// provision applies defaults.
+func (h *HealthCheck) provision(networks []ChainNetworkConfig) {
+	if h.Interval <= 0 {
+		h.Interval = caddy.Duration(defaultHealthCheckInterval)
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = caddy.Duration(defaultHealthCheckTimeout)
+	}
+	if h.MaxBlockAge == 0 {
+		h.MaxBlockAge = caddy.Duration(defaultMaxBlockAge)
+	}
+	h.states = make(map[string]*networkHealth, len(networks))
+	for _, network := range networks {
+		h.addNetwork(network)
+	}
+}
+
+// addNetwork starts probing network.
+func (h *HealthCheck) addNetwork(network ChainNetworkConfig) {
+	h.states[network.Name] = &networkHealth{Network: network.Name}
+}
+
+// run probes every network each interval until ctx is done.
+func (h *HealthCheck) run(ctx context.Context, app *X402FacilitatorApp) {
+	ticker := time.NewTicker(time.Duration(h.Interval))
+	defer ticker.Stop()
+
+	for {
+		for _, network := range app.ChainNetworks {
+			h.probe(ctx, app, network)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe checks a single network and records the result.
+func (h *HealthCheck) probe(ctx context.Context, app *X402FacilitatorApp, network ChainNetworkConfig) {
+	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(h.Timeout))
+	defer cancel()
+
+	var errs []string
+	client, ok := app.clients[network.Name]
+	if !ok {
+		errs = append(errs, "no rpc client")
+	}
+
+	h.mu.RLock()
+	prev := *h.states[network.Name]
+	h.mu.RUnlock()
+
+	now := time.Now()
+	next := networkHealth{
+		Network:         network.Name,
+		LatestBlock:     prev.LatestBlock,
+		BlockAdvancedAt: prev.BlockAdvancedAt,
+		CheckedAt:       now,
+	}
+
+	if client != nil {
+		chainID, err := client.ChainID(probeCtx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("chain id: %v", err))
+		} else {
+			next.ChainID = chainID.Uint64()
+			if next.ChainID != network.ID {
+				errs = append(errs, fmt.Sprintf("chain id is %d, expected %d", next.ChainID, network.ID))
+			}
+		}
+
+		block, err := client.BlockNumber(probeCtx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("block number: %v", err))
+		} else if block > next.LatestBlock || next.BlockAdvancedAt.IsZero() {
+			next.LatestBlock = block
+			next.BlockAdvancedAt = now
+		}
+		if h.MaxBlockAge > 0 && !next.BlockAdvancedAt.IsZero() &&
+			now.Sub(next.BlockAdvancedAt) > time.Duration(h.MaxBlockAge) {
+			errs = append(errs, fmt.Sprintf("no new block since %s", next.BlockAdvancedAt.UTC().Format(time.RFC3339)))
+		}
+
+		next.TokenCode = true
+		for _, asset := range network.assets() {
+			code, err := client.CodeAt(probeCtx, common.HexToAddress(asset.Address), nil)
+			if err != nil {
+				next.TokenCode = false
+				errs = append(errs, fmt.Sprintf("token code: %v", err))
+			} else if len(bytes.TrimLeft(code, "\x00")) == 0 {
+				next.TokenCode = false
+				errs = append(errs, fmt.Sprintf("no contract code at token address %s", asset.Address))
+			}
+		}
+	}
+
+	next.GasOK = app.GasMonitor.healthy(network.Name)
+	next.Endpoints = app.pools[network.Name].snapshot()
+	next.Errors = errs
+	next.Healthy = len(errs) == 0
+
+	h.mu.Lock()
+	*h.states[network.Name] = next
+	h.mu.Unlock()
+
+	data := map[string]any{"network": network.Name}
+	switch {
+	case prev.CheckedAt.IsZero() && next.Healthy:
+		// First probe came back fine; nothing changed from the operator's view
+	case (prev.Healthy || prev.CheckedAt.IsZero()) && !next.Healthy:
+		data["errors"] = errs
+		app.logger.Warn("chain network is unhealthy",
+			zap.String("network", network.Name),
+			zap.Strings("errors", errs),
+		)
+		app.emit("x402_network_unhealthy", data)
+	case !prev.Healthy && next.Healthy:
+		app.logger.Info("chain network is healthy again",
+			zap.String("network", network.Name),
+		)
+		app.emit("x402_network_healthy", data)
+	}
+}
+
+// snapshot returns the health of the given networks, or of all networks if
+// none are given. The facilitator is ready when every one of them has been
+// probed successfully and can afford gas.
+func (h *HealthCheck) snapshot(networks ...string) facilitatorHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(networks) == 0 {
+		for name := range h.states {
+			networks = append(networks, name)
+		}
+	}
+	sort.Strings(networks)
+
+	health := facilitatorHealth{Ready: true, Networks: []networkHealth{}}
+	for _, name := range networks {
+		state, ok := h.states[name]
+		if !ok {
+			health.Ready = false
+			health.Networks = append(health.Networks, networkHealth{
+				Network: name,
+				Errors:  []string{"unknown chain network"},
+			})
+			continue
+		}
+		if !state.Healthy || !state.GasOK {
+			health.Ready = false
+		}
+		health.Networks = append(health.Networks, *state)
+	}
+	return health
+}
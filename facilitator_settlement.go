@@ -0,0 +1,745 @@
+package x402pay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSettlementWorkers      = 1
+	defaultSettlementMaxAttempts  = 5
+	defaultSettlementRetryBackoff = 10 * time.Second
+	defaultSettlementRetention    = 7 * 24 * time.Hour
+
+	// settlementMaxBackoff caps the delay between settlement attempts.
+	settlementMaxBackoff = 10 * time.Minute
+
+	// settlementTimeout bounds a single settlement attempt, which includes
+	// waiting for the transaction to be mined.
+	settlementTimeout = 2 * time.Minute
+
+	// journalRescanInterval is how often the journal is re-read, to pick up
+	// settlements queued or replayed by other instances sharing the storage.
+	journalRescanInterval = 30 * time.Second
+
+	// journalPrefix is the storage prefix of journal records.
+	journalPrefix = "x402/settlements"
+)
+
+// settlementState is the state of a journaled settlement.
+type settlementState string
+
+const (
+	settlementPending    settlementState = "pending"
+	settlementConfirming settlementState = "confirming"
+	settlementSettled    settlementState = "settled"
+	settlementDead       settlementState = "dead"
+	settlementReverted   settlementState = "reverted"
+	settlementOrphaned   settlementState = "orphaned"
+)
+
+// errPaymentAlreadyQueued is returned when a payment that is already in
+// the journal is presented again.
+var errPaymentAlreadyQueued = errors.New("payment_already_used")
+
+// SettlementQueue makes settlement asynchronous. Sellers in optimistic mode
+// serve the resource as soon as a payment is verified and hand it to this
+// queue, which journals it to storage and settles it in the background.
+// Failed settlements are retried with exponential backoff and dead-lettered
+// after MaxAttempts; they can be inspected and replayed through the admin
+// API. The journal doubles as the facilitator's payment ledger.
+//
+// On chain networks that require confirmations, a mined settlement stays
+// confirming until it is final. Its transaction is watched meanwhile, and
+// the payment is marked reverted or orphaned if a reorg undoes it.
+type SettlementQueue struct {
+	// Workers is the number of settlements processed concurrently.
+	// Defaults to 1.
+	Workers int `json:"workers,omitempty"`
+
+	// MaxAttempts is how often settlement is tried before the payment is
+	// dead-lettered. Defaults to 5.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// RetryBackoff is the delay before the first retry; it doubles with
+	// every further attempt, up to 10m. Defaults to 10s.
+	RetryBackoff caddy.Duration `json:"retry_backoff,omitempty"`
+
+	// Retention is how long settled payments stay in the journal.
+	// Defaults to 7 days. Dead-lettered payments are kept until replayed.
+	Retention caddy.Duration `json:"retention,omitempty"`
+
+	// Directory keeps the journal in a local directory. If neither it nor
+	// Storage is set, Caddy's configured storage is used.
+	Directory string `json:"directory,omitempty"`
+
+	// StorageRaw is a storage module to keep the journal in.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// Batch, if set, settles payments in batches rather than one by one.
+	Batch *SettlementBatch `json:"batch,omitempty"`
+
+	// Runtime fields
+	storage  certmagic.Storage
+	app      *X402FacilitatorApp
+	mu       sync.Mutex
+	records  map[string]*settlementRecord
+	inFlight map[string]bool
+	jobs     chan []string
+	wake     chan struct{}
+	wg       sync.WaitGroup
+	stopped  chan struct{}
+
+	// unjournaled are settled payments whose record could not be written
+	// yet; watchFinality writes them
+	unjournaled map[string]*settlementRecord
+}
+
+// settlementRecord is a journal entry for one payment.
+type settlementRecord struct {
+	ID            string              `json:"id"`
+	State         settlementState     `json:"state"`
+	Network       string              `json:"network"`
+	Payer         string              `json:"payer,omitempty"`
+	PayTo         string              `json:"pay_to,omitempty"`
+	Amount        string              `json:"amount,omitempty"`
+	Resource      string              `json:"resource,omitempty"`
+	Transaction   string              `json:"transaction,omitempty"`
+	BlockNumber   uint64              `json:"block_number,omitempty"`
+	BlockHash     string              `json:"block_hash,omitempty"`
+	Confirmations int                 `json:"confirmations,omitempty"`
+	BatchID       string              `json:"batch_id,omitempty"`
+	Attempts      int                 `json:"attempts"`
+	LastError     string              `json:"last_error,omitempty"`
+	CreatedAt     time.Time           `json:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at"`
+	NextAttemptAt time.Time           `json:"next_attempt_at,omitempty"`
+	SettledAt     *time.Time          `json:"settled_at,omitempty"`
+	Request       types.VerifyRequest `json:"request"`
+
+	// Legs are the shares of a split payment, paid to each payee once the
+	// payment is settled.
+	Legs []settlementLeg `json:"legs,omitempty"`
+}
+
+// provision sets up the journal storage.
+func (q *SettlementQueue) provision(ctx caddy.Context, app *X402FacilitatorApp) error {
+	if q.Workers <= 0 {
+		q.Workers = defaultSettlementWorkers
+	}
+	if q.MaxAttempts <= 0 {
+		q.MaxAttempts = defaultSettlementMaxAttempts
+	}
+	if q.RetryBackoff <= 0 {
+		q.RetryBackoff = caddy.Duration(defaultSettlementRetryBackoff)
+	}
+	if q.Retention <= 0 {
+		q.Retention = caddy.Duration(defaultSettlementRetention)
+	}
+	if q.Batch != nil {
+		if err := q.Batch.provision(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case q.Directory != "" && q.StorageRaw != nil:
+		return fmt.Errorf("settlement_queue: directory and storage are mutually exclusive")
+	case q.Directory != "":
+		q.storage = &certmagic.FileStorage{Path: q.Directory}
+	case q.StorageRaw != nil:
+		val, err := ctx.LoadModule(q, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading settlement_queue storage module: %v", err)
+		}
+		storage, err := val.(caddy.StorageConverter).CertMagicStorage()
+		if err != nil {
+			return fmt.Errorf("creating settlement_queue storage: %v", err)
+		}
+		q.storage = storage
+	default:
+		q.storage = ctx.Storage()
+	}
+
+	q.app = app
+	q.records = make(map[string]*settlementRecord)
+	q.unjournaled = make(map[string]*settlementRecord)
+	q.inFlight = make(map[string]bool)
+	q.jobs = make(chan []string)
+	q.wake = make(chan struct{}, 1)
+	q.stopped = make(chan struct{})
+	return nil
+}
+
+// run loads the journal and processes settlements until ctx is done.
+func (q *SettlementQueue) run(ctx context.Context) {
+	defer close(q.stopped)
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+	q.wg.Add(1)
+	go q.watchFinality(ctx)
+	q.wg.Add(1)
+	go q.payLegs(ctx)
+	defer q.wg.Wait()
+
+	if err := q.load(ctx); err != nil {
+		q.app.logger.Error("failed to load settlement journal", zap.Error(err))
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastScan := time.Now()
+
+	for {
+		q.dispatch(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		case <-ctx.Done():
+			return
+		}
+
+		if time.Since(lastScan) >= journalRescanInterval {
+			if err := q.load(ctx); err != nil {
+				q.app.logger.Error("failed to rescan settlement journal", zap.Error(err))
+			}
+			lastScan = time.Now()
+		}
+	}
+}
+
+// load reads the journal from storage, replacing the in-memory view of
+// records not currently being settled, and prunes expired settled records.
+func (q *SettlementQueue) load(ctx context.Context) error {
+	keys, err := q.storage.List(ctx, journalPrefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-time.Duration(q.Retention))
+	for _, key := range keys {
+		data, err := q.storage.Load(ctx, key)
+		if err != nil {
+			q.app.logger.Warn("failed to read settlement record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		var rec settlementRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			q.app.logger.Warn("skipping corrupt settlement record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+
+		if rec.State == settlementSettled && rec.UpdatedAt.Before(cutoff) && !rec.owesLegs() {
+			if err := q.storage.Delete(ctx, key); err != nil {
+				q.app.logger.Warn("failed to prune settlement record", zap.String("id", rec.ID), zap.Error(err))
+			}
+			q.mu.Lock()
+			delete(q.records, rec.ID)
+			q.mu.Unlock()
+			continue
+		}
+
+		q.mu.Lock()
+		if !q.inFlight[rec.ID] {
+			q.records[rec.ID] = &rec
+		}
+		q.mu.Unlock()
+	}
+	return nil
+}
+
+// enqueue journals a verified payment for settlement.
+func (q *SettlementQueue) enqueue(ctx context.Context, req *types.VerifyRequest, payer string) (*settlementRecord, error) {
+	id := settlementID(req)
+	now := time.Now()
+	rec := &settlementRecord{
+		ID:            id,
+		State:         settlementPending,
+		Network:       req.PaymentRequirements.Network,
+		Payer:         payer,
+		PayTo:         req.PaymentRequirements.PayTo,
+		Amount:        req.PaymentRequirements.MaxAmountRequired,
+		Resource:      req.PaymentRequirements.Resource,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		NextAttemptAt: now,
+		Request:       *req,
+	}
+	if auth, ok := exactAuthorization(req.PaymentPayload); ok && auth.Value != "" {
+		rec.Amount = auth.Value
+	}
+	rec.Legs = splitLegs(req.PaymentRequirements, rec.Amount)
+
+	// The same signed authorization may only be used once; until it is
+	// settled on chain, the journal is what enforces that.
+	q.mu.Lock()
+	if _, exists := q.records[id]; exists {
+		q.mu.Unlock()
+		return nil, errPaymentAlreadyQueued
+	}
+	q.records[id] = rec
+	q.mu.Unlock()
+
+	// Another instance sharing the journal may have queued it already
+	exists := q.storage.Exists(ctx, settlementKey(id))
+	var err error
+	if !exists {
+		err = q.save(ctx, rec)
+	}
+	if exists || err != nil {
+		q.mu.Lock()
+		delete(q.records, id)
+		q.mu.Unlock()
+		if exists {
+			return nil, errPaymentAlreadyQueued
+		}
+		return nil, err
+	}
+
+	q.app.emit("x402_settlement_queued", rec.eventData())
+	q.notify()
+	return rec, nil
+}
+
+// notify wakes up the dispatcher.
+func (q *SettlementQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands due settlements to idle workers.
+func (q *SettlementQueue) dispatch(ctx context.Context) {
+	for {
+		ids := q.nextDue()
+		if len(ids) == 0 {
+			return
+		}
+		select {
+		case q.jobs <- ids:
+		case <-ctx.Done():
+			q.release(ids)
+			return
+		default:
+			// All workers are busy; try again on the next tick
+			q.release(ids)
+			return
+		}
+	}
+}
+
+// nextDue claims the oldest due pending settlement or, when batching, the
+// oldest batch that is full or has waited long enough.
+func (q *SettlementQueue) nextDue() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	byNetwork := make(map[string][]*settlementRecord)
+	for _, rec := range q.records {
+		if rec.State != settlementPending || q.inFlight[rec.ID] || rec.NextAttemptAt.After(now) {
+			continue
+		}
+		byNetwork[rec.Network] = append(byNetwork[rec.Network], rec)
+	}
+
+	var claim []*settlementRecord
+	for _, due := range byNetwork {
+		sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+		candidate := due[:1]
+		if q.Batch != nil {
+			if len(due) < q.Batch.MaxSize && now.Sub(due[0].NextAttemptAt) < time.Duration(q.Batch.MaxWait) {
+				continue
+			}
+			candidate = due[:min(len(due), q.Batch.MaxSize)]
+		}
+		if claim == nil || candidate[0].NextAttemptAt.Before(claim[0].NextAttemptAt) {
+			claim = candidate
+		}
+	}
+
+	ids := make([]string, len(claim))
+	for i, rec := range claim {
+		q.inFlight[rec.ID] = true
+		ids[i] = rec.ID
+	}
+	return ids
+}
+
+// release marks settlements as no longer being worked on.
+func (q *SettlementQueue) release(ids []string) {
+	q.mu.Lock()
+	for _, id := range ids {
+		delete(q.inFlight, id)
+	}
+	q.mu.Unlock()
+}
+
+// work settles payments handed out by the dispatcher.
+func (q *SettlementQueue) work(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case ids := <-q.jobs:
+			q.settle(ctx, ids)
+			q.release(ids)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// settle makes one settlement attempt for a payment or a batch of
+// payments on the same network. Records are locked in storage so that
+// instances sharing the journal do not settle the same payment twice.
+func (q *SettlementQueue) settle(ctx context.Context, ids []string) {
+	var recs []*settlementRecord
+	for _, id := range ids {
+		lockName := "x402_settlement_" + id
+		if err := q.storage.Lock(ctx, lockName); err != nil {
+			q.app.logger.Warn("failed to lock settlement record", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		defer func() {
+			if err := q.storage.Unlock(context.Background(), lockName); err != nil {
+				q.app.logger.Warn("failed to unlock settlement record", zap.String("id", id), zap.Error(err))
+			}
+		}()
+
+		// Another instance may have settled it meanwhile
+		rec, err := q.read(ctx, id)
+		if err != nil {
+			q.app.logger.Warn("failed to read settlement record", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		if rec.State != settlementPending {
+			q.remember(rec)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) == 0 {
+		return
+	}
+
+	settleCtx, cancel := context.WithTimeout(ctx, settlementTimeout)
+	var results []batchResult
+	var batchID string
+	if q.Batch == nil {
+		resp, err := q.app.facilitator.Settle(settleCtx, &recs[0].Request)
+		if err == nil && !resp.Success {
+			err = errors.New(resp.ErrorReason)
+		}
+		result := batchResult{Err: err}
+		if resp != nil {
+			result.Transaction = resp.Transaction
+			result.Payer = resp.Payer
+		}
+		results = []batchResult{result}
+	} else {
+		reqs := make([]*types.VerifyRequest, len(recs))
+		for i, rec := range recs {
+			reqs[i] = &rec.Request
+		}
+		batchID = batchIDOf(recs)
+		results = q.app.settleBatch(settleCtx, recs[0].Network, reqs, q.Batch)
+	}
+	cancel()
+	if ctx.Err() != nil {
+		// Shutting down; the attempt is not held against the payments
+		return
+	}
+
+	for i, rec := range recs {
+		rec.BatchID = batchID
+		q.finish(rec, results[i])
+	}
+}
+
+// finish journals the outcome of a settlement attempt.
+func (q *SettlementQueue) finish(rec *settlementRecord, result batchResult) {
+	now := time.Now()
+	rec.Attempts++
+	rec.UpdatedAt = now
+	if result.Transaction != "" {
+		rec.Transaction = result.Transaction
+	}
+	if result.Payer != "" {
+		rec.Payer = result.Payer
+	}
+	if result.Err == nil {
+		rec.LastError = ""
+		rec.BlockNumber = result.BlockNumber
+		rec.BlockHash = result.BlockHash
+		if q.app.tracksFinality(rec.Network) && rec.Transaction != "" {
+			rec.State = settlementConfirming
+		} else {
+			rec.State = settlementSettled
+			rec.SettledAt = &now
+		}
+	} else {
+		rec.LastError = result.Err.Error()
+		if rec.Attempts >= q.MaxAttempts {
+			rec.State = settlementDead
+		} else {
+			rec.NextAttemptAt = now.Add(q.backoff(rec.Attempts))
+		}
+	}
+
+	if err := q.save(context.Background(), rec); err != nil {
+		q.app.logger.Error("failed to journal settlement outcome",
+			zap.String("id", rec.ID),
+			zap.String("state", string(rec.State)),
+			zap.Error(err),
+		)
+	}
+	q.remember(rec)
+
+	switch rec.State {
+	case settlementSettled:
+		q.app.logger.Info("payment settled",
+			zap.String("id", rec.ID),
+			zap.String("network", rec.Network),
+			zap.String("transaction", rec.Transaction),
+			zap.Int("attempts", rec.Attempts),
+		)
+		q.app.emit("x402_settlement_settled", rec.eventData())
+	case settlementConfirming:
+		q.app.logger.Info("payment settlement mined, awaiting confirmations",
+			zap.String("id", rec.ID),
+			zap.String("network", rec.Network),
+			zap.String("transaction", rec.Transaction),
+			zap.Uint64("block_number", rec.BlockNumber),
+		)
+	case settlementDead:
+		q.app.logger.Error("settlement dead-lettered",
+			zap.String("id", rec.ID),
+			zap.String("network", rec.Network),
+			zap.Int("attempts", rec.Attempts),
+			zap.String("error", rec.LastError),
+		)
+		q.app.emit("x402_settlement_dead", rec.eventData())
+	default:
+		q.app.logger.Warn("settlement failed, will retry",
+			zap.String("id", rec.ID),
+			zap.Int("attempts", rec.Attempts),
+			zap.Time("next_attempt_at", rec.NextAttemptAt),
+			zap.String("error", rec.LastError),
+		)
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (q *SettlementQueue) backoff(attempts int) time.Duration {
+	delay := time.Duration(q.RetryBackoff) << min(attempts-1, 16)
+	if delay > settlementMaxBackoff || delay <= 0 {
+		delay = settlementMaxBackoff
+	}
+	return delay
+}
+
+// replay puts a dead-lettered, reverted, orphaned or stuck pending
+// settlement back in the queue with a fresh set of attempts. For a settled
+// split payment, it does so with the legs that could not be paid.
+func (q *SettlementQueue) replay(ctx context.Context, id string) (*settlementRecord, error) {
+	q.mu.Lock()
+	busy := q.inFlight[id]
+	q.mu.Unlock()
+	if busy {
+		return nil, fmt.Errorf("settlement %s is being processed", id)
+	}
+
+	rec, err := q.read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case rec.State == settlementSettled && rec.hasDeadLegs():
+		rec.replayLegs(time.Now())
+		if err := q.save(ctx, rec); err != nil {
+			return nil, err
+		}
+		q.remember(rec)
+		return rec, nil
+	case rec.State == settlementSettled:
+		return nil, fmt.Errorf("settlement %s is already settled", id)
+	case rec.State == settlementConfirming:
+		return nil, fmt.Errorf("settlement %s is awaiting confirmations", id)
+	}
+	rec.State = settlementPending
+	rec.BlockNumber = 0
+	rec.BlockHash = ""
+	rec.Confirmations = 0
+	rec.Attempts = 0
+	rec.UpdatedAt = time.Now()
+	rec.NextAttemptAt = rec.UpdatedAt
+	if err := q.save(ctx, rec); err != nil {
+		return nil, err
+	}
+	q.remember(rec)
+	q.notify()
+	return rec, nil
+}
+
+// list returns the journaled settlements, optionally only those in state,
+// oldest first.
+func (q *SettlementQueue) list(state settlementState) []settlementRecord {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	records := []settlementRecord{}
+	for _, rec := range q.records {
+		if state == "" || rec.State == state {
+			records = append(records, *rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records
+}
+
+// get returns a journaled settlement.
+func (q *SettlementQueue) get(ctx context.Context, id string) (*settlementRecord, error) {
+	q.mu.Lock()
+	rec, ok := q.records[id]
+	q.mu.Unlock()
+	if ok {
+		copied := *rec
+		return &copied, nil
+	}
+	return q.read(ctx, id)
+}
+
+// read loads a record from storage.
+func (q *SettlementQueue) read(ctx context.Context, id string) (*settlementRecord, error) {
+	data, err := q.storage.Load(ctx, settlementKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var rec settlementRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("decoding settlement record %s: %w", id, err)
+	}
+	return &rec, nil
+}
+
+// save writes a record to storage.
+func (q *SettlementQueue) save(ctx context.Context, rec *settlementRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := q.storage.Store(ctx, settlementKey(rec.ID), data); err != nil {
+		return fmt.Errorf("journaling settlement %s: %w", rec.ID, err)
+	}
+	return nil
+}
+
+// remember updates the in-memory view of a record.
+func (q *SettlementQueue) remember(rec *settlementRecord) {
+	q.mu.Lock()
+	q.records[rec.ID] = rec
+	q.mu.Unlock()
+}
+
+// eventData returns the fields of a record included in events.
+func (rec *settlementRecord) eventData() map[string]any {
+	data := map[string]any{
+		"id":       rec.ID,
+		"network":  rec.Network,
+		"payer":    rec.Payer,
+		"pay_to":   rec.PayTo,
+		"amount":   rec.Amount,
+		"resource": rec.Resource,
+		"attempts": rec.Attempts,
+	}
+	if rec.Transaction != "" {
+		data["transaction"] = rec.Transaction
+	}
+	if rec.BatchID != "" {
+		data["batch_id"] = rec.BatchID
+	}
+	if rec.BlockHash != "" {
+		data["block_number"] = rec.BlockNumber
+		data["block_hash"] = rec.BlockHash
+		data["confirmations"] = rec.Confirmations
+	}
+	if rec.LastError != "" {
+		data["error"] = rec.LastError
+	}
+	return data
+}
+
+// batchIDOf derives an ID for a batch from the payments in it.
+func batchIDOf(recs []*settlementRecord) string {
+	h := sha256.New()
+	for _, rec := range recs {
+		h.Write([]byte(rec.ID))
+	}
+	h.Write([]byte(time.Now().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// settlementKey returns the storage key of a record.
+func settlementKey(id string) string {
+	return path.Join(journalPrefix, id+".json")
+}
+
+// settlementID derives a stable ID from the payment's authorization, so
+// that the same signed payment always maps to the same journal record.
+func settlementID(req *types.VerifyRequest) string {
+	h := sha256.New()
+	h.Write([]byte(req.PaymentRequirements.Network))
+	if auth, ok := exactAuthorization(req.PaymentPayload); ok {
+		h.Write([]byte(strings.ToLower(auth.From)))
+		h.Write([]byte(strings.ToLower(auth.Nonce)))
+	} else if upto, ok := uptoPayloadOf(req.PaymentPayload); ok {
+		h.Write([]byte(strings.ToLower(upto.Permit.Owner)))
+		h.Write([]byte(upto.Permit.Nonce))
+	} else {
+		payload, _ := json.Marshal(req.PaymentPayload)
+		h.Write(payload)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// exactEVMPayload extracts the signed EIP-3009 authorization of an exact
+// scheme payment payload.
+func exactEVMPayload(payload types.PaymentPayload) (types.ExactEVMPayload, bool) {
+	data, err := json.Marshal(payload.Payload)
+	if err != nil {
+		return types.ExactEVMPayload{}, false
+	}
+	var exact types.ExactEVMPayload
+	if err := json.Unmarshal(data, &exact); err != nil || exact.Authorization.Nonce == "" {
+		return types.ExactEVMPayload{}, false
+	}
+	return exact, true
+}
+
+// exactAuthorization extracts the EIP-3009 authorization from an exact
+// scheme payment payload.
+func exactAuthorization(payload types.PaymentPayload) (types.Authorization, bool) {
+	exact, ok := exactEVMPayload(payload)
+	return exact.Authorization, ok
+}
@@ -0,0 +1,432 @@
+package x402pay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"go.uber.org/zap"
+)
+
+// legCheckInterval is how often settled payments are looked at for legs
+// to pay.
+const legCheckInterval = 5 * time.Second
+
+// errLegNotMined is returned while the transfer of a leg is still waiting
+// to be mined, which is not held against the leg.
+var errLegNotMined = errors.New("transfer is not mined yet")
+
+// legState is the state of a leg of a split payment.
+type legState string
+
+const (
+	// legPending legs are yet to be paid by the facilitator.
+	legPending legState = "pending"
+
+	// legPaid legs were paid by the facilitator.
+	legPaid legState = "paid"
+
+	// legDead legs could not be paid and wait to be replayed.
+	legDead legState = "dead"
+
+	// legContract legs are paid by the splitter contract the payment was
+	// made to.
+	legContract legState = "contract"
+)
+
+// settlementLeg is the share of a split payment that goes to one payee.
+type settlementLeg struct {
+	PayTo         string     `json:"pay_to"`
+	Amount        string     `json:"amount"`
+	State         legState   `json:"state"`
+	Transaction   string     `json:"transaction,omitempty"`
+	Nonce         *uint64    `json:"nonce,omitempty"`
+	Attempts      int        `json:"attempts,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at,omitempty"`
+	PaidAt        *time.Time `json:"paid_at,omitempty"`
+}
+
+// splitOf returns the revenue split payments on requirements are made
+// through, if any.
+func splitOf(requirements types.PaymentRequirements) (paymentSplit, bool) {
+	raw, ok := requirements.Extra["split"]
+	if !ok {
+		return paymentSplit{}, false
+	}
+	// Requirements read back from the journal hold the split as a map
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return paymentSplit{}, false
+	}
+	var split paymentSplit
+	if err := json.Unmarshal(data, &split); err != nil {
+		return paymentSplit{}, false
+	}
+	return split, true
+}
+
+// legs shares amount between the payees of the split: each takes its
+// share in turn, as far as what is left allows, and the remainder goes to
+// the split's remainder address.
+func (s paymentSplit) legs(amount string) []settlementLeg {
+	total, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		return nil
+	}
+	state := legPending
+	if s.Mode == splitContract {
+		state = legContract
+	}
+
+	var legs []settlementLeg
+	left := new(big.Int).Set(total)
+	add := func(payTo string, share *big.Int) {
+		if share.Cmp(left) > 0 {
+			share = new(big.Int).Set(left)
+		}
+		if share.Sign() <= 0 {
+			return
+		}
+		left.Sub(left, share)
+		legs = append(legs, settlementLeg{PayTo: payTo, Amount: share.String(), State: state})
+	}
+	for _, payee := range s.Payees {
+		share := new(big.Int)
+		if payee.Amount != "" {
+			share.SetString(strings.TrimSpace(payee.Amount), 10)
+		} else if percent, ok := new(big.Rat).SetString(strings.TrimSpace(payee.Percent)); ok {
+			portion := new(big.Rat).Mul(new(big.Rat).SetInt(total), percent)
+			portion.Quo(portion, big.NewRat(100, 1))
+			share.Quo(portion.Num(), portion.Denom())
+		}
+		add(payee.Address, share)
+	}
+	add(s.Remainder, new(big.Int).Set(left))
+	return legs
+}
+
+// splitLegs returns the legs of a payment of amount made on requirements,
+// or nil if the payment is not split.
+func splitLegs(requirements types.PaymentRequirements, amount string) []settlementLeg {
+	split, ok := splitOf(requirements)
+	if !ok {
+		return nil
+	}
+	return split.legs(amount)
+}
+
+// hasDeadLegs reports whether a leg of the payment could not be paid.
+func (rec *settlementRecord) hasDeadLegs() bool {
+	for _, leg := range rec.Legs {
+		if leg.State == legDead {
+			return true
+		}
+	}
+	return false
+}
+
+// owesLegs reports whether legs of the payment are still to be paid.
+func (rec *settlementRecord) owesLegs() bool {
+	for _, leg := range rec.Legs {
+		if leg.State == legPending || leg.State == legDead {
+			return true
+		}
+	}
+	return false
+}
+
+// dueLegs reports whether the payment is settled and has legs due to be
+// paid by now.
+func (rec *settlementRecord) dueLegs(now time.Time) bool {
+	if rec.State != settlementSettled {
+		return false
+	}
+	for _, leg := range rec.Legs {
+		if leg.State == legPending && !leg.NextAttemptAt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// payLegs pays the legs of split payments once they are settled, until ctx
+// is done. Legs are only paid out of payments that are final, so that a
+// reorg cannot leave the facilitator paying out what it never received.
+func (q *SettlementQueue) payLegs(ctx context.Context) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(legCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		now := time.Now()
+		var ids []string
+		q.mu.Lock()
+		for _, rec := range q.records {
+			if rec.dueLegs(now) && !q.inFlight[rec.ID] {
+				q.inFlight[rec.ID] = true
+				ids = append(ids, rec.ID)
+			}
+		}
+		q.mu.Unlock()
+
+		for _, id := range ids {
+			q.payRecordLegs(ctx, id)
+			q.release([]string{id})
+		}
+	}
+}
+
+// payRecordLegs makes one attempt at paying each due leg of a payment.
+func (q *SettlementQueue) payRecordLegs(ctx context.Context, id string) {
+	lockName := "x402_settlement_" + id
+	if err := q.storage.Lock(ctx, lockName); err != nil {
+		q.app.logger.Warn("failed to lock settlement record", zap.String("id", id), zap.Error(err))
+		return
+	}
+	defer func() {
+		if err := q.storage.Unlock(context.Background(), lockName); err != nil {
+			q.app.logger.Warn("failed to unlock settlement record", zap.String("id", id), zap.Error(err))
+		}
+	}()
+
+	// Another instance may have paid them meanwhile
+	rec, err := q.read(ctx, id)
+	if err != nil {
+		q.app.logger.Warn("failed to read settlement record", zap.String("id", id), zap.Error(err))
+		return
+	}
+	now := time.Now()
+	if !rec.dueLegs(now) {
+		q.remember(rec)
+		return
+	}
+
+	token := common.HexToAddress(q.app.tokenAddress(rec.Request.PaymentRequirements))
+	for i := range rec.Legs {
+		leg := &rec.Legs[i]
+		if leg.State != legPending || leg.NextAttemptAt.After(now) {
+			continue
+		}
+		err := q.payLeg(ctx, rec, leg, token)
+		if ctx.Err() != nil {
+			// Shutting down; the attempt is not held against the leg
+			break
+		}
+		if errors.Is(err, errLegNotMined) {
+			// Looked up again next time round
+			leg.LastError = err.Error()
+			continue
+		}
+		q.finishLeg(rec, leg, err)
+	}
+
+	if err := q.save(context.Background(), rec); err != nil {
+		q.app.logger.Error("failed to journal split payment legs",
+			zap.String("id", rec.ID),
+			zap.Error(err),
+		)
+	}
+	q.remember(rec)
+}
+
+// payLeg transfers a leg to its payee and waits for the transfer to be
+// mined. A leg whose transfer was sent before is not sent again unless
+// another transaction took its nonce; its transaction is looked up instead.
+func (q *SettlementQueue) payLeg(ctx context.Context, rec *settlementRecord, leg *settlementLeg, token common.Address) error {
+	transactor, ok := q.app.transactors[rec.Network]
+	if !ok {
+		return fmt.Errorf("unsupported_network: %s", rec.Network)
+	}
+	legCtx, cancel := context.WithTimeout(ctx, settlementTimeout)
+	defer cancel()
+
+	var receipt *ethtypes.Receipt
+	if leg.Transaction != "" {
+		var err error
+		if receipt, err = q.legReceipt(legCtx, transactor, leg); err != nil {
+			return err
+		}
+	} else {
+		amount, _ := new(big.Int).SetString(leg.Amount, 10)
+		data, err := erc2612.Pack("transfer", common.HexToAddress(leg.PayTo), amount)
+		if err != nil {
+			return fmt.Errorf("invalid_payload: %w", err)
+		}
+		tx, err := transactor.send(legCtx, token, data)
+		if err != nil {
+			return fmt.Errorf("transaction_failed: %w", err)
+		}
+
+		// Journal the transfer before waiting for it, so that it is not
+		// sent again should we stop meanwhile
+		nonce := tx.Nonce()
+		leg.Transaction = tx.Hash().Hex()
+		leg.Nonce = &nonce
+		if err := q.save(legCtx, rec); err != nil {
+			q.app.logger.Error("failed to journal split payment leg transfer",
+				zap.String("id", rec.ID),
+				zap.String("transaction", leg.Transaction),
+				zap.Error(err),
+			)
+		}
+		receipt, err = transactor.wait(legCtx, tx)
+		switch {
+		case errors.Is(err, errTxSuperseded):
+			// Nothing was transferred, so the leg is sent again
+			leg.Transaction = ""
+			leg.Nonce = nil
+			return fmt.Errorf("confirmation_failed: %w", err)
+		case err != nil && ctx.Err() == nil && legCtx.Err() != nil:
+			return fmt.Errorf("%w: %s", errLegNotMined, leg.Transaction)
+		case err != nil:
+			return fmt.Errorf("confirmation_failed: %w", err)
+		}
+	}
+
+	// A replacement may have been mined in place of the transfer sent
+	leg.Transaction = receipt.TxHash.Hex()
+	if receipt.Status != ethtypes.ReceiptStatusSuccessful {
+		// A reverted transfer moved nothing and can be sent again
+		leg.Transaction = ""
+		return fmt.Errorf("transfer %s reverted", receipt.TxHash.Hex())
+	}
+	return nil
+}
+
+// legReceipt looks up the receipt of the transfer sent for a leg, or of a
+// replacement of it the transactor still knows. If the transfer is not
+// mined but its nonce has been used, it never will be, and the leg is
+// cleared to be sent again.
+func (q *SettlementQueue) legReceipt(ctx context.Context, transactor *chainTransactor, leg *settlementLeg) (*ethtypes.Receipt, error) {
+	hashes := []common.Hash{common.HexToHash(leg.Transaction)}
+	if leg.Nonce != nil {
+		hashes = append(hashes, transactor.sent(*leg.Nonce)...)
+	}
+	lookup := func() (*ethtypes.Receipt, error) {
+		for _, hash := range hashes {
+			receipt, err := transactor.client.TransactionReceipt(ctx, hash)
+			if err == nil {
+				return receipt, nil
+			}
+			if !errors.Is(err, ethereum.NotFound) {
+				return nil, fmt.Errorf("confirmation_failed: %w", err)
+			}
+		}
+		return nil, nil
+	}
+
+	receipt, err := lookup()
+	if receipt != nil || err != nil {
+		return receipt, err
+	}
+	if leg.Nonce == nil {
+		// Journaled without its nonce, so it can only be waited for
+		return nil, fmt.Errorf("%w: %s", errLegNotMined, leg.Transaction)
+	}
+	minedNonce, err := transactor.client.NonceAt(ctx, transactor.from, nil)
+	if err != nil {
+		return nil, fmt.Errorf("confirmation_failed: %w", err)
+	}
+	if *leg.Nonce >= minedNonce {
+		return nil, fmt.Errorf("%w: %s", errLegNotMined, leg.Transaction)
+	}
+
+	// It may have been mined since it was looked up
+	if receipt, err := lookup(); receipt != nil || err != nil {
+		return receipt, err
+	}
+	superseded := leg.Transaction
+	leg.Transaction = ""
+	leg.Nonce = nil
+	return nil, fmt.Errorf("transfer %s was superseded by another transaction with its nonce", superseded)
+}
+
+// finishLeg records the outcome of an attempt at paying a leg.
+func (q *SettlementQueue) finishLeg(rec *settlementRecord, leg *settlementLeg, err error) {
+	now := time.Now()
+	leg.Attempts++
+	if err == nil {
+		leg.State = legPaid
+		leg.LastError = ""
+		leg.PaidAt = &now
+		q.app.logger.Info("split payment leg paid",
+			zap.String("id", rec.ID),
+			zap.String("pay_to", leg.PayTo),
+			zap.String("amount", leg.Amount),
+			zap.String("transaction", leg.Transaction),
+		)
+		q.app.emit("x402_split_leg_paid", rec.legEventData(leg))
+		return
+	}
+
+	leg.LastError = err.Error()
+	if leg.Attempts >= q.MaxAttempts {
+		leg.State = legDead
+		q.app.logger.Error("split payment leg dead-lettered",
+			zap.String("id", rec.ID),
+			zap.String("pay_to", leg.PayTo),
+			zap.String("amount", leg.Amount),
+			zap.Int("attempts", leg.Attempts),
+			zap.String("error", leg.LastError),
+		)
+		q.app.emit("x402_split_leg_dead", rec.legEventData(leg))
+		return
+	}
+	leg.NextAttemptAt = now.Add(q.backoff(leg.Attempts))
+	q.app.logger.Warn("split payment leg failed, will retry",
+		zap.String("id", rec.ID),
+		zap.String("pay_to", leg.PayTo),
+		zap.Int("attempts", leg.Attempts),
+		zap.Time("next_attempt_at", leg.NextAttemptAt),
+		zap.String("error", leg.LastError),
+	)
+}
+
+// replayLegs puts the dead legs of a payment back in line with a fresh
+// set of attempts. A transfer journaled for a leg is looked up before
+// anything is sent, so that a replay cannot pay a leg twice.
+func (rec *settlementRecord) replayLegs(now time.Time) {
+	for i := range rec.Legs {
+		leg := &rec.Legs[i]
+		if leg.State == legDead {
+			leg.State = legPending
+			leg.Attempts = 0
+			leg.LastError = ""
+			leg.NextAttemptAt = now
+		}
+	}
+}
+
+// legEventData returns the fields of a leg included in events.
+func (rec *settlementRecord) legEventData(leg *settlementLeg) map[string]any {
+	data := map[string]any{
+		"id":       rec.ID,
+		"network":  rec.Network,
+		"resource": rec.Resource,
+		"pay_to":   leg.PayTo,
+		"amount":   leg.Amount,
+		"attempts": leg.Attempts,
+	}
+	if leg.Transaction != "" {
+		data["transaction"] = leg.Transaction
+	}
+	if leg.LastError != "" {
+		data["error"] = leg.LastError
+	}
+	return data
+}
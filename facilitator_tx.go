@@ -0,0 +1,511 @@
+package x402pay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"go.uber.org/zap"
+)
+
+const (
+	// fallbackGasLimit is used when gas estimation fails, so that the
+	// transaction is still attempted and its revert reason recorded on chain.
+	fallbackGasLimit = 210000
+
+	defaultStuckAfter         = 2 * time.Minute
+	defaultFeeBump            = 20
+	defaultMaxReplacements    = 5
+	defaultNonceCheckInterval = 15 * time.Second
+
+	// minFeeBump is the smallest fee increase nodes accept for replacing a
+	// pending transaction.
+	minFeeBump = 10
+
+	// receiptPollInterval is how often a waiter looks for a receipt.
+	receiptPollInterval = time.Second
+)
+
+// errTxSuperseded is returned when a transaction's nonce was used by
+// another transaction that was mined instead.
+var errTxSuperseded = errors.New("transaction superseded by another transaction with the same nonce")
+
+// NonceManager tunes how the facilitator tracks the transactions it sends:
+// settlements, batched or not, and split payment legs. Nonces are assigned
+// one at a time per chain network, so concurrent settlements never
+// collide. Transactions that are still pending after StuckAfter are
+// rebroadcast if the node has dropped them, or replaced with a higher gas
+// price otherwise.
+type NonceManager struct {
+	// StuckAfter is how long a transaction may stay pending before it is
+	// rebroadcast or replaced. Defaults to 2m.
+	StuckAfter caddy.Duration `json:"stuck_after,omitempty"`
+
+	// FeeBump is the gas price increase, in percent, of a replacement
+	// transaction. Defaults to 20; nodes require at least 10.
+	FeeBump int `json:"fee_bump,omitempty"`
+
+	// MaxReplacements is how often a transaction is replaced before it is
+	// reported as stuck and left alone. Defaults to 5.
+	MaxReplacements int `json:"max_replacements,omitempty"`
+
+	// CheckInterval is how often pending transactions are checked.
+	// Defaults to 15s.
+	CheckInterval caddy.Duration `json:"check_interval,omitempty"`
+}
+
+// chainTransactor sends transactions from the facilitator account on one
+// chain network and keeps track of them until they are mined.
+type chainTransactor struct {
+	network string
+	client  *ethclient.Client
+	key     *ecdsa.PrivateKey
+	from    common.Address
+	signer  ethtypes.Signer
+	manager *NonceManager
+	app     *X402FacilitatorApp
+
+	mu         sync.Mutex
+	nonce      uint64
+	nonceKnown bool
+	pending    map[uint64]*pendingTx
+}
+
+// pendingTx is a transaction that has been sent but not yet seen mined,
+// along with every replacement sent for it.
+type pendingTx struct {
+	nonce        uint64
+	hashes       []common.Hash
+	latest       *ethtypes.Transaction
+	sentAt       time.Time
+	replacements int
+	reported     bool
+	err          error
+
+	// doneAt is when the transaction was seen mined or given up on. The
+	// entry is kept for a while so that waiters can pick up the outcome.
+	doneAt time.Time
+}
+
+// txState is the observable state of a pending transaction.
+type txState struct {
+	Network      string    `json:"network"`
+	Nonce        uint64    `json:"nonce"`
+	Hash         string    `json:"hash"`
+	GasPrice     string    `json:"gas_price"`
+	SentAt       time.Time `json:"sent_at"`
+	Replacements int       `json:"replacements,omitempty"`
+	Replaced     []string  `json:"replaced,omitempty"`
+}
+
+// provision applies defaults.
+func (n *NonceManager) provision() error {
+	if n.StuckAfter <= 0 {
+		n.StuckAfter = caddy.Duration(defaultStuckAfter)
+	}
+	if n.FeeBump == 0 {
+		n.FeeBump = defaultFeeBump
+	}
+	if n.FeeBump < minFeeBump {
+		return fmt.Errorf("nonce_manager fee_bump must be at least %d percent", minFeeBump)
+	}
+	if n.MaxReplacements <= 0 {
+		n.MaxReplacements = defaultMaxReplacements
+	}
+	if n.CheckInterval <= 0 {
+		n.CheckInterval = caddy.Duration(defaultNonceCheckInterval)
+	}
+	return nil
+}
+
+// newChainTransactors creates a transactor for every chain network.
+func (m *X402FacilitatorApp) newChainTransactors() error {
+	key, err := crypto.HexToECDSA(trimHexPrefix(m.PrivateKey))
+	if err != nil {
+		return fmt.Errorf("invalid private_key: %v", err)
+	}
+
+	m.transactors = make(map[string]*chainTransactor, len(m.ChainNetworks))
+	for _, network := range m.ChainNetworks {
+		m.transactors[network.Name] = &chainTransactor{
+			network: network.Name,
+			client:  m.clients[network.Name],
+			key:     key,
+			from:    crypto.PubkeyToAddress(key.PublicKey),
+			signer:  ethtypes.LatestSignerForChainID(new(big.Int).SetUint64(network.ID)),
+			manager: m.NonceManager,
+			app:     m,
+			pending: make(map[uint64]*pendingTx),
+		}
+	}
+	return nil
+}
+
+// runNonceManager checks pending transactions every interval until ctx is
+// done.
+func (m *X402FacilitatorApp) runNonceManager(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(m.NonceManager.CheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, transactor := range m.transactors {
+			checkCtx, cancel := context.WithTimeout(ctx, balanceQueryTimeout)
+			transactor.check(checkCtx)
+			cancel()
+		}
+	}
+}
+
+// send signs and broadcasts a call of data on to. Unless gas_limit and
+// gas_price are configured, gas is estimated with a 20% margin and the
+// gas price is the one suggested by the RPC.
+func (t *chainTransactor) send(ctx context.Context, to common.Address, data []byte) (*ethtypes.Transaction, error) {
+	gasLimit := t.app.GasLimit
+	if gasLimit == 0 {
+		estimate, err := t.client.EstimateGas(ctx, ethereum.CallMsg{From: t.from, To: &to, Data: data})
+		if err != nil {
+			gasLimit = fallbackGasLimit
+		} else {
+			gasLimit = estimate + estimate/5
+		}
+	}
+	gasPrice := new(big.Int).SetUint64(t.app.GasPrice)
+	if gasPrice.Sign() == 0 {
+		var err error
+		if gasPrice, err = t.client.SuggestGasPrice(ctx); err != nil {
+			return nil, fmt.Errorf("failed to get suggested gas price: %w", err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Other instances and the library, on networks without a transactor,
+	// may send from the same account, so the node's pending nonce is
+	// checked every time to stay clear of them
+	nonce, err := t.client.PendingNonceAt(ctx, t.from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending nonce: %w", err)
+	}
+	if t.nonceKnown && t.nonce > nonce {
+		// Transactions we sent may not have reached the node's pool yet
+		nonce = t.nonce
+	}
+	for pendingNonce := range t.pending {
+		if pendingNonce >= nonce {
+			nonce = pendingNonce + 1
+		}
+	}
+	t.nonce = nonce
+	t.nonceKnown = true
+
+	tx, err := ethtypes.SignTx(ethtypes.NewTransaction(t.nonce, to, big.NewInt(0), gasLimit, gasPrice, data), t.signer, t.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	if err := t.client.SendTransaction(ctx, tx); err != nil {
+		// Our view of the nonce may be what is wrong; ask again next time
+		t.nonceKnown = false
+		return nil, fmt.Errorf("failed to send transaction: %w", err)
+	}
+	t.pending[t.nonce] = &pendingTx{
+		nonce:  t.nonce,
+		hashes: []common.Hash{tx.Hash()},
+		latest: tx,
+		sentAt: time.Now(),
+	}
+	t.nonce++
+	return tx, nil
+}
+
+// wait waits for tx, or a replacement of it, to be mined and returns the
+// receipt.
+func (t *chainTransactor) wait(ctx context.Context, tx *ethtypes.Transaction) (*ethtypes.Receipt, error) {
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+
+	for {
+		hashes := []common.Hash{tx.Hash()}
+		t.mu.Lock()
+		p, tracked := t.pending[tx.Nonce()]
+		if tracked {
+			if p.err != nil {
+				err := p.err
+				delete(t.pending, p.nonce)
+				t.mu.Unlock()
+				return nil, err
+			}
+			hashes = append([]common.Hash(nil), p.hashes...)
+		}
+		t.mu.Unlock()
+
+		for _, hash := range hashes {
+			receipt, err := t.client.TransactionReceipt(ctx, hash)
+			if err == nil {
+				t.mu.Lock()
+				delete(t.pending, tx.Nonce())
+				t.mu.Unlock()
+				return receipt, nil
+			}
+			if !errors.Is(err, ethereum.NotFound) && ctx.Err() == nil {
+				t.app.logger.Debug("failed to get transaction receipt",
+					zap.String("network", t.network),
+					zap.String("hash", hash.Hex()),
+					zap.Error(err),
+				)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to wait for transaction %s: %w", tx.Hash().Hex(), ctx.Err())
+		}
+	}
+}
+
+// check looks after pending transactions: those whose nonce has been used
+// by a transaction that is not ours are failed, those the node no longer
+// knows are rebroadcast, and those pending for too long are replaced with a
+// higher gas price.
+func (t *chainTransactor) check(ctx context.Context) {
+	t.mu.Lock()
+	pending := make([]*pendingTx, 0, len(t.pending))
+	for nonce, p := range t.pending {
+		switch {
+		case p.doneAt.IsZero():
+			pending = append(pending, p)
+		case time.Since(p.doneAt) >= time.Duration(t.manager.CheckInterval):
+			// Nobody is waiting for it any more
+			delete(t.pending, nonce)
+		}
+	}
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].nonce < pending[j].nonce })
+
+	minedNonce, err := t.client.NonceAt(ctx, t.from, nil)
+	if err != nil {
+		t.app.logger.Warn("failed to check facilitator nonce",
+			zap.String("network", t.network),
+			zap.Error(err),
+		)
+		return
+	}
+
+	for _, p := range pending {
+		if p.nonce < minedNonce {
+			if t.minedAny(ctx, p) {
+				t.mu.Lock()
+				p.doneAt = time.Now()
+				t.mu.Unlock()
+			} else {
+				t.fail(p, errTxSuperseded)
+			}
+			continue
+		}
+
+		t.mu.Lock()
+		stuck := time.Since(p.sentAt) >= time.Duration(t.manager.StuckAfter)
+		latest := p.latest
+		t.mu.Unlock()
+		if !stuck {
+			continue
+		}
+
+		_, _, err := t.client.TransactionByHash(ctx, latest.Hash())
+		switch {
+		case errors.Is(err, ethereum.NotFound):
+			t.rebroadcast(ctx, p, latest)
+		case err != nil:
+			t.app.logger.Warn("failed to look up pending transaction",
+				zap.String("network", t.network),
+				zap.String("hash", latest.Hash().Hex()),
+				zap.Error(err),
+			)
+		default:
+			t.replace(ctx, p, latest)
+		}
+	}
+}
+
+// sent returns the hashes of every transaction sent with nonce that is
+// still tracked, replacements included.
+func (t *chainTransactor) sent(nonce uint64) []common.Hash {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[nonce]; ok {
+		return append([]common.Hash(nil), p.hashes...)
+	}
+	return nil
+}
+
+// minedAny reports whether any transaction sent for p has a receipt.
+func (t *chainTransactor) minedAny(ctx context.Context, p *pendingTx) bool {
+	t.mu.Lock()
+	hashes := append([]common.Hash(nil), p.hashes...)
+	t.mu.Unlock()
+	for _, hash := range hashes {
+		if _, err := t.client.TransactionReceipt(ctx, hash); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// fail makes waiters of p give up with err.
+func (t *chainTransactor) fail(p *pendingTx, err error) {
+	t.mu.Lock()
+	p.err = err
+	p.doneAt = time.Now()
+	t.mu.Unlock()
+	t.app.logger.Error("facilitator transaction lost",
+		zap.String("network", t.network),
+		zap.Uint64("nonce", p.nonce),
+		zap.Error(err),
+	)
+}
+
+// rebroadcast sends a transaction the node has dropped again.
+func (t *chainTransactor) rebroadcast(ctx context.Context, p *pendingTx, tx *ethtypes.Transaction) {
+	err := t.client.SendTransaction(ctx, tx)
+	t.mu.Lock()
+	p.sentAt = time.Now()
+	t.mu.Unlock()
+
+	data := map[string]any{
+		"network": t.network,
+		"nonce":   p.nonce,
+		"hash":    tx.Hash().Hex(),
+	}
+	if err != nil {
+		t.app.logger.Warn("failed to rebroadcast dropped transaction",
+			zap.String("network", t.network),
+			zap.Uint64("nonce", p.nonce),
+			zap.String("hash", tx.Hash().Hex()),
+			zap.Error(err),
+		)
+		return
+	}
+	t.app.logger.Warn("rebroadcast dropped transaction",
+		zap.String("network", t.network),
+		zap.Uint64("nonce", p.nonce),
+		zap.String("hash", tx.Hash().Hex()),
+	)
+	t.app.emit("x402_tx_dropped", data)
+}
+
+// replace sends tx again with the same nonce and a higher gas price.
+func (t *chainTransactor) replace(ctx context.Context, p *pendingTx, tx *ethtypes.Transaction) {
+	t.mu.Lock()
+	replacements := p.replacements
+	reported := p.reported
+	t.mu.Unlock()
+
+	if replacements >= t.manager.MaxReplacements {
+		if !reported {
+			t.mu.Lock()
+			p.reported = true
+			t.mu.Unlock()
+			t.app.logger.Error("facilitator transaction is stuck",
+				zap.String("network", t.network),
+				zap.Uint64("nonce", p.nonce),
+				zap.String("hash", tx.Hash().Hex()),
+				zap.Int("replacements", replacements),
+			)
+			t.app.emit("x402_tx_stuck", map[string]any{
+				"network":      t.network,
+				"nonce":        p.nonce,
+				"hash":         tx.Hash().Hex(),
+				"replacements": replacements,
+			})
+		}
+		return
+	}
+
+	gasPrice := new(big.Int).Mul(tx.GasPrice(), big.NewInt(int64(100+t.manager.FeeBump)))
+	gasPrice.Div(gasPrice, big.NewInt(100))
+	if suggested, err := t.client.SuggestGasPrice(ctx); err == nil && suggested.Cmp(gasPrice) > 0 {
+		gasPrice = suggested
+	}
+
+	replacement, err := ethtypes.SignTx(ethtypes.NewTransaction(tx.Nonce(), *tx.To(), tx.Value(), tx.Gas(), gasPrice, tx.Data()), t.signer, t.key)
+	if err == nil {
+		err = t.client.SendTransaction(ctx, replacement)
+	}
+	if err != nil {
+		t.app.logger.Warn("failed to replace stuck transaction",
+			zap.String("network", t.network),
+			zap.Uint64("nonce", p.nonce),
+			zap.String("hash", tx.Hash().Hex()),
+			zap.Error(err),
+		)
+		return
+	}
+
+	t.mu.Lock()
+	p.hashes = append(p.hashes, replacement.Hash())
+	p.latest = replacement
+	p.sentAt = time.Now()
+	p.replacements++
+	t.mu.Unlock()
+
+	t.app.logger.Warn("replaced stuck transaction",
+		zap.String("network", t.network),
+		zap.Uint64("nonce", p.nonce),
+		zap.String("replaced", tx.Hash().Hex()),
+		zap.String("hash", replacement.Hash().Hex()),
+		zap.String("gas_price", gasPrice.String()),
+	)
+	t.app.emit("x402_tx_replaced", map[string]any{
+		"network":   t.network,
+		"nonce":     p.nonce,
+		"replaced":  tx.Hash().Hex(),
+		"hash":      replacement.Hash().Hex(),
+		"gas_price": gasPrice.String(),
+	})
+}
+
+// snapshot returns the transactions that are still pending.
+func (t *chainTransactor) snapshot() []txState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make([]txState, 0, len(t.pending))
+	for _, p := range t.pending {
+		if !p.doneAt.IsZero() {
+			continue
+		}
+		state := txState{
+			Network:      t.network,
+			Nonce:        p.nonce,
+			Hash:         p.latest.Hash().Hex(),
+			GasPrice:     p.latest.GasPrice().String(),
+			SentAt:       p.sentAt,
+			Replacements: p.replacements,
+		}
+		for _, hash := range p.hashes[:len(p.hashes)-1] {
+			state.Replaced = append(state.Replaced, hash.Hex())
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Nonce < states[j].Nonce })
+	return states
+}
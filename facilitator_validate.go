@@ -0,0 +1,130 @@
+package x402pay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// onlineValidationTimeout bounds the online validation of one chain
+// network.
+const onlineValidationTimeout = 15 * time.Second
+
+// decimalsABI is the ABI of the ERC20 decimals() function.
+const decimalsABI = `[{"constant":true,"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"type":"function"}]`
+
+// validate checks the network's configuration without contacting it.
+func (c ChainNetworkConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("chain network without a name")
+	}
+	if c.ID == 0 {
+		return fmt.Errorf("chain network %s: id is required", c.Name)
+	}
+	if err := c.validateRPC(); err != nil {
+		return err
+	}
+	if err := c.validateAssets(); err != nil {
+		return err
+	}
+	if c.Confirmations < 0 {
+		return fmt.Errorf("chain network %s: confirmations must be non-negative", c.Name)
+	}
+	return nil
+}
+
+// validateOnline checks every chain network against its RPC: the chain ID
+// must match, and each token's name(), version() and decimals() must match
+// the configured EIP-712 domain and decimals, where configured.
+func (m *X402FacilitatorApp) validateOnline() error {
+	var errs []error
+	for _, network := range m.ChainNetworks {
+		ctx, cancel := context.WithTimeout(context.Background(), onlineValidationTimeout)
+		errs = append(errs, validateChainNetworkOnline(ctx, m.clients[network.Name], network)...)
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// validateChainNetworkOnline returns everything about network that does
+// not match the chain.
+func validateChainNetworkOnline(ctx context.Context, client *ethclient.Client, network ChainNetworkConfig) []error {
+	var errs []error
+	mismatch := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("chain network %s: "+format, append([]any{network.Name}, args...)...))
+	}
+
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		mismatch("getting chain id: %v", err)
+		return errs
+	}
+	if chainID.Uint64() != network.ID {
+		mismatch("rpc reports chain id %s, configured id is %d", chainID, network.ID)
+	}
+
+	for _, asset := range network.assets() {
+		token := common.HexToAddress(asset.Address)
+		if asset.Name != "" {
+			name, err := utils.FetchTokenNameWithContext(ctx, client, token)
+			switch {
+			case err != nil:
+				mismatch("token %s: %v", asset.Address, err)
+			case name != asset.Name:
+				mismatch("token %s: name() is %q, configured name is %q", asset.Address, name, asset.Name)
+			}
+		}
+		if asset.Version != "" {
+			version, err := utils.FetchTokenVersionWithContext(ctx, client, token)
+			switch {
+			case err != nil:
+				mismatch("token %s: %v", asset.Address, err)
+			case version != asset.Version:
+				mismatch("token %s: version() is %q, configured version is %q", asset.Address, version, asset.Version)
+			}
+		}
+		if asset.Decimals != 0 {
+			results, err := utils.CallTokenContractFunction(ctx, client, decimalsABI, token, "decimals")
+			if err != nil {
+				mismatch("token %s: %v", asset.Address, err)
+				continue
+			}
+			decimals, ok := results[0].(uint8)
+			if !ok {
+				mismatch("token %s: decimals() returned %T", asset.Address, results[0])
+				continue
+			}
+			if int64(decimals) != asset.Decimals {
+				mismatch("token %s: decimals() is %d, configured decimals are %d", asset.Address, decimals, asset.Decimals)
+			}
+		}
+	}
+	return errs
+}
+
+// validatePayTo checks a payment recipient address.
+func validatePayTo(payTo string) error {
+	if !common.IsHexAddress(payTo) {
+		return fmt.Errorf("invalid pay_to address %q", payTo)
+	}
+	if common.HexToAddress(payTo) == (common.Address{}) {
+		return fmt.Errorf("pay_to must not be the zero address")
+	}
+	return nil
+}
+
+// validateAmount checks an amount in the token's smallest unit.
+func validateAmount(amount string) error {
+	value, ok := new(big.Int).SetString(strings.TrimSpace(amount), 10)
+	if !ok || value.Sign() < 0 {
+		return fmt.Errorf("invalid amount %q: expected a non-negative integer in the token's smallest unit", amount)
+	}
+	return nil
+}
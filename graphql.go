@@ -0,0 +1,873 @@
+package x402pay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultGraphQLListArguments are the arguments taken as the number of
+// items a list field returns.
+var defaultGraphQLListArguments = []string{"first", "last", "limit"}
+
+// maxGraphQLFields is the most fields priced for a request, fragments
+// spread, before it is refused as too complex.
+const maxGraphQLFields = 10000
+
+// defaultGraphQLMaxDepth is how deep queries may be nested when no
+// max_depth is configured.
+const defaultGraphQLMaxDepth = 32
+
+// GraphQLPricing prices GraphQL requests by what their operations select:
+// each operation costs its base price plus the price of every field it
+// selects, including through fragments, so that clients pay for what they
+// ask for. Batched requests cost what their operations cost together.
+type GraphQLPricing struct {
+	// Operations maps operation names, or the operation types query,
+	// mutation and subscription, to a base price in the token's smallest
+	// unit. Names take precedence over types.
+	Operations map[string]string `json:"operations,omitempty"`
+
+	// Fields maps field names to their price. A key may be qualified with
+	// the name of the parent field, or with the operation type for root
+	// fields, as in users.posts or mutation.createUser; qualified keys take
+	// precedence.
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// DefaultField is the price of fields not listed. Defaults to 0.
+	// Introspection fields, whose names start with __, are free along with
+	// what is selected on them, unless listed.
+	DefaultField string `json:"default_field,omitempty"`
+
+	// DepthMultiplier multiplies the price of fields by itself for each
+	// level they are nested below the root, so that deep queries cost
+	// more. A decimal such as 1.5. Defaults to 1.
+	DepthMultiplier string `json:"depth_multiplier,omitempty"`
+
+	// ListArguments are the arguments that give the number of items a list
+	// field returns, which multiplies the price of what is selected on
+	// each item. Defaults to first, last and limit.
+	ListArguments []string `json:"list_arguments,omitempty"`
+
+	// MaxDepth refuses queries nested deeper than this, counting fields,
+	// fragments and list or object argument values. Defaults to 32.
+	MaxDepth int `json:"max_depth,omitempty"`
+
+	depthMultiplier *big.Rat
+}
+
+// provision applies defaults and checks the price table.
+func (p *GraphQLPricing) provision() error {
+	for key, price := range p.Operations {
+		if err := validateAmount(price); err != nil {
+			return fmt.Errorf("graphql operation %s: %w", key, err)
+		}
+	}
+	for key, price := range p.Fields {
+		if err := validateAmount(price); err != nil {
+			return fmt.Errorf("graphql field %s: %w", key, err)
+		}
+	}
+	if p.DefaultField == "" {
+		p.DefaultField = "0"
+	}
+	if err := validateAmount(p.DefaultField); err != nil {
+		return fmt.Errorf("graphql default_field: %w", err)
+	}
+	if p.DepthMultiplier == "" {
+		p.DepthMultiplier = "1"
+	}
+	multiplier, ok := new(big.Rat).SetString(p.DepthMultiplier)
+	if !ok || multiplier.Sign() <= 0 {
+		return fmt.Errorf("invalid graphql depth_multiplier %q: expected a positive number", p.DepthMultiplier)
+	}
+	p.depthMultiplier = multiplier
+	if len(p.ListArguments) == 0 {
+		p.ListArguments = defaultGraphQLListArguments
+	}
+	if p.MaxDepth < 0 {
+		return fmt.Errorf("graphql max_depth must not be negative")
+	}
+	if p.MaxDepth == 0 {
+		p.MaxDepth = defaultGraphQLMaxDepth
+	}
+	return nil
+}
+
+// graphQLRequest is a single GraphQL request: a document, the operation
+// in it to run and the variables to run it with.
+type graphQLRequest struct {
+	Query         string                     `json:"query"`
+	OperationName string                     `json:"operationName,omitempty"`
+	Variables     map[string]json.RawMessage `json:"variables,omitempty"`
+}
+
+// readGraphQL returns the GraphQL requests in r, whose body has been read
+// already, reporting whether it is a GraphQL request. Requests may be sent
+// as query parameters, as a JSON body, or as a JSON batch.
+func readGraphQL(r *http.Request, body []byte) ([]graphQLRequest, bool, error) {
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		if query.Get("query") == "" {
+			return nil, false, nil
+		}
+		req := graphQLRequest{Query: query.Get("query"), OperationName: query.Get("operationName")}
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				return nil, false, fmt.Errorf("invalid GraphQL variables: %w", err)
+			}
+		}
+		return []graphQLRequest{req}, true, nil
+	}
+
+	body = bytes.TrimSpace(body)
+	var reqs []graphQLRequest
+	switch {
+	case len(body) > 0 && body[0] == '[':
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			return nil, false, nil
+		}
+	case len(body) > 0 && body[0] == '{':
+		var req graphQLRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, false, nil
+		}
+		reqs = []graphQLRequest{req}
+	}
+	if len(reqs) == 0 {
+		return nil, false, nil
+	}
+	for _, req := range reqs {
+		if req.Query == "" {
+			return nil, false, nil
+		}
+	}
+	return reqs, true, nil
+}
+
+// price returns what the requests cost together, rounded up to the
+// token's smallest unit.
+func (p *GraphQLPricing) price(reqs []graphQLRequest) (*big.Int, error) {
+	total := new(big.Rat)
+	for _, req := range reqs {
+		doc, err := parseGraphQL(req.Query, p.MaxDepth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GraphQL query: %w", err)
+		}
+		op, err := doc.operation(req.OperationName)
+		if err != nil {
+			return nil, err
+		}
+		cost, err := p.operationCost(doc, op, req.Variables)
+		if err != nil {
+			return nil, err
+		}
+		total.Add(total, cost)
+	}
+
+	// Round up
+	amount := new(big.Int).Quo(total.Num(), total.Denom())
+	if new(big.Rat).SetInt(amount).Cmp(total) < 0 {
+		amount.Add(amount, big.NewInt(1))
+	}
+	return amount, nil
+}
+
+// operationCost returns what an operation costs.
+func (p *GraphQLPricing) operationCost(doc *graphQLDocument, op *graphQLOperation, variables map[string]json.RawMessage) (*big.Rat, error) {
+	total := new(big.Rat)
+	if price, ok := p.Operations[op.name]; ok && op.name != "" {
+		total.Add(total, ratAmount(price))
+	} else if price, ok := p.Operations[op.kind]; ok {
+		total.Add(total, ratAmount(price))
+	}
+
+	c := &graphQLCoster{
+		pricing:   p,
+		doc:       doc,
+		variables: variables,
+		total:     total,
+		spreading: make(map[string]bool),
+	}
+	if err := c.selections(op.selections, op.kind, 1, big.NewRat(1, 1)); err != nil {
+		return nil, err
+	}
+	return total, nil
+}
+
+// graphQLCoster adds up what the fields of an operation cost.
+type graphQLCoster struct {
+	pricing   *GraphQLPricing
+	doc       *graphQLDocument
+	variables map[string]json.RawMessage
+	total     *big.Rat
+
+	// spreading are the fragments being spread, against cycles
+	spreading map[string]bool
+	fields    int
+}
+
+// selections adds what a selection set costs, nested depth levels down
+// under parent, with each price weighted by factor: the list sizes and
+// depth multipliers of the fields above it.
+func (c *graphQLCoster) selections(selections []graphQLSelection, parent string, depth int, factor *big.Rat) error {
+	// Fragments spread can nest deeper than the parser saw
+	if depth > c.pricing.MaxDepth && len(selections) > 0 {
+		return fmt.Errorf("GraphQL query is nested deeper than %d levels", c.pricing.MaxDepth)
+	}
+	for _, sel := range selections {
+		switch {
+		case sel.field != nil:
+			if err := c.field(sel.field, parent, depth, factor); err != nil {
+				return err
+			}
+
+		case sel.fragment != "":
+			fragment, ok := c.doc.fragments[sel.fragment]
+			if !ok {
+				return fmt.Errorf("unknown GraphQL fragment %s", sel.fragment)
+			}
+			if c.spreading[sel.fragment] {
+				return fmt.Errorf("GraphQL fragment %s spreads itself", sel.fragment)
+			}
+			c.spreading[sel.fragment] = true
+			err := c.selections(fragment, parent, depth, factor)
+			delete(c.spreading, sel.fragment)
+			if err != nil {
+				return err
+			}
+
+		default:
+			if err := c.selections(sel.inline, parent, depth, factor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// field adds what a field and its selections cost.
+func (c *graphQLCoster) field(field *graphQLField, parent string, depth int, factor *big.Rat) error {
+	c.fields++
+	if c.fields > maxGraphQLFields {
+		return fmt.Errorf("GraphQL query selects more than %d fields", maxGraphQLFields)
+	}
+
+	if c.pricing.introspection(parent, field.name) {
+		return nil
+	}
+
+	c.total.Add(c.total, new(big.Rat).Mul(c.pricing.fieldPrice(parent, field.name), factor))
+
+	// What is selected on a list is selected for each item, and each level
+	// down is weighted by the depth multiplier once more
+	childFactor := new(big.Rat).Mul(factor, c.pricing.depthMultiplier)
+	for _, name := range c.pricing.ListArguments {
+		if value, ok := field.arguments[name]; ok {
+			if n, ok := c.intValue(value); ok && n >= 0 {
+				childFactor.Mul(childFactor, new(big.Rat).SetInt64(n))
+			}
+			break
+		}
+	}
+	return c.selections(field.selections, field.name, depth+1, childFactor)
+}
+
+// intValue returns the integer an argument is given, directly or through
+// a variable.
+func (c *graphQLCoster) intValue(value graphQLValue) (int64, bool) {
+	text := value.literal
+	if value.variable != "" {
+		raw, ok := c.variables[value.variable]
+		if !ok {
+			return 0, false
+		}
+		text = string(raw)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	return n, err == nil
+}
+
+// fieldPrice returns the price of a field selected under parent.
+func (p *GraphQLPricing) fieldPrice(parent, name string) *big.Rat {
+	if price, ok := p.Fields[parent+"."+name]; ok {
+		return ratAmount(price)
+	}
+	if price, ok := p.Fields[name]; ok {
+		return ratAmount(price)
+	}
+	return ratAmount(p.DefaultField)
+}
+
+// introspection reports whether a field is an introspection field that is
+// not priced.
+func (p *GraphQLPricing) introspection(parent, name string) bool {
+	if !strings.HasPrefix(name, "__") {
+		return false
+	}
+	_, qualified := p.Fields[parent+"."+name]
+	_, listed := p.Fields[name]
+	return !qualified && !listed
+}
+
+// ratAmount parses a validated amount.
+func ratAmount(amount string) *big.Rat {
+	value, _ := new(big.Rat).SetString(strings.TrimSpace(amount))
+	if value == nil {
+		return new(big.Rat)
+	}
+	return value
+}
+
+// graphQLDocument is a parsed GraphQL executable document, reduced to what
+// pricing needs.
+type graphQLDocument struct {
+	operations []*graphQLOperation
+	fragments  map[string][]graphQLSelection
+}
+
+// operation returns the operation a request runs.
+func (d *graphQLDocument) operation(name string) (*graphQLOperation, error) {
+	if name == "" {
+		if len(d.operations) != 1 {
+			return nil, fmt.Errorf("GraphQL document has %d operations and no operationName picks one", len(d.operations))
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("GraphQL document has no operation named %s", name)
+}
+
+// graphQLOperation is an operation of a document.
+type graphQLOperation struct {
+	kind       string
+	name       string
+	selections []graphQLSelection
+}
+
+// graphQLSelection is a field, a fragment spread or an inline fragment.
+type graphQLSelection struct {
+	field    *graphQLField
+	fragment string
+	inline   []graphQLSelection
+}
+
+// graphQLField is a selected field.
+type graphQLField struct {
+	name       string
+	arguments  map[string]graphQLValue
+	selections []graphQLSelection
+}
+
+// graphQLValue is an argument value: a variable or the text of a literal.
+type graphQLValue struct {
+	variable string
+	literal  string
+}
+
+// parseGraphQL parses a GraphQL executable document, refusing selection
+// sets and values nested deeper than maxDepth.
+func parseGraphQL(query string, maxDepth int) (*graphQLDocument, error) {
+	p := &graphQLParser{lexer: graphQLLexer{src: query}, maxDepth: maxDepth}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &graphQLDocument{fragments: make(map[string][]graphQLSelection)}
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.tok.is(gqlPunct, "{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &graphQLOperation{kind: "query", selections: selections})
+
+		case p.tok.is(gqlName, "query"), p.tok.is(gqlName, "mutation"), p.tok.is(gqlName, "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+
+		case p.tok.is(gqlName, "fragment"):
+			name, selections, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = selections
+
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("no operation")
+	}
+	return doc, nil
+}
+
+// graphQLParser is a recursive descent parser over the lexer's tokens.
+type graphQLParser struct {
+	lexer    graphQLLexer
+	tok      graphQLToken
+	depth    int
+	maxDepth int
+}
+
+func (p *graphQLParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+// enter descends into a nested selection set or value, which leave must
+// follow.
+func (p *graphQLParser) enter() error {
+	p.depth++
+	if p.depth > p.maxDepth {
+		return fmt.Errorf("GraphQL query is nested deeper than %d levels", p.maxDepth)
+	}
+	return nil
+}
+
+func (p *graphQLParser) leave() {
+	p.depth--
+}
+
+func (p *graphQLParser) unexpected() error {
+	if p.tok.kind == gqlEOF {
+		return fmt.Errorf("unexpected end of query")
+	}
+	return fmt.Errorf("unexpected %q at offset %d", p.tok.text, p.tok.pos)
+}
+
+// expect consumes the given punctuator.
+func (p *graphQLParser) expect(punct string) error {
+	if !p.tok.is(gqlPunct, punct) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+// name consumes a name.
+func (p *graphQLParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.unexpected()
+	}
+	name := p.tok.text
+	return name, p.advance()
+}
+
+func (p *graphQLParser) operation() (*graphQLOperation, error) {
+	op := &graphQLOperation{kind: p.tok.text}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == gqlName {
+		op.name = p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.tok.is(gqlPunct, "(") {
+		if err := p.variableDefinitions(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *graphQLParser) variableDefinitions() error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.tok.is(gqlPunct, ")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if p.tok.is(gqlPunct, "=") {
+			if err := p.advance(); err != nil {
+				return err
+			}
+			if _, err := p.value(); err != nil {
+				return err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return err
+		}
+	}
+	return p.advance()
+}
+
+func (p *graphQLParser) typeRef() error {
+	if p.tok.is(gqlPunct, "[") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.tok.is(gqlPunct, "!") {
+		return p.advance()
+	}
+	return nil
+}
+
+func (p *graphQLParser) fragment() (string, []graphQLSelection, error) {
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if !p.tok.is(gqlName, "on") {
+		return "", nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	if _, err := p.name(); err != nil {
+		return "", nil, err
+	}
+	if err := p.directives(); err != nil {
+		return "", nil, err
+	}
+	selections, err := p.selectionSet()
+	return name, selections, err
+}
+
+func (p *graphQLParser) selectionSet() ([]graphQLSelection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []graphQLSelection
+	for !p.tok.is(gqlPunct, "}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("empty selection set at offset %d", p.tok.pos)
+	}
+	return selections, p.advance()
+}
+
+func (p *graphQLParser) selection() (graphQLSelection, error) {
+	if !p.tok.is(gqlPunct, "...") {
+		field, err := p.field()
+		return graphQLSelection{field: field}, err
+	}
+	if err := p.advance(); err != nil {
+		return graphQLSelection{}, err
+	}
+
+	// A fragment spread
+	if p.tok.kind == gqlName && p.tok.text != "on" {
+		name := p.tok.text
+		if err := p.advance(); err != nil {
+			return graphQLSelection{}, err
+		}
+		return graphQLSelection{fragment: name}, p.directives()
+	}
+
+	// An inline fragment
+	if p.tok.is(gqlName, "on") {
+		if err := p.advance(); err != nil {
+			return graphQLSelection{}, err
+		}
+		if _, err := p.name(); err != nil {
+			return graphQLSelection{}, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return graphQLSelection{}, err
+	}
+	selections, err := p.selectionSet()
+	return graphQLSelection{inline: selections}, err
+}
+
+func (p *graphQLParser) field() (*graphQLField, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	// Aliases do not change what is selected
+	if p.tok.is(gqlPunct, ":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	field := &graphQLField{name: name}
+	if p.tok.is(gqlPunct, "(") {
+		if field.arguments, err = p.arguments(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	if p.tok.is(gqlPunct, "{") {
+		if field.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func (p *graphQLParser) arguments() (map[string]graphQLValue, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arguments := make(map[string]graphQLValue)
+	for !p.tok.is(gqlPunct, ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		arguments[name] = value
+	}
+	return arguments, p.advance()
+}
+
+func (p *graphQLParser) directives() error {
+	for p.tok.is(gqlPunct, "@") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if p.tok.is(gqlPunct, "(") {
+			if _, err := p.arguments(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value consumes a value. Only variables and scalar literals are kept;
+// lists and objects are skipped.
+func (p *graphQLParser) value() (graphQLValue, error) {
+	switch {
+	case p.tok.is(gqlPunct, "$"):
+		if err := p.advance(); err != nil {
+			return graphQLValue{}, err
+		}
+		name, err := p.name()
+		return graphQLValue{variable: name}, err
+
+	case p.tok.is(gqlPunct, "["):
+		if err := p.enter(); err != nil {
+			return graphQLValue{}, err
+		}
+		defer p.leave()
+		if err := p.advance(); err != nil {
+			return graphQLValue{}, err
+		}
+		for !p.tok.is(gqlPunct, "]") {
+			if _, err := p.value(); err != nil {
+				return graphQLValue{}, err
+			}
+		}
+		return graphQLValue{}, p.advance()
+
+	case p.tok.is(gqlPunct, "{"):
+		if err := p.enter(); err != nil {
+			return graphQLValue{}, err
+		}
+		defer p.leave()
+		if err := p.advance(); err != nil {
+			return graphQLValue{}, err
+		}
+		for !p.tok.is(gqlPunct, "}") {
+			if _, err := p.name(); err != nil {
+				return graphQLValue{}, err
+			}
+			if err := p.expect(":"); err != nil {
+				return graphQLValue{}, err
+			}
+			if _, err := p.value(); err != nil {
+				return graphQLValue{}, err
+			}
+		}
+		return graphQLValue{}, p.advance()
+
+	case p.tok.kind == gqlName, p.tok.kind == gqlNumber, p.tok.kind == gqlString:
+		value := graphQLValue{literal: p.tok.text}
+		return value, p.advance()
+
+	default:
+		return graphQLValue{}, p.unexpected()
+	}
+}
+
+// GraphQL token kinds.
+const (
+	gqlEOF = iota
+	gqlPunct
+	gqlName
+	gqlNumber
+	gqlString
+)
+
+// graphQLToken is a lexical token of a GraphQL document.
+type graphQLToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t graphQLToken) is(kind int, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+// graphQLLexer splits a GraphQL document into tokens.
+type graphQLLexer struct {
+	src string
+	pos int
+}
+
+func (l *graphQLLexer) next() (graphQLToken, error) {
+	// Skip whitespace, commas, comments and the byte order mark
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.pos++
+			continue
+		}
+		if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if strings.HasPrefix(l.src[l.pos:], "\uFEFF") {
+			l.pos += len("\uFEFF")
+			continue
+		}
+		break
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return graphQLToken{kind: gqlEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return graphQLToken{kind: gqlPunct, text: "...", pos: start}, nil
+
+	case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+		l.pos++
+		return graphQLToken{kind: gqlPunct, text: string(c), pos: start}, nil
+
+	case c == '_' || isASCIILetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isASCIILetter(l.src[l.pos]) || isASCIIDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return graphQLToken{kind: gqlName, text: l.src[start:l.pos], pos: start}, nil
+
+	case c == '-' || isASCIIDigit(c):
+		l.pos++
+		for l.pos < len(l.src) && (isASCIIDigit(l.src[l.pos]) || strings.IndexByte(".eE+-", l.src[l.pos]) >= 0) {
+			l.pos++
+		}
+		return graphQLToken{kind: gqlNumber, text: l.src[start:l.pos], pos: start}, nil
+
+	case strings.HasPrefix(l.src[l.pos:], `"""`):
+		l.pos += 3
+		for !strings.HasPrefix(l.src[l.pos:], `"""`) {
+			if l.pos >= len(l.src) {
+				return graphQLToken{}, fmt.Errorf("unterminated block string at offset %d", start)
+			}
+			if strings.HasPrefix(l.src[l.pos:], `\"""`) {
+				l.pos += 3
+			}
+			l.pos++
+		}
+		l.pos += 3
+		return graphQLToken{kind: gqlString, text: l.src[start:l.pos], pos: start}, nil
+
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			if l.pos < len(l.src) && (l.src[l.pos] == '\n' || l.src[l.pos] == '\r') {
+				return graphQLToken{}, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return graphQLToken{}, fmt.Errorf("unterminated string at offset %d", start)
+		}
+		l.pos++
+		return graphQLToken{kind: gqlString, text: l.src[start:l.pos], pos: start}, nil
+
+	default:
+		return graphQLToken{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+	}
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isASCIIDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
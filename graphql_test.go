@@ -0,0 +1,163 @@
+package x402pay
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLLexer(t *testing.T) {
+	l := graphQLLexer{src: "\uFEFFquery Q($n: Int = -1.5e3) { a(s: \"x\\\"y\", b: \"\"\"block \\\"\"\" quote\"\"\") ...F } # comment"}
+	var got []string
+	for {
+		tok, err := l.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.kind == gqlEOF {
+			break
+		}
+		got = append(got, tok.text)
+	}
+	want := []string{"query", "Q", "(", "$", "n", ":", "Int", "=", "-1.5e3", ")", "{",
+		"a", "(", "s", ":", `"x\"y"`, "b", ":", `"""block \""" quote"""`, ")", "...", "F", "}"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("tokens = %q\nwant %q", got, want)
+	}
+
+	for _, src := range []string{`"open`, "\"line\nbreak\"", `"""open`, "%"} {
+		l := graphQLLexer{src: src}
+		if _, err := l.next(); err == nil {
+			t.Errorf("lexing %q: expected an error", src)
+		}
+	}
+}
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		query Users($n: Int!) @cached {
+			list: users(first: $n, filter: {tags: ["a", "b"]}) {
+				name
+				...Posts
+				... on Admin { role }
+			}
+		}
+		fragment Posts on User { posts { title } }
+		mutation { ping }
+	`, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 2 {
+		t.Fatalf("got %d operations, want 2", len(doc.operations))
+	}
+	if _, err := doc.operation(""); err == nil {
+		t.Error("expected an error picking among operations without a name")
+	}
+	op, err := doc.operation("Users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.kind != "query" || len(op.selections) != 1 {
+		t.Fatalf("unexpected operation %+v", op)
+	}
+	users := op.selections[0].field
+	if users.name != "users" || users.arguments["first"].variable != "n" {
+		t.Errorf("unexpected field %+v", users)
+	}
+	if len(users.selections) != 3 || users.selections[1].fragment != "Posts" || users.selections[2].inline == nil {
+		t.Errorf("unexpected selections %+v", users.selections)
+	}
+	if _, ok := doc.fragments["Posts"]; !ok {
+		t.Error("fragment Posts not parsed")
+	}
+
+	for _, query := range []string{
+		"",
+		"{ }",
+		"{ a",
+		"query { a(x: ) }",
+		"fragment F { a }",
+		"subscription",
+	} {
+		if _, err := parseGraphQL(query, 32); err == nil {
+			t.Errorf("parsing %q: expected an error", query)
+		}
+	}
+}
+
+func TestParseGraphQLDepth(t *testing.T) {
+	nested := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + strings.Repeat(close, n)
+	}
+	if _, err := parseGraphQL("{ a { b { c { d { e } } } } }", 4); err == nil {
+		t.Error("expected selections nested too deep to be refused")
+	}
+	if _, err := parseGraphQL("{ a { b { c { d } } } }", 4); err != nil {
+		t.Errorf("selections within max depth refused: %v", err)
+	}
+
+	// Values must not recurse without bound either
+	deep := "{ a(x: " + nested("[", "]", 100000) + ") }"
+	if _, err := parseGraphQL(deep, 32); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Errorf("deeply nested list value: got %v", err)
+	}
+	deep = "{ a(x: " + nested("{y: ", "}", 100000) + ") }"
+	if _, err := parseGraphQL(deep, 32); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Errorf("deeply nested object value: got %v", err)
+	}
+}
+
+func TestGraphQLPrice(t *testing.T) {
+	pricing := &GraphQLPricing{
+		Operations:      map[string]string{"query": "10", "Expensive": "100"},
+		Fields:          map[string]string{"users": "1", "posts": "2", "users.name": "0"},
+		DefaultField:    "1",
+		DepthMultiplier: "2",
+	}
+	if err := pricing.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if pricing.MaxDepth != defaultGraphQLMaxDepth {
+		t.Errorf("max depth defaulted to %d", pricing.MaxDepth)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		query     string
+		variables string
+		want      string
+	}{
+		// 10 + users 1 + name 0 + posts 2*2 + title 1*4
+		{"nested", "{ users { name posts { title } } }", "", "19"},
+		// 10 + users 1 + each of 5 items: posts 2*2, title 1*4
+		{"list", "{ users(first: 5) { posts { title } } }", "", "51"},
+		{"list variable", "query($n: Int) { users(first: $n) { posts { title } } }", `{"n": 5}`, "51"},
+		{"named operation", "query Expensive { users }", "", "101"},
+		{"fragment", "{ users { ...P } } fragment P on User { posts }", "", "15"},
+		{"introspection", "{ __schema { types { name } } }", "", "10"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := graphQLRequest{Query: tc.query}
+			if tc.variables != "" {
+				if err := json.Unmarshal([]byte(tc.variables), &req.Variables); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := pricing.price([]graphQLRequest{req})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("price = %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	// Fragments spread into each other can nest deeper than the parser saw
+	pricing.MaxDepth = 3
+	query := "{ a { ...F } } fragment F on A { b { ...G } } fragment G on B { c { d } }"
+	if _, err := pricing.price([]graphQLRequest{{Query: query}}); err == nil {
+		t.Error("expected fragments nested too deep to be refused")
+	}
+}
@@ -0,0 +1,108 @@
+package x402pay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(&X402HealthHandler{})
+}
+
+// X402HealthHandler responds with the facilitator's health, for use as a
+// load balancer health check. In readiness mode, the default, it responds
+// 200 when every checked chain network passed its latest RPC probes and the
+// facilitator can afford gas on it, and 503 otherwise. In liveness mode it
+// responds 200 as long as the facilitator is running.
+type X402HealthHandler struct {
+	// Mode is "ready" (default) or "live".
+	Mode string `json:"mode,omitempty"`
+
+	// Networks limits the readiness check to these chain networks.
+	// Defaults to all of them.
+	Networks []string `json:"networks,omitempty"`
+
+	// Facilitator app reference
+	facilitatorApp *X402FacilitatorApp
+}
+
+// CaddyModule returns the Caddy module information.
+func (X402HealthHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.x402health",
+		New: func() caddy.Module { return new(X402HealthHandler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *X402HealthHandler) Provision(ctx caddy.Context) error {
+	if h.Mode == "" {
+		h.Mode = "ready"
+	}
+
+	appVal, err := ctx.App("x402.facilitator")
+	if err != nil {
+		return fmt.Errorf("failed to get x402.facilitator app: %w", err)
+	}
+	h.facilitatorApp = appVal.(*X402FacilitatorApp)
+	return nil
+}
+
+// Validate validates the handler configuration.
+func (h *X402HealthHandler) Validate() error {
+	if h.Mode != "ready" && h.Mode != "live" {
+		return fmt.Errorf("unknown mode %q: expected ready or live", h.Mode)
+	}
+	for _, name := range h.Networks {
+		found := false
+		for _, network := range h.facilitatorApp.ChainNetworks {
+			if network.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown chain network: %s", name)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements the caddyhttp.MiddlewareHandler interface. The
+// request is always answered here and never passed on.
+func (h *X402HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	health := h.facilitatorApp.health(h.Networks...)
+
+	status := http.StatusOK
+	switch h.Mode {
+	case "live":
+		if h.facilitatorApp.GetFacilitator() == nil {
+			status = http.StatusServiceUnavailable
+		}
+	default:
+		if !health.Ready {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	return json.NewEncoder(w).Encode(health)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*X402HealthHandler)(nil)
+	_ caddy.Validator             = (*X402HealthHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*X402HealthHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*X402HealthHandler)(nil)
+)
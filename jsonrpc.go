@@ -0,0 +1,212 @@
+package x402pay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+)
+
+const (
+	// mcpToolsCall is the MCP method that calls a tool, priced by tool name.
+	mcpToolsCall = "tools/call"
+
+	// jsonRPCPaymentRequired is the JSON-RPC error code of a payment
+	// required error.
+	jsonRPCPaymentRequired = 402
+)
+
+// JSONRPCPricing prices JSON-RPC requests, including MCP tool calls, by
+// method. A batch costs what its calls cost together, and requests that
+// cost nothing are served without payment.
+type JSONRPCPricing struct {
+	// Methods maps methods to their price in the token's smallest unit. A
+	// price of 0 makes a method free.
+	Methods map[string]string `json:"methods,omitempty"`
+
+	// Tools maps MCP tool names to the price of calling them with
+	// tools/call. Tools not listed cost what tools/call does.
+	Tools map[string]string `json:"tools,omitempty"`
+
+	// Default is the price of methods not listed. Defaults to
+	// max_amount_required.
+	Default string `json:"default,omitempty"`
+}
+
+// validate checks the rate table.
+func (p *JSONRPCPricing) validate() error {
+	for method, price := range p.Methods {
+		if err := validateAmount(price); err != nil {
+			return fmt.Errorf("jsonrpc method %s: %w", method, err)
+		}
+	}
+	for tool, price := range p.Tools {
+		if err := validateAmount(price); err != nil {
+			return fmt.Errorf("jsonrpc tool %s: %w", tool, err)
+		}
+	}
+	if p.Default != "" {
+		if err := validateAmount(p.Default); err != nil {
+			return fmt.Errorf("jsonrpc default: %w", err)
+		}
+	}
+	return nil
+}
+
+// price returns what a call costs, falling back to fallback for methods
+// not listed.
+func (p *JSONRPCPricing) price(call jsonRPCCall, fallback string) *big.Int {
+	amount, ok := "", false
+	if call.Method == mcpToolsCall {
+		amount, ok = p.Tools[call.tool()]
+	}
+	if !ok {
+		amount, ok = p.Methods[call.Method]
+	}
+	if !ok {
+		amount = p.Default
+	}
+	if amount == "" {
+		amount = fallback
+	}
+	value, _ := new(big.Int).SetString(strings.TrimSpace(amount), 10)
+	return value
+}
+
+// jsonRPCRequest is a JSON-RPC request body: a single call or a batch.
+type jsonRPCRequest struct {
+	calls []jsonRPCCall
+	batch bool
+}
+
+// jsonRPCCall is a single call of a JSON-RPC request.
+type jsonRPCCall struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// tool returns the name of the tool an MCP tools/call call calls.
+func (c jsonRPCCall) tool() string {
+	var params struct {
+		Name string `json:"name"`
+	}
+	_ = json.Unmarshal(c.Params, &params)
+	return params.Name
+}
+
+// name identifies what a call does, for telling apart quotes for the
+// same URL.
+func (c jsonRPCCall) name() string {
+	if c.Method == mcpToolsCall {
+		return c.Method + ":" + c.tool()
+	}
+	return c.Method
+}
+
+// parseJSONRPC parses body as a JSON-RPC request, reporting whether it is
+// one.
+func parseJSONRPC(body []byte) (*jsonRPCRequest, bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, false
+	}
+
+	req := &jsonRPCRequest{}
+	switch body[0] {
+	case '[':
+		req.batch = true
+		if err := json.Unmarshal(body, &req.calls); err != nil {
+			return nil, false
+		}
+	case '{':
+		var call jsonRPCCall
+		if err := json.Unmarshal(body, &call); err != nil {
+			return nil, false
+		}
+		req.calls = []jsonRPCCall{call}
+	default:
+		return nil, false
+	}
+	if len(req.calls) == 0 {
+		return nil, false
+	}
+	for _, call := range req.calls {
+		if call.Method == "" {
+			return nil, false
+		}
+	}
+	return req, true
+}
+
+// returnJSONRPCPaymentRequired returns a 402 Payment Required response
+// shaped as a JSON-RPC error for each call of req that expects a
+// response, carrying the payment requirements for the whole request.
+func (m *X402SellerMiddleware) returnJSONRPCPaymentRequired(w http.ResponseWriter, req *jsonRPCRequest, requirements *types.PaymentRequirements) error {
+	rpcError := map[string]any{
+		"code":    jsonRPCPaymentRequired,
+		"message": "Payment is required to access this resource",
+		"data": map[string]any{
+			"error":               "payment_required",
+			"message":             "Payment is required to access this resource",
+			"code":                http.StatusPaymentRequired,
+			"paymentRequirements": *requirements,
+		},
+	}
+	response := func(id json.RawMessage) map[string]any {
+		if len(id) == 0 {
+			id = json.RawMessage("null")
+		}
+		return map[string]any{"jsonrpc": "2.0", "id": id, "error": rpcError}
+	}
+
+	var body any = response(req.calls[0].ID)
+	if req.batch {
+		var responses []map[string]any
+		for _, call := range req.calls {
+			// Notifications get no response
+			if len(call.ID) > 0 {
+				responses = append(responses, response(call.ID))
+			}
+		}
+		if len(responses) > 0 {
+			body = responses
+		} else {
+			body = response(nil)
+		}
+	}
+
+	w.Header().Set("X-Payment-Required", "true")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPaymentRequired)
+	return json.NewEncoder(w).Encode(body)
+}
+
+// jsonRPCPaymentRequiredData returns the x402 payment required response
+// carried in a JSON-RPC payment required error, if body is one.
+func jsonRPCPaymentRequiredData(body []byte) (json.RawMessage, bool) {
+	body = bytes.TrimSpace(body)
+	var responses []struct {
+		JSONRPC string `json:"jsonrpc"`
+		Error   *struct {
+			Code int             `json:"code"`
+			Data json.RawMessage `json:"data"`
+		} `json:"error"`
+	}
+	if len(body) > 0 && body[0] == '{' {
+		body = append(append([]byte{'['}, body...), ']')
+	}
+	if err := json.Unmarshal(body, &responses); err != nil {
+		return nil, false
+	}
+	for _, response := range responses {
+		if response.JSONRPC != "" && response.Error != nil && response.Error.Code == jsonRPCPaymentRequired && len(response.Error.Data) > 0 {
+			return response.Error.Data, true
+		}
+	}
+	return nil, false
+}
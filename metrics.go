@@ -0,0 +1,66 @@
+package x402pay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// x402Metrics holds the collectors shared by all x402 modules.
+var x402Metrics = struct {
+	once              sync.Once
+	buyerTokenBalance *prometheus.GaugeVec
+	buyerLowBalance   *prometheus.GaugeVec
+	buyerInsufficient *prometheus.CounterVec
+	buyerAllowance    *prometheus.GaugeVec
+}{}
+
+// initX402Metrics creates the collectors once and registers them with
+// registry. Registering the same collectors again, as happens when several
+// handlers share a config, is not an error.
+func initX402Metrics(registry *prometheus.Registry) error {
+	const ns = "caddy"
+
+	x402Metrics.once.Do(func() {
+		walletLabels := []string{"network", "address"}
+		x402Metrics.buyerTokenBalance = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: "x402_buyer",
+			Name:      "token_balance",
+			Help:      "Last observed token balance of a buyer wallet, in base units.",
+		}, walletLabels)
+		x402Metrics.buyerLowBalance = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: "x402_buyer",
+			Name:      "low_balance",
+			Help:      "Whether a buyer wallet's token balance is below its low-water mark (1) or not (0).",
+		}, walletLabels)
+		x402Metrics.buyerInsufficient = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: "x402_buyer",
+			Name:      "insufficient_funds_total",
+			Help:      "Payments refused by the buyer because the wallet could not cover them.",
+		}, walletLabels)
+		x402Metrics.buyerAllowance = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: "x402_buyer",
+			Name:      "token_allowance",
+			Help:      "Last observed token allowance of a buyer wallet to a spender, in base units.",
+		}, append(walletLabels, "spender"))
+	})
+
+	for _, c := range []prometheus.Collector{
+		x402Metrics.buyerTokenBalance,
+		x402Metrics.buyerLowBalance,
+		x402Metrics.buyerInsufficient,
+		x402Metrics.buyerAllowance,
+	} {
+		if err := registry.Register(c); err != nil &&
+			!errors.As(err, new(prometheus.AlreadyRegisteredError)) {
+			return fmt.Errorf("registering x402 metrics: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+package x402pay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultRPCTimeout bounds a single request to one endpoint when no
+	// timeout is configured.
+	defaultRPCTimeout = 10 * time.Second
+
+	// defaultRPCRetries is how many other endpoints an idempotent read is
+	// retried on after the first one fails.
+	defaultRPCRetries = 2
+
+	// rpcRetryBackoff is the delay before the first retry; it doubles with
+	// every further retry.
+	rpcRetryBackoff = 100 * time.Millisecond
+
+	// rpcMaxCooldown caps how long a failing endpoint is skipped.
+	rpcMaxCooldown = time.Minute
+
+	// rpcMaxResponseSize bounds a JSON-RPC response read through the pool.
+	rpcMaxResponseSize = 64 << 20
+)
+
+// RPC endpoint selection policies.
+const (
+	rpcPolicyFirstHealthy  = "first_healthy"
+	rpcPolicyRoundRobin    = "round_robin"
+	rpcPolicyLowestLatency = "lowest_latency"
+)
+
+// RPCEndpoint is one of several RPC endpoints of a chain network.
+type RPCEndpoint struct {
+	URL string `json:"url,omitempty"`
+
+	// Timeout overrides the network's rpc_timeout for this endpoint.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// idempotentRPCMethods are the JSON-RPC methods that only read chain state
+// and may safely be sent to another endpoint when one fails.
+var idempotentRPCMethods = map[string]bool{
+	"eth_blockNumber":           true,
+	"eth_call":                  true,
+	"eth_chainId":               true,
+	"eth_estimateGas":           true,
+	"eth_feeHistory":            true,
+	"eth_gasPrice":              true,
+	"eth_getBalance":            true,
+	"eth_getBlockByHash":        true,
+	"eth_getBlockByNumber":      true,
+	"eth_getCode":               true,
+	"eth_getLogs":               true,
+	"eth_getStorageAt":          true,
+	"eth_getTransactionByHash":  true,
+	"eth_getTransactionCount":   true,
+	"eth_getTransactionReceipt": true,
+	"eth_maxPriorityFeePerGas":  true,
+	"eth_syncing":               true,
+	"net_version":               true,
+	"web3_clientVersion":        true,
+}
+
+// rpcPool spreads a chain network's JSON-RPC traffic over its endpoints. An
+// endpoint that fails at the transport level, times out or answers with a
+// 5xx or 429 status is skipped for a cooldown that grows with consecutive
+// failures. Reads are retried on the next endpoint with backoff; anything
+// else, such as eth_sendRawTransaction, is sent to one endpoint only.
+type rpcPool struct {
+	network   string
+	policy    string
+	retries   int
+	endpoints []*rpcEndpoint
+	transport http.RoundTripper
+	logger    *zap.Logger
+	next      atomic.Uint64
+}
+
+// rpcEndpoint is the runtime state of an RPCEndpoint.
+type rpcEndpoint struct {
+	url     *url.URL
+	timeout time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+	latency   time.Duration
+	lastError string
+}
+
+// rpcEndpointState is the observable state of an endpoint.
+type rpcEndpointState struct {
+	URL       string     `json:"url"`
+	Healthy   bool       `json:"healthy"`
+	Failures  int        `json:"failures,omitempty"`
+	DownUntil *time.Time `json:"down_until,omitempty"`
+	LatencyMS float64    `json:"latency_ms,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// rpcEndpoints returns every configured endpoint of the network, starting
+// with RPC.
+func (c ChainNetworkConfig) rpcEndpoints() []RPCEndpoint {
+	var endpoints []RPCEndpoint
+	if c.RPC != "" {
+		endpoints = append(endpoints, RPCEndpoint{URL: c.RPC})
+	}
+	return append(endpoints, c.RPCEndpoints...)
+}
+
+// validateRPC checks the network's RPC settings.
+func (c ChainNetworkConfig) validateRPC() error {
+	endpoints := c.rpcEndpoints()
+	if len(endpoints) == 0 {
+		return fmt.Errorf("chain network %s: no rpc configured", c.Name)
+	}
+	switch c.RPCPolicy {
+	case "", rpcPolicyFirstHealthy, rpcPolicyRoundRobin, rpcPolicyLowestLatency:
+	default:
+		return fmt.Errorf("chain network %s: unknown rpc_policy %q", c.Name, c.RPCPolicy)
+	}
+	if c.RPCRetries < 0 {
+		return fmt.Errorf("chain network %s: rpc_retries must be non-negative", c.Name)
+	}
+	if len(endpoints) == 1 {
+		return nil
+	}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil {
+			return fmt.Errorf("chain network %s: invalid rpc %s: %v", c.Name, endpoint.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("chain network %s: rpc %s: only http and https endpoints can be pooled", c.Name, endpoint.URL)
+		}
+	}
+	return nil
+}
+
+// newRPCPool creates a pool over the network's endpoints.
+func newRPCPool(network ChainNetworkConfig, logger *zap.Logger) (*rpcPool, error) {
+	if err := network.validateRPC(); err != nil {
+		return nil, err
+	}
+
+	pool := &rpcPool{
+		network: network.Name,
+		policy:  network.RPCPolicy,
+		retries: defaultRPCRetries,
+		transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		logger: logger,
+	}
+	if pool.policy == "" {
+		pool.policy = rpcPolicyFirstHealthy
+	}
+	if network.RPCRetries > 0 {
+		pool.retries = network.RPCRetries
+	}
+
+	timeout := time.Duration(network.RPCTimeout)
+	if timeout <= 0 {
+		timeout = defaultRPCTimeout
+	}
+	for _, endpoint := range network.rpcEndpoints() {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil {
+			return nil, fmt.Errorf("chain network %s: invalid rpc %s: %v", network.Name, endpoint.URL, err)
+		}
+		e := &rpcEndpoint{url: u, timeout: timeout}
+		if endpoint.Timeout > 0 {
+			e.timeout = time.Duration(endpoint.Timeout)
+		}
+		pool.endpoints = append(pool.endpoints, e)
+	}
+	return pool, nil
+}
+
+// dialChainNetwork returns an RPC client for network. Networks with a single
+// endpoint are dialed directly; otherwise the client goes through a pool.
+func dialChainNetwork(ctx context.Context, network ChainNetworkConfig, logger *zap.Logger) (*ethclient.Client, *rpcPool, error) {
+	endpoints := network.rpcEndpoints()
+	if len(endpoints) == 1 {
+		if err := network.validateRPC(); err != nil {
+			return nil, nil, err
+		}
+		client, err := ethclient.DialContext(ctx, endpoints[0].URL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("connecting to %s rpc: %w", network.Name, err)
+		}
+		return client, nil, nil
+	}
+
+	pool, err := newRPCPool(network, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := pool.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, pool, nil
+}
+
+// dial returns an RPC client whose requests go through the pool.
+func (p *rpcPool) dial(ctx context.Context) (*ethclient.Client, error) {
+	// The URL only has to be well-formed; RoundTrip picks the real endpoint
+	rpcClient, err := rpc.DialOptions(ctx, "http://x402-rpc-pool/"+p.network,
+		rpc.WithHTTPClient(&http.Client{Transport: p}))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s rpc pool: %w", p.network, err)
+	}
+	return ethclient.NewClient(rpcClient), nil
+}
+
+// RoundTrip sends a JSON-RPC request to the pool's endpoints.
+func (p *rpcPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	attempts := 1
+	if isIdempotentRPC(body) {
+		attempts += p.retries
+	}
+	candidates := p.candidates()
+	if attempts > len(candidates) {
+		attempts = len(candidates)
+	}
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(rpcRetryBackoff << (i - 1)):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+
+		endpoint := candidates[i]
+		resp, err := p.send(req, endpoint, body)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if req.Context().Err() != nil {
+			break
+		}
+		p.logger.Warn("rpc endpoint failed",
+			zap.String("network", p.network),
+			zap.String("endpoint", endpoint.url.Redacted()),
+			zap.Int("attempt", i+1),
+			zap.Error(err),
+		)
+	}
+	return nil, lastErr
+}
+
+// send sends body to a single endpoint and reads the whole response, so
+// that the per-endpoint timeout covers it.
+func (p *rpcPool) send(req *http.Request, endpoint *rpcEndpoint, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), endpoint.timeout)
+	defer cancel()
+
+	outReq := req.Clone(ctx)
+	outReq.URL = endpoint.url
+	outReq.Host = ""
+	outReq.Body = io.NopCloser(bytes.NewReader(body))
+	outReq.ContentLength = int64(len(body))
+	outReq.GetBody = nil
+
+	start := time.Now()
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		endpoint.failed(err)
+		return nil, err
+	}
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, rpcMaxResponseSize))
+	resp.Body.Close()
+	if err != nil {
+		endpoint.failed(err)
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		err := fmt.Errorf("%s responded with status %d", endpoint.url.Redacted(), resp.StatusCode)
+		endpoint.failed(err)
+		return nil, err
+	}
+	endpoint.succeeded(time.Since(start))
+
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	resp.ContentLength = int64(len(respBody))
+	resp.Request = req
+	return resp, nil
+}
+
+// candidates returns the endpoints in the order they should be tried:
+// healthy ones first, ordered by the policy, then those cooling down,
+// soonest available first.
+func (p *rpcPool) candidates() []*rpcEndpoint {
+	now := time.Now()
+	var healthy, down []*rpcEndpoint
+	for _, endpoint := range p.endpoints {
+		if endpoint.available(now) {
+			healthy = append(healthy, endpoint)
+		} else {
+			down = append(down, endpoint)
+		}
+	}
+
+	switch p.policy {
+	case rpcPolicyRoundRobin:
+		if n := len(healthy); n > 1 {
+			start := int(p.next.Add(1)-1) % n
+			healthy = append(healthy[start:], healthy[:start]...)
+		}
+	case rpcPolicyLowestLatency:
+		// Endpoints without a measurement yet sort first so they get one
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].averageLatency() < healthy[j].averageLatency()
+		})
+	}
+	sort.SliceStable(down, func(i, j int) bool {
+		return down[i].until().Before(down[j].until())
+	})
+	return append(healthy, down...)
+}
+
+// snapshot returns the state of every endpoint.
+func (p *rpcPool) snapshot() []rpcEndpointState {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	states := make([]rpcEndpointState, 0, len(p.endpoints))
+	for _, endpoint := range p.endpoints {
+		endpoint.mu.Lock()
+		state := rpcEndpointState{
+			URL:       endpoint.url.Redacted(),
+			Healthy:   !now.Before(endpoint.downUntil),
+			Failures:  endpoint.failures,
+			LatencyMS: float64(endpoint.latency) / float64(time.Millisecond),
+			LastError: endpoint.lastError,
+		}
+		if !state.Healthy {
+			downUntil := endpoint.downUntil
+			state.DownUntil = &downUntil
+		}
+		endpoint.mu.Unlock()
+		states = append(states, state)
+	}
+	return states
+}
+
+// close closes the pool's idle connections to its endpoints.
+func (p *rpcPool) close() {
+	if t, ok := p.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// ServeHTTP exposes the pool as a plain JSON-RPC endpoint, for libraries
+// that can only be given an RPC URL.
+func (p *rpcPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	outReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "http://x402-rpc-pool/"+p.network, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.RoundTrip(outReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (e *rpcEndpoint) available(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.downUntil)
+}
+
+func (e *rpcEndpoint) until() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.downUntil
+}
+
+func (e *rpcEndpoint) averageLatency() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.latency
+}
+
+// failed puts the endpoint on a cooldown that doubles with every
+// consecutive failure.
+func (e *rpcEndpoint) failed(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures++
+	cooldown := time.Second << min(e.failures-1, 6)
+	if cooldown > rpcMaxCooldown {
+		cooldown = rpcMaxCooldown
+	}
+	e.downUntil = time.Now().Add(cooldown)
+	e.lastError = err.Error()
+}
+
+// succeeded marks the endpoint healthy and updates its moving average
+// latency.
+func (e *rpcEndpoint) succeeded(latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = 0
+	e.downUntil = time.Time{}
+	e.lastError = ""
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = (e.latency*4 + latency) / 5
+	}
+}
+
+// isIdempotentRPC reports whether a JSON-RPC request or batch consists of
+// reads only.
+func isIdempotentRPC(body []byte) bool {
+	type call struct {
+		Method string `json:"method"`
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	var calls []call
+	if strings.HasPrefix(string(trimmed), "[") {
+		if err := json.Unmarshal(trimmed, &calls); err != nil {
+			return false
+		}
+	} else {
+		var c call
+		if err := json.Unmarshal(trimmed, &c); err != nil {
+			return false
+		}
+		calls = append(calls, c)
+	}
+	if len(calls) == 0 {
+		return false
+	}
+	for _, c := range calls {
+		if !idempotentRPCMethods[c.Method] {
+			return false
+		}
+	}
+	return true
+}
+
+// Interface guards
+var (
+	_ http.RoundTripper = (*rpcPool)(nil)
+	_ http.Handler      = (*rpcPool)(nil)
+)
@@ -0,0 +1,441 @@
+package x402pay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.uber.org/zap"
+)
+
+const (
+	// headerPaymentIdentity carries a buyer's signed wallet identity, as
+	// <address>:<unix time>:<signature> of identityMessage for the host
+	// requested.
+	headerPaymentIdentity = "X-Payment-Identity"
+
+	// headerFreeTierRemaining tells clients how many free requests they
+	// have left in the current window.
+	headerFreeTierRemaining = "X-Free-Tier-Remaining"
+
+	// identityMaxSkew is how far the time of a signed identity may be from
+	// ours.
+	identityMaxSkew = 5 * time.Minute
+
+	defaultFreeTierWindow     = 24 * time.Hour
+	defaultFreeTierMaxClients = 100000
+	freeTierPrefix            = "x402_free_tier/"
+)
+
+// FreeTier lets each client make a number of requests per window without
+// paying before it is asked for payment. Clients are told apart by IP
+// address, by an API key header, or by a wallet address proven with a
+// signed identity header. A wallet identity only proves that the client
+// holds the wallet's key: new keys cost nothing to make, so it tells
+// well-behaved clients apart but does not stop a client from claiming a
+// new free tier with every key it makes.
+//
+// Counts are kept in memory unless Store is "storage", in which case they
+// are kept in storage, and shared by all instances using the same storage.
+type FreeTier struct {
+	// Requests is how many free requests a client may make per window.
+	Requests int `json:"requests,omitempty"`
+
+	// Window is how long a client's count lasts from its first free
+	// request. Defaults to 24h.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// Identity is ip (default), header or wallet.
+	Identity string `json:"identity,omitempty"`
+
+	// Header names the request header identifying clients under the header
+	// identity.
+	Header string `json:"header,omitempty"`
+
+	// MaxClients is the most clients counted at once. While that many are
+	// counted, new clients pay until counts expire. Defaults to 100000.
+	MaxClients int `json:"max_clients,omitempty"`
+
+	// Store is memory (default) or storage.
+	Store string `json:"store,omitempty"`
+
+	// Directory keeps counts in a local directory. If neither it nor
+	// Storage is set, Caddy's configured storage is used.
+	Directory string `json:"directory,omitempty"`
+
+	// StorageRaw is a storage module to keep counts in.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// Runtime fields
+	scope   string
+	storage certmagic.Storage
+	logger  *zap.Logger
+	mu      sync.Mutex
+	counts  map[string]*freeTierCount
+	stored  int
+}
+
+// freeTierCount is how many free requests a client made in its window.
+type freeTierCount struct {
+	Count int       `json:"count"`
+	Reset time.Time `json:"reset"`
+}
+
+// provision sets up where counts are kept and prunes expired ones until
+// ctx is done.
+func (f *FreeTier) provision(ctx caddy.Context, m *X402SellerMiddleware) error {
+	if f.Requests <= 0 {
+		return fmt.Errorf("free_tier requests must be positive")
+	}
+	if f.Window <= 0 {
+		f.Window = caddy.Duration(defaultFreeTierWindow)
+	}
+	if f.Identity == "" {
+		f.Identity = "ip"
+	}
+	if f.MaxClients < 0 {
+		return fmt.Errorf("free_tier max_clients must not be negative")
+	}
+	if f.MaxClients == 0 {
+		f.MaxClients = defaultFreeTierMaxClients
+	}
+	switch f.Identity {
+	case "ip", "wallet":
+	case "header":
+		if f.Header == "" {
+			return fmt.Errorf("free_tier header identity requires a header name")
+		}
+	default:
+		return fmt.Errorf("unknown free_tier identity %q: expected ip, header or wallet", f.Identity)
+	}
+
+	if f.Store == "" && (f.Directory != "" || f.StorageRaw != nil) {
+		f.Store = "storage"
+	}
+	switch f.Store {
+	case "", "memory":
+		if f.Directory != "" || f.StorageRaw != nil {
+			return fmt.Errorf("free_tier directory and storage require the storage store")
+		}
+		f.counts = make(map[string]*freeTierCount)
+	case "storage":
+		switch {
+		case f.Directory != "" && f.StorageRaw != nil:
+			return fmt.Errorf("free_tier: directory and storage are mutually exclusive")
+		case f.Directory != "":
+			f.storage = &certmagic.FileStorage{Path: f.Directory}
+		case f.StorageRaw != nil:
+			val, err := ctx.LoadModule(f, "StorageRaw")
+			if err != nil {
+				return fmt.Errorf("loading free_tier storage module: %v", err)
+			}
+			storage, err := val.(caddy.StorageConverter).CertMagicStorage()
+			if err != nil {
+				return fmt.Errorf("creating free_tier storage: %v", err)
+			}
+			f.storage = storage
+		default:
+			f.storage = ctx.Storage()
+		}
+	default:
+		return fmt.Errorf("unknown free_tier store %q: expected memory or storage", f.Store)
+	}
+
+	// Routes keep separate counts, even in shared storage
+	f.scope = m.Resource
+	f.logger = ctx.Logger(m)
+	go f.prune(ctx)
+	return nil
+}
+
+// allow counts a free request by the client making r, reporting whether
+// it is within the client's free tier.
+func (f *FreeTier) allow(w http.ResponseWriter, r *http.Request) bool {
+	identity, ok := f.identify(r)
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(f.scope + "\x00" + f.Identity + "\x00" + identity))
+	key := hex.EncodeToString(sum[:16])
+
+	remaining, err := f.take(r.Context(), key)
+	if err != nil {
+		// Without a count the client pays, as it would without a free tier
+		f.logger.Error("failed to count free request", zap.Error(err))
+		return false
+	}
+	if remaining < 0 {
+		w.Header().Set(headerFreeTierRemaining, "0")
+		return false
+	}
+	w.Header().Set(headerFreeTierRemaining, strconv.Itoa(remaining))
+	return true
+}
+
+// identify returns who is making r.
+func (f *FreeTier) identify(r *http.Request) (string, bool) {
+	switch f.Identity {
+	case "header":
+		value := strings.TrimSpace(r.Header.Get(f.Header))
+		return value, value != ""
+	case "wallet":
+		value := r.Header.Get(headerPaymentIdentity)
+		if value == "" {
+			return "", false
+		}
+		address, err := verifyIdentity(value, r.Host, time.Now())
+		if err != nil {
+			f.logger.Debug("ignoring invalid payment identity", zap.Error(err))
+			return "", false
+		}
+		return address.Hex(), true
+	default:
+		ip, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+		return ip, ip != ""
+	}
+}
+
+// take counts a request against key, returning how many free requests are
+// left after it, or -1 if none were left for it.
+func (f *FreeTier) take(ctx context.Context, key string) (int, error) {
+	now := time.Now()
+	if f.storage == nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		count, ok := f.counts[key]
+		if !ok && len(f.counts) >= f.MaxClients {
+			f.dropExpired(now)
+			if len(f.counts) >= f.MaxClients {
+				return -1, nil
+			}
+		}
+		if !ok || !now.Before(count.Reset) {
+			count = &freeTierCount{Reset: now.Add(time.Duration(f.Window))}
+			f.counts[key] = count
+		}
+		return f.spend(count), nil
+	}
+
+	name := freeTierPrefix + key
+	if err := f.storage.Lock(ctx, name); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := f.storage.Unlock(context.WithoutCancel(ctx), name); err != nil {
+			f.logger.Warn("failed to unlock free tier count", zap.Error(err))
+		}
+	}()
+
+	var count freeTierCount
+	data, err := f.storage.Load(ctx, name)
+	isNew := errors.Is(err, fs.ErrNotExist)
+	switch {
+	case isNew:
+		// Shared storage is only counted as this instance last pruned it,
+		// plus what it added since
+		f.mu.Lock()
+		full := f.stored >= f.MaxClients
+		f.mu.Unlock()
+		if full {
+			return -1, nil
+		}
+	case err != nil:
+		return 0, err
+	default:
+		if err := json.Unmarshal(data, &count); err != nil {
+			f.logger.Warn("resetting corrupt free tier count", zap.Error(err))
+			count = freeTierCount{}
+		}
+	}
+	if !now.Before(count.Reset) {
+		count = freeTierCount{Reset: now.Add(time.Duration(f.Window))}
+	}
+	remaining := f.spend(&count)
+	if remaining < 0 {
+		return remaining, nil
+	}
+	data, err = json.Marshal(count)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.storage.Store(ctx, name, data); err != nil {
+		return 0, err
+	}
+	if isNew {
+		f.mu.Lock()
+		f.stored++
+		f.mu.Unlock()
+	}
+	return remaining, nil
+}
+
+// spend counts a request, returning how many are left after it, or -1 if
+// none were left for it.
+func (f *FreeTier) spend(count *freeTierCount) int {
+	if count.Count >= f.Requests {
+		return -1
+	}
+	count.Count++
+	return f.Requests - count.Count
+}
+
+// prune drops the counts of windows that are over, until ctx is done.
+func (f *FreeTier) prune(ctx context.Context) {
+	interval := min(time.Duration(f.Window), time.Hour)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Counts already in storage count against max_clients from the start
+	if f.storage != nil {
+		if err := f.pruneStorage(ctx, time.Now()); err != nil {
+			f.logger.Warn("failed to prune free tier counts", zap.Error(err))
+		}
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		now := time.Now()
+		if f.storage == nil {
+			f.mu.Lock()
+			f.dropExpired(now)
+			f.mu.Unlock()
+			continue
+		}
+		if err := f.pruneStorage(ctx, now); err != nil {
+			f.logger.Warn("failed to prune free tier counts", zap.Error(err))
+		}
+	}
+}
+
+// dropExpired drops the counts in memory whose window ended before now.
+// f.mu must be held.
+func (f *FreeTier) dropExpired(now time.Time) {
+	for key, count := range f.counts {
+		if !now.Before(count.Reset) {
+			delete(f.counts, key)
+		}
+	}
+}
+
+// pruneStorage deletes counts in storage whose window ended before now,
+// and recounts those left.
+func (f *FreeTier) pruneStorage(ctx context.Context, now time.Time) error {
+	keys, err := f.storage.List(ctx, strings.TrimSuffix(freeTierPrefix, "/"), false)
+	if errors.Is(err, fs.ErrNotExist) {
+		f.mu.Lock()
+		f.stored = 0
+		f.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stored := len(keys)
+	defer func() {
+		f.mu.Lock()
+		f.stored = stored
+		f.mu.Unlock()
+	}()
+	for _, name := range keys {
+		if err := f.storage.Lock(ctx, name); err != nil {
+			return err
+		}
+		var count freeTierCount
+		data, err := f.storage.Load(ctx, name)
+		if err == nil && json.Unmarshal(data, &count) == nil && !now.Before(count.Reset) {
+			if err = f.storage.Delete(ctx, name); err == nil {
+				stored--
+			}
+		}
+		if unlockErr := f.storage.Unlock(ctx, name); unlockErr != nil {
+			f.logger.Warn("failed to unlock free tier count", zap.Error(unlockErr))
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// identityMessage is what a buyer signs to prove its wallet address to
+// host, so that the signature cannot be replayed to other sellers.
+func identityMessage(host string, timestamp int64) []byte {
+	return []byte("x402 identity " + identityHost(host) + " " + strconv.FormatInt(timestamp, 10))
+}
+
+// identityHost returns the host an identity is bound to: the request's
+// host without its port, which proxies in between may change.
+func identityHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// signIdentity returns an identity header value for the wallet of key,
+// for requests to host.
+func signIdentity(key *ecdsa.PrivateKey, host string, now time.Time) (string, error) {
+	timestamp := now.Unix()
+	sig, err := crypto.Sign(accounts.TextHash(identityMessage(host, timestamp)), key)
+	if err != nil {
+		return "", err
+	}
+	sig[64] += 27
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	return fmt.Sprintf("%s:%d:%s", address.Hex(), timestamp, hexutil.Encode(sig)), nil
+}
+
+// verifyIdentity returns the wallet address an identity header value
+// proves, if it was signed for host recently enough.
+func verifyIdentity(value, host string, now time.Time) (common.Address, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || !common.IsHexAddress(parts[0]) {
+		return common.Address{}, fmt.Errorf("malformed identity")
+	}
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("malformed identity time")
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > identityMaxSkew || skew < -identityMaxSkew {
+		return common.Address{}, fmt.Errorf("identity signed too far from now")
+	}
+	sig, err := hexutil.Decode(parts[2])
+	if err != nil || len(sig) != 65 {
+		return common.Address{}, fmt.Errorf("malformed signature")
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	pub, err := crypto.SigToPub(accounts.TextHash(identityMessage(host, timestamp)), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	address := crypto.PubkeyToAddress(*pub)
+	if address != common.HexToAddress(parts[0]) {
+		return common.Address{}, fmt.Errorf("identity not signed by %s", parts[0])
+	}
+	return address, nil
+}
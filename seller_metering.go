@@ -0,0 +1,187 @@
+package x402pay
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultUsageHeader is the header in which upstreams report what a
+// response cost under the upto scheme.
+const defaultUsageHeader = "X-Usage-Cost"
+
+// serveMetered serves a request paid under the upto scheme: the payment is
+// verified for the maximum price, the request is served, and what the
+// response reported it cost is settled afterwards.
+func (m *X402SellerMiddleware) serveMetered(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, paymentHeader string, terms paymentTerms) error {
+	verifyReq, payer, err := m.verifyPayment(paymentHeader, terms)
+	if err != nil {
+		m.paymentFailed(w, err)
+		return nil
+	}
+	if !m.facilitatorApp.reserveUpto(m.ctx, verifyReq) {
+		m.paymentFailed(w, fmt.Errorf("payment is invalid: payment_already_used"))
+		return nil
+	}
+	defer m.facilitatorApp.releaseUpto(verifyReq)
+
+	rec := &usageRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		header:                m.UsageHeader,
+	}
+	handlerErr := next.ServeHTTP(rec, r)
+	rec.collectTrailer()
+
+	status := rec.status
+	if handlerErr != nil && status == 0 {
+		status = http.StatusInternalServerError
+		if handlerErr, ok := handlerErr.(caddyhttp.HandlerError); ok && handlerErr.StatusCode != 0 {
+			status = handlerErr.StatusCode
+		}
+	}
+	amount := m.meteredAmount(rec.usage, status, terms.amount)
+
+	logger := m.ctx.Logger(m)
+	if amount.Sign() == 0 {
+		logger.Info("metered response cost nothing, not settling",
+			zap.String("resource", m.Resource),
+			zap.String("payer", payer),
+			zap.Int("status", status),
+		)
+		return handlerErr
+	}
+
+	// The actual cost takes the place of the maximum in the settlement
+	settleReq := *verifyReq
+	settleReq.PaymentRequirements.MaxAmountRequired = amount.String()
+	if err := m.settlePayment(&settleReq, payer); err != nil {
+		logger.Error("metered payment settlement failed",
+			zap.String("resource", m.Resource),
+			zap.String("payer", payer),
+			zap.String("amount", amount.String()),
+			zap.Error(err),
+		)
+	}
+	return handlerErr
+}
+
+// meteredAmount returns what to charge for a response given the usage it
+// reported and its status. Usage is capped at the maximum price. Responses
+// that report nothing are charged the maximum, unless they failed, in
+// which case they are free.
+func (m *X402SellerMiddleware) meteredAmount(usage string, status int, price string) *big.Int {
+	maximum, _ := new(big.Int).SetString(price, 10)
+	if usage == "" {
+		if status >= http.StatusBadRequest {
+			return new(big.Int)
+		}
+		return maximum
+	}
+
+	cost, ok := new(big.Int).SetString(strings.TrimSpace(usage), 10)
+	if !ok || cost.Sign() < 0 {
+		m.ctx.Logger(m).Warn("invalid usage reported, charging the maximum",
+			zap.String("resource", m.Resource),
+			zap.String("usage", usage),
+		)
+		return maximum
+	}
+	if cost.Cmp(maximum) > 0 {
+		m.ctx.Logger(m).Warn("reported usage exceeds the maximum price, charging the maximum",
+			zap.String("resource", m.Resource),
+			zap.String("usage", usage),
+			zap.String("max_amount_required", price),
+		)
+		return maximum
+	}
+	return cost
+}
+
+// usageRecorder passes a response through while picking up the usage
+// reported in its header or trailer, which it keeps from the client.
+type usageRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	header      string
+	status      int
+	usage       string
+	wroteHeader bool
+}
+
+// WriteHeader takes the usage header out of the response.
+func (u *usageRecorder) WriteHeader(status int) {
+	if u.wroteHeader {
+		return
+	}
+	// Informational responses are followed by the real one
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		u.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	u.wroteHeader = true
+	u.status = status
+	if usage := u.Header().Get(u.header); usage != "" {
+		u.usage = usage
+		u.Header().Del(u.header)
+	}
+	u.unannounceTrailer()
+	u.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// Write writes the header if it was not written yet.
+func (u *usageRecorder) Write(p []byte) (int, error) {
+	if !u.wroteHeader {
+		u.WriteHeader(http.StatusOK)
+	}
+	return u.ResponseWriterWrapper.Write(p)
+}
+
+// ReadFrom writes the header if it was not written yet, so that copying
+// the body straight to the connection does not skip it.
+func (u *usageRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if !u.wroteHeader {
+		u.WriteHeader(http.StatusOK)
+	}
+	return u.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// unannounceTrailer drops the usage header from the announced trailers,
+// so that it is not sent to the client at the end of the body.
+func (u *usageRecorder) unannounceTrailer() {
+	announced := u.Header().Values("Trailer")
+	if len(announced) == 0 {
+		return
+	}
+	var kept []string
+	for _, value := range announced {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !strings.EqualFold(name, u.header) {
+				kept = append(kept, name)
+			}
+		}
+	}
+	u.Header().Del("Trailer")
+	if len(kept) > 0 {
+		u.Header().Set("Trailer", strings.Join(kept, ", "))
+	}
+}
+
+// collectTrailer picks up usage reported in a trailer once the response
+// body is written. Trailers are either announced and set under their own
+// name, or set under the http.TrailerPrefix.
+func (u *usageRecorder) collectTrailer() {
+	if !u.wroteHeader {
+		return
+	}
+	for _, key := range []string{http.TrailerPrefix + u.header, u.header} {
+		if usage := u.Header().Get(key); usage != "" {
+			u.usage = usage
+			u.Header().Del(key)
+		}
+	}
+}
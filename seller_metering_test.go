@@ -0,0 +1,33 @@
+package x402pay
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMeteredAmount(t *testing.T) {
+	m := &X402SellerMiddleware{}
+	for _, tc := range []struct {
+		name   string
+		usage  string
+		status int
+		want   string
+	}{
+		{"reported", "250", http.StatusOK, "250"},
+		{"whitespace", " 250 ", http.StatusOK, "250"},
+		{"zero", "0", http.StatusOK, "0"},
+		{"capped", "5000", http.StatusOK, "1000"},
+		{"at maximum", "1000", http.StatusOK, "1000"},
+		{"unreported", "", http.StatusOK, "1000"},
+		{"unreported failure", "", http.StatusBadGateway, "0"},
+		{"reported failure", "10", http.StatusInternalServerError, "10"},
+		{"negative", "-5", http.StatusOK, "1000"},
+		{"invalid", "1.5", http.StatusOK, "1000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := m.meteredAmount(tc.usage, tc.status, "1000"); got.String() != tc.want {
+				t.Errorf("meteredAmount(%q, %d) = %s, want %s", tc.usage, tc.status, got, tc.want)
+			}
+		})
+	}
+}
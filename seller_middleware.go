@@ -2,6 +2,7 @@ package x402pay
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -27,9 +28,55 @@ type X402SellerMiddleware struct {
 	MaxAmountRequired string `json:"max_amount_required,omitempty"`
 	PayTo             string `json:"pay_to,omitempty"`
 
+	// Asset is the symbol or address of the token to be paid in. Defaults
+	// to the network's default asset.
+	Asset string `json:"asset,omitempty"`
+
+	// Settlement is "sync" (default), which settles the payment on chain
+	// before serving the resource, or "optimistic", which serves it once
+	// the payment is verified and leaves settlement to the facilitator's
+	// settlement queue.
+	Settlement string `json:"settlement,omitempty"`
+
+	// UsageHeader is the response header, or trailer, in which the upstream
+	// reports what a response cost under the upto scheme, in the token's
+	// smallest unit. It is not passed on to the client. Defaults to
+	// X-Usage-Cost.
+	UsageHeader string `json:"usage_header,omitempty"`
+
+	// Stream, if set, meters the response and has the buyer pay again each
+	// time the allowance bought by a payment is used up.
+	Stream *PaymentStream `json:"stream,omitempty"`
+
+	// Session, if set, meters WebSocket connections upgraded from paid
+	// requests and has the client pay again as the session goes on.
+	Session *PaymentSession `json:"session,omitempty"`
+
+	// JSONRPC, if set, prices JSON-RPC requests by method, and MCP tool
+	// calls by tool, instead of charging max_amount_required for each.
+	JSONRPC *JSONRPCPricing `json:"jsonrpc,omitempty"`
+
+	// GraphQL, if set, prices GraphQL requests by the operations and
+	// fields they select instead of charging max_amount_required for each.
+	GraphQL *GraphQLPricing `json:"graphql,omitempty"`
+
+	// RateCard, if set, prices requests from a file that is reloaded when
+	// it changes, falling back to the configuration above for requests no
+	// rate applies to.
+	RateCard *RateCard `json:"rate_card,omitempty"`
+
+	// FreeTier, if set, serves each client a number of requests per window
+	// before asking it to pay.
+	FreeTier *FreeTier `json:"free_tier,omitempty"`
+
+	// Split, if set, shares each payment between pay_to and further
+	// payees.
+	Split *RevenueSplit `json:"split,omitempty"`
+
 	// Facilitator app reference
 	facilitatorApp *X402FacilitatorApp
 	ctx            caddy.Context
+	streams        *streamRegistry
 }
 
 // CaddyModule returns the Caddy module information.
@@ -56,6 +103,61 @@ func (m *X402SellerMiddleware) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("x402.facilitator app is not of type *X402FacilitatorApp")
 	}
 
+	if m.Settlement == "" {
+		m.Settlement = "sync"
+	}
+	if m.UsageHeader == "" {
+		m.UsageHeader = defaultUsageHeader
+	}
+	if m.Stream != nil {
+		if err := m.Stream.provision(); err != nil {
+			return err
+		}
+		m.streams = newStreamRegistry()
+	}
+	if m.Session != nil {
+		if err := m.Session.provision(); err != nil {
+			return err
+		}
+	}
+	if m.GraphQL != nil {
+		if err := m.GraphQL.provision(); err != nil {
+			return err
+		}
+	}
+	if m.Settlement == "optimistic" && m.facilitatorApp.SettlementQueue == nil {
+		return fmt.Errorf("optimistic settlement requires the x402.facilitator settlement_queue")
+	}
+	if m.Split != nil {
+		if err := m.Split.provision(); err != nil {
+			return err
+		}
+		if m.facilitatorApp.SettlementQueue == nil {
+			return fmt.Errorf("split requires the x402.facilitator settlement_queue")
+		}
+	}
+	found, err := m.facilitatorApp.useChainNetwork(m.Network)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("chain network %s is neither configured nor a known preset", m.Network)
+	}
+	chainNetwork, _ := m.facilitatorApp.findChainNetwork(m.Network)
+	if _, ok := chainNetwork.asset(m.Asset); !ok {
+		return fmt.Errorf("asset %s not found on chain network %s", m.Asset, m.Network)
+	}
+	if m.RateCard != nil {
+		if err := m.RateCard.provision(ctx, m); err != nil {
+			return err
+		}
+	}
+	if m.FreeTier != nil {
+		if err := m.FreeTier.provision(ctx, m); err != nil {
+			return err
+		}
+	}
+
 	ctx.Logger(m).Info("provisioning x402 seller middleware",
 		zap.String("network", m.Network),
 		zap.String("resource", m.Resource),
@@ -69,6 +171,9 @@ func (m *X402SellerMiddleware) Validate() error {
 	if m.Scheme == "" {
 		return fmt.Errorf("scheme is required")
 	}
+	if m.Scheme != schemeExact && m.Scheme != schemeUpto {
+		return fmt.Errorf("unsupported scheme %q: expected exact or upto", m.Scheme)
+	}
 	if m.Network == "" {
 		return fmt.Errorf("network is required")
 	}
@@ -78,9 +183,35 @@ func (m *X402SellerMiddleware) Validate() error {
 	if m.PayTo == "" {
 		return fmt.Errorf("pay_to is required")
 	}
+	if err := validatePayTo(m.PayTo); err != nil {
+		return err
+	}
 	if m.MaxAmountRequired == "" {
 		return fmt.Errorf("max_amount_required is required")
 	}
+	if err := validateAmount(m.MaxAmountRequired); err != nil {
+		return fmt.Errorf("max_amount_required: %w", err)
+	}
+	if m.Settlement != "sync" && m.Settlement != "optimistic" {
+		return fmt.Errorf("unknown settlement mode %q: expected sync or optimistic", m.Settlement)
+	}
+	if m.Stream != nil && m.Scheme != schemeExact {
+		return fmt.Errorf("stream metering requires the exact scheme")
+	}
+	if m.Session != nil && m.Scheme != schemeExact {
+		return fmt.Errorf("session metering requires the exact scheme")
+	}
+	if m.JSONRPC != nil {
+		if err := m.JSONRPC.validate(); err != nil {
+			return err
+		}
+	}
+	if m.JSONRPC != nil && m.GraphQL != nil {
+		return fmt.Errorf("jsonrpc and graphql pricing cannot be used together")
+	}
+	if m.FreeTier != nil && m.Stream != nil {
+		return fmt.Errorf("free_tier cannot be used with stream metering")
+	}
 	return nil
 }
 
@@ -88,9 +219,34 @@ func (m *X402SellerMiddleware) Validate() error {
 func (m *X402SellerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	// Check for X-Payment header
 	paymentHeader := r.Header.Get("X-Payment")
+
+	// Top-ups for a stream being served are not requests for the resource
+	if id := r.Header.Get(headerPaymentStream); id != "" && m.Stream != nil {
+		return m.serveTopUp(w, r, id, paymentHeader)
+	}
+
+	// What the request costs may depend on what it asks for
+	terms, err := m.requestTerms(w, r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if terms.priced && terms.amount == "0" {
+		return next.ServeHTTP(w, r)
+	}
+
+	// Clients within their free tier need not pay; metered sessions are
+	// paid for from the start
+	if paymentHeader == "" && m.FreeTier != nil && !isWebSocketUpgrade(r) && m.FreeTier.allow(w, r) {
+		return next.ServeHTTP(w, r)
+	}
+
 	if paymentHeader == "" {
 		// No payment provided, return 402 Payment Required
-		if err := m.returnPaymentRequired(w); err != nil {
+		if err := m.returnPaymentRequired(w, terms); err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(types.ErrorResponse{
@@ -102,38 +258,59 @@ func (m *X402SellerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request,
 		return nil
 	}
 
-	// Parse and validate payment
-	if err := m.processPayment(paymentHeader); err != nil {
-		m.ctx.Logger(m).Error("payment processing failed",
-			zap.Error(err),
-		)
+	// Metered payments are settled once the response is done
+	if m.Scheme == schemeUpto {
+		return m.serveMetered(w, r, next, paymentHeader, terms)
+	}
 
-		// Return payment required with error details
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusPaymentRequired)
-		json.NewEncoder(w).Encode(types.ErrorResponse{
-			Error:   "payment_failed",
-			Message: err.Error(),
-			Code:    http.StatusPaymentRequired,
-		})
+	// Parse and validate payment
+	if err := m.processPayment(paymentHeader, terms); err != nil {
+		m.paymentFailed(w, err)
 		return nil
 	}
 
 	// Payment successful, continue to next handler
+	if m.Session != nil && isWebSocketUpgrade(r) {
+		return m.serveSession(w, r, next, m.resourceTerms(r))
+	}
+	if m.Stream != nil {
+		return m.serveStream(w, r, next, m.resourceTerms(r))
+	}
 	return next.ServeHTTP(w, r)
 }
 
-// returnPaymentRequired returns a 402 Payment Required response with payment requirements.
-func (m *X402SellerMiddleware) returnPaymentRequired(w http.ResponseWriter) error {
+// paymentFailed returns a 402 Payment Required response with the details
+// of why the payment was not accepted.
+func (m *X402SellerMiddleware) paymentFailed(w http.ResponseWriter, err error) {
+	m.ctx.Logger(m).Error("payment processing failed",
+		zap.Error(err),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPaymentRequired)
+	json.NewEncoder(w).Encode(types.ErrorResponse{
+		Error:   "payment_failed",
+		Message: err.Error(),
+		Code:    http.StatusPaymentRequired,
+	})
+}
+
+// returnPaymentRequired returns a 402 Payment Required response with payment
+// requirements on the given terms, shaped as a JSON-RPC error if the
+// request was a JSON-RPC request.
+func (m *X402SellerMiddleware) returnPaymentRequired(w http.ResponseWriter, terms paymentTerms) error {
 	facilitatorInstance := m.facilitatorApp.GetFacilitator()
 	if facilitatorInstance == nil {
 		return fmt.Errorf("facilitator is not initialized")
 	}
 
-	requirements, err := facilitatorInstance.CreatePaymentRequirements(m.Resource, m.Description, m.Network, m.PayTo, m.MaxAmountRequired)
+	requirements, err := m.paymentRequirements(terms)
 	if err != nil {
 		return fmt.Errorf("create payment requirements failed: %w", err)
 	}
+	if terms.rpc != nil {
+		return m.returnJSONRPCPaymentRequired(w, terms.rpc, requirements)
+	}
 
 	w.Header().Set("X-Payment-Required", "true")
 	w.Header().Set("Content-Type", "application/json")
@@ -148,48 +325,77 @@ func (m *X402SellerMiddleware) returnPaymentRequired(w http.ResponseWriter) erro
 }
 
 // processPayment processes the X-Payment header and verifies/settles the payment.
-func (m *X402SellerMiddleware) processPayment(paymentHeader string) error {
+func (m *X402SellerMiddleware) processPayment(paymentHeader string, terms paymentTerms) error {
+	verifyReq, payer, err := m.verifyPayment(paymentHeader, terms)
+	if err != nil {
+		return err
+	}
+	return m.settlePayment(verifyReq, payer)
+}
+
+// verifyPayment parses the X-Payment header and verifies the payment
+// against the resource's requirements on the given terms. It returns the
+// verified request and the payer.
+func (m *X402SellerMiddleware) verifyPayment(paymentHeader string, terms paymentTerms) (*types.VerifyRequest, string, error) {
 	// Get facilitator instance
 	facilitatorInstance := m.facilitatorApp.GetFacilitator()
 	if facilitatorInstance == nil {
-		return fmt.Errorf("facilitator is not initialized")
+		return nil, "", fmt.Errorf("facilitator is not initialized")
 	}
 
 	// Parse X-Payment header (should be JSON)
 	var paymentPayload types.PaymentPayload
 	if err := json.Unmarshal([]byte(paymentHeader), &paymentPayload); err != nil {
-		return fmt.Errorf("failed to parse X-Payment header: %w", err)
+		return nil, "", fmt.Errorf("failed to parse X-Payment header: %w", err)
 	}
 
 	// Verify scheme and network match
-	if paymentPayload.Scheme != m.Scheme || paymentPayload.Network != m.Network {
-		return fmt.Errorf("payment scheme/network mismatch: expected scheme=%s network=%s, got scheme=%s network=%s",
-			m.Scheme, m.Network, paymentPayload.Scheme, paymentPayload.Network)
+	if paymentPayload.Scheme != m.Scheme || paymentPayload.Network != terms.network {
+		return nil, "", fmt.Errorf("payment scheme/network mismatch: expected scheme=%s network=%s, got scheme=%s network=%s",
+			m.Scheme, terms.network, paymentPayload.Scheme, paymentPayload.Network)
 	}
 
-	requirements, err := facilitatorInstance.CreatePaymentRequirements(m.Resource, m.Description, m.Network, m.PayTo, m.MaxAmountRequired)
+	requirements, err := m.paymentRequirements(terms)
 	if err != nil {
-		return fmt.Errorf("create payment requirements failed: %w", err)
+		return nil, "", fmt.Errorf("create payment requirements failed: %w", err)
 	}
 
 	// Create verify request
-	verifyReq := types.VerifyRequest{
+	verifyReq := &types.VerifyRequest{
 		PaymentPayload:      paymentPayload,
 		PaymentRequirements: *requirements,
 	}
 
 	// Verify payment
-	verifyResp, err := facilitatorInstance.Verify(m.ctx, &verifyReq)
+	verifyResp, err := facilitatorInstance.Verify(m.ctx, verifyReq)
 	if err != nil {
-		return fmt.Errorf("payment verification failed: %w", err)
+		return nil, "", fmt.Errorf("payment verification failed: %w", err)
 	}
 
 	if !verifyResp.IsValid {
-		return fmt.Errorf("payment is invalid: %s", verifyResp.InvalidReason)
+		return nil, "", fmt.Errorf("payment is invalid: %s", verifyResp.InvalidReason)
+	}
+	return verifyReq, verifyResp.Payer, nil
+}
+
+// settlePayment settles a verified payment, or queues it for settlement in
+// optimistic mode.
+func (m *X402SellerMiddleware) settlePayment(verifyReq *types.VerifyRequest, payer string) error {
+	if m.Settlement == "optimistic" {
+		rec, err := m.facilitatorApp.SettlementQueue.enqueue(m.ctx, verifyReq, payer)
+		if err != nil {
+			return fmt.Errorf("payment settlement failed: %w", err)
+		}
+		m.ctx.Logger(m).Info("payment verified, settlement queued",
+			zap.String("resource", m.Resource),
+			zap.String("payer", payer),
+			zap.String("settlement_id", rec.ID),
+		)
+		return nil
 	}
 
 	// Settle payment
-	settleResp, err := facilitatorInstance.Settle(m.ctx, &verifyReq)
+	settleResp, err := m.facilitatorApp.GetFacilitator().Settle(m.ctx, verifyReq)
 	if err != nil {
 		return fmt.Errorf("payment settlement failed: %w", err)
 	}
@@ -204,6 +410,18 @@ func (m *X402SellerMiddleware) processPayment(paymentHeader string) error {
 		zap.String("transaction", settleResp.Transaction),
 	)
 
+	// The resource is served once the settlement is mined; its finality,
+	// and the legs of a split payment, are tracked in the journal
+	if queue := m.facilitatorApp.SettlementQueue; queue != nil && settleResp.Transaction != "" && (m.Split != nil || m.facilitatorApp.tracksFinality(verifyReq.PaymentRequirements.Network)) {
+		if err := queue.record(m.ctx, verifyReq, settleResp); err != nil {
+			// The sale is done; the queue writes the record again later
+			m.ctx.Logger(m).Error("failed to journal settled payment, will retry",
+				zap.String("transaction", settleResp.Transaction),
+				zap.Error(err),
+			)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,111 @@
+package x402pay
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"net/http"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+)
+
+// maxPricedBody is the largest request body inspected for pricing.
+const maxPricedBody = 1 << 20
+
+// paymentTerms are what a request costs and where it is paid.
+type paymentTerms struct {
+	amount  string
+	network string
+	asset   string
+	payTo   string
+
+	// priced is set when the amount was worked out for the request rather
+	// than being the route's price; requests priced at 0 are free
+	priced bool
+
+	// rpc is the JSON-RPC request priced, if any
+	rpc *jsonRPCRequest
+}
+
+// resourceTerms returns the terms of the resource r asks for, from the
+// rate card if a rate applies and from the route's configuration
+// otherwise.
+func (m *X402SellerMiddleware) resourceTerms(r *http.Request) paymentTerms {
+	terms := paymentTerms{
+		amount:  m.MaxAmountRequired,
+		network: m.Network,
+		asset:   m.Asset,
+		payTo:   m.PayTo,
+	}
+	if m.RateCard != nil {
+		if rate := m.RateCard.match(r); rate != nil {
+			rate.apply(&terms)
+		}
+	}
+	return terms
+}
+
+// requestTerms returns the terms of r. Without JSON-RPC or GraphQL
+// pricing, or for requests they do not apply to, they are the terms of the
+// resource.
+func (m *X402SellerMiddleware) requestTerms(w http.ResponseWriter, r *http.Request) (paymentTerms, error) {
+	terms := m.resourceTerms(r)
+	if m.JSONRPC == nil && m.GraphQL == nil {
+		return terms, nil
+	}
+	body, err := readPricedBody(w, r)
+	if err != nil {
+		return terms, err
+	}
+
+	if m.JSONRPC != nil {
+		req, ok := parseJSONRPC(body)
+		if !ok {
+			return terms, nil
+		}
+		total := new(big.Int)
+		for _, call := range req.calls {
+			total.Add(total, m.JSONRPC.price(call, terms.amount))
+		}
+		terms.amount = total.String()
+		terms.priced = true
+		terms.rpc = req
+		return terms, nil
+	}
+
+	reqs, ok, err := readGraphQL(r, body)
+	if err != nil || !ok {
+		return terms, err
+	}
+	total, err := m.GraphQL.price(reqs)
+	if err != nil {
+		return terms, err
+	}
+	terms.amount = total.String()
+	terms.priced = true
+	return terms, nil
+}
+
+// paymentRequirements builds the payment requirements for terms, paid
+// through the revenue split if there is one.
+func (m *X402SellerMiddleware) paymentRequirements(terms paymentTerms) (*types.PaymentRequirements, error) {
+	requirements, err := m.facilitatorApp.createPaymentRequirements(m.Scheme, m.Resource, m.Description, terms.network, terms.asset, terms.payTo, terms.amount)
+	if err != nil || m.Split == nil {
+		return requirements, err
+	}
+	m.Split.apply(requirements, terms.payTo, m.facilitatorApp.facilitatorAddress())
+	return requirements, nil
+}
+
+// readPricedBody reads and restores the body of r, for pricing.
+func readPricedBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPricedBody))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
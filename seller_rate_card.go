@@ -0,0 +1,382 @@
+package x402pay
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultRateCardCheckInterval = 5 * time.Second
+
+// RateCard prices the resources behind a seller from a file kept outside
+// the Caddy config. The file lists rates, each matching requests by path
+// pattern and optionally by method and host, and setting their price and
+// optionally the network, asset and pay_to address they are paid with.
+// The first matching rate applies; requests no rate matches are priced by
+// the seller's own configuration.
+//
+// The file is checked for changes every check interval and reloaded as a
+// whole. A file that fails to load or validate is logged and the rates
+// loaded before stay in effect.
+type RateCard struct {
+	// File is the path of the rate card.
+	File string `json:"file,omitempty"`
+
+	// Format is json, yaml or csv. Defaults to the one the file extension
+	// names.
+	Format string `json:"format,omitempty"`
+
+	// CheckInterval is how often the file is checked for changes. Defaults
+	// to 5s.
+	CheckInterval caddy.Duration `json:"check_interval,omitempty"`
+
+	rates   atomic.Pointer[[]*rateCardEntry]
+	modTime time.Time
+	size    int64
+}
+
+// rateCardEntry is a rate of a rate card.
+type rateCardEntry struct {
+	Path    string         `json:"path" yaml:"path"`
+	Methods []string       `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Hosts   []string       `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	Price   rateCardAmount `json:"price" yaml:"price"`
+	Network string         `json:"network,omitempty" yaml:"network,omitempty"`
+	Asset   string         `json:"asset,omitempty" yaml:"asset,omitempty"`
+	PayTo   string         `json:"pay_to,omitempty" yaml:"pay_to,omitempty"`
+
+	pathMatcher caddyhttp.MatchPath
+	hostMatcher caddyhttp.MatchHost
+}
+
+// rateCardAmount is a price, which rate cards may give as a number or a
+// string.
+type rateCardAmount string
+
+// UnmarshalJSON accepts a number or a string.
+func (a *rateCardAmount) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = rateCardAmount(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("price must be a number or a string")
+	}
+	*a = rateCardAmount(n.String())
+	return nil
+}
+
+// provision loads the rate card, which has to be valid, and watches it for
+// changes until ctx is done.
+func (c *RateCard) provision(ctx caddy.Context, m *X402SellerMiddleware) error {
+	if c.File == "" {
+		return fmt.Errorf("rate card file is required")
+	}
+	if c.Format == "" {
+		c.Format = strings.TrimPrefix(strings.ToLower(filepath.Ext(c.File)), ".")
+		if c.Format == "yml" {
+			c.Format = "yaml"
+		}
+	}
+	if c.Format != "json" && c.Format != "yaml" && c.Format != "csv" {
+		return fmt.Errorf("unknown rate card format %q: expected json, yaml or csv", c.Format)
+	}
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = caddy.Duration(defaultRateCardCheckInterval)
+	}
+
+	// Networks first named by the rate card may still be set up from
+	// presets now; later changes can only use networks already set up
+	rates, err := c.load(ctx, m, true)
+	if err != nil {
+		return fmt.Errorf("rate card %s: %w", c.File, err)
+	}
+	c.rates.Store(&rates)
+	ctx.Logger(m).Info("loaded rate card",
+		zap.String("file", c.File),
+		zap.Int("rates", len(rates)),
+	)
+
+	go c.watch(ctx, m)
+	return nil
+}
+
+// watch reloads the rate card whenever the file changes, until ctx is done.
+func (c *RateCard) watch(ctx caddy.Context, m *X402SellerMiddleware) {
+	ticker := time.NewTicker(time.Duration(c.CheckInterval))
+	defer ticker.Stop()
+
+	logger := ctx.Logger(m)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		info, err := os.Stat(c.File)
+		if err != nil {
+			logger.Error("cannot check rate card, keeping the current rates",
+				zap.String("file", c.File),
+				zap.Error(err),
+			)
+			continue
+		}
+		if info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+			continue
+		}
+
+		rates, err := c.load(ctx, m, false)
+		if err != nil {
+			logger.Error("invalid rate card, keeping the current rates",
+				zap.String("file", c.File),
+				zap.Error(err),
+			)
+			continue
+		}
+		c.rates.Store(&rates)
+		logger.Info("reloaded rate card",
+			zap.String("file", c.File),
+			zap.Int("rates", len(rates)),
+		)
+	}
+}
+
+// load reads, parses and validates the rate card.
+func (c *RateCard) load(ctx caddy.Context, m *X402SellerMiddleware, provisioning bool) ([]*rateCardEntry, error) {
+	f, err := os.Open(c.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is not read again until it changes, valid or not
+	c.modTime, c.size = info.ModTime(), info.Size()
+
+	var rates []*rateCardEntry
+	switch c.Format {
+	case "json":
+		rates, err = parseRateCardJSON(data)
+	case "yaml":
+		rates, err = parseRateCardYAML(data)
+	case "csv":
+		rates, err = parseRateCardCSV(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rate := range rates {
+		if err := rate.provision(ctx, m, provisioning); err != nil {
+			return nil, fmt.Errorf("rate %d (%s): %w", i+1, rate.Path, err)
+		}
+	}
+	return rates, nil
+}
+
+// parseRateCardJSON parses a JSON rate card: a list of rates, or an object
+// listing them under rates.
+func parseRateCardJSON(data []byte) ([]*rateCardEntry, error) {
+	data = bytes.TrimSpace(data)
+	var card struct {
+		Rates []*rateCardEntry `json:"rates"`
+	}
+	var err error
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &card.Rates)
+	} else {
+		err = json.Unmarshal(data, &card)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing JSON: %w", err)
+	}
+	return card.Rates, nil
+}
+
+// parseRateCardYAML parses a YAML rate card, laid out as JSON ones are.
+func parseRateCardYAML(data []byte) ([]*rateCardEntry, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	var card struct {
+		Rates []*rateCardEntry `yaml:"rates"`
+	}
+	var err error
+	if len(node.Content) > 0 && node.Content[0].Kind == yaml.SequenceNode {
+		err = node.Decode(&card.Rates)
+	} else {
+		err = node.Decode(&card)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	return card.Rates, nil
+}
+
+// parseRateCardCSV parses a CSV rate card. The first row names the
+// columns: path, methods, hosts, price, network, asset and pay_to, of
+// which path and price are required. Methods and hosts are separated by
+// spaces. Lines starting with # are comments.
+func parseRateCardCSV(data []byte) ([]*rateCardEntry, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("parsing CSV: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"path", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV rate card has no %s column", required)
+		}
+	}
+	get := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	rates := make([]*rateCardEntry, 0, len(records)-1)
+	for _, record := range records[1:] {
+		rates = append(rates, &rateCardEntry{
+			Path:    get(record, "path"),
+			Methods: strings.Fields(get(record, "methods")),
+			Hosts:   strings.Fields(get(record, "hosts")),
+			Price:   rateCardAmount(get(record, "price")),
+			Network: get(record, "network"),
+			Asset:   get(record, "asset"),
+			PayTo:   get(record, "pay_to"),
+		})
+	}
+	return rates, nil
+}
+
+// provision checks a rate and sets up its matchers.
+func (e *rateCardEntry) provision(ctx caddy.Context, m *X402SellerMiddleware, provisioning bool) error {
+	if e.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if err := validateAmount(string(e.Price)); err != nil {
+		return fmt.Errorf("price: %w", err)
+	}
+	for i, method := range e.Methods {
+		e.Methods[i] = strings.ToUpper(method)
+	}
+	if e.PayTo != "" {
+		if err := validatePayTo(e.PayTo); err != nil {
+			return err
+		}
+	}
+
+	network := e.Network
+	if network == "" {
+		network = m.Network
+	}
+	if provisioning {
+		if _, err := m.facilitatorApp.useChainNetwork(network); err != nil {
+			return err
+		}
+	}
+	chainNetwork, ok := m.facilitatorApp.findChainNetwork(network)
+	if !ok {
+		return fmt.Errorf("chain network %s is not configured", network)
+	}
+	asset := e.Asset
+	if asset == "" && e.Network == "" {
+		asset = m.Asset
+	}
+	if _, ok := chainNetwork.asset(asset); !ok {
+		return fmt.Errorf("asset %s not found on chain network %s", asset, network)
+	}
+
+	e.pathMatcher = caddyhttp.MatchPath{e.Path}
+	if err := e.pathMatcher.Provision(ctx); err != nil {
+		return err
+	}
+	if len(e.Hosts) > 0 {
+		e.hostMatcher = caddyhttp.MatchHost(e.Hosts)
+		if err := e.hostMatcher.Provision(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rate applies to r.
+func (e *rateCardEntry) matches(r *http.Request) bool {
+	if len(e.Methods) > 0 && !slices.Contains(e.Methods, r.Method) {
+		return false
+	}
+	if ok, _ := e.pathMatcher.MatchWithError(r); !ok {
+		return false
+	}
+	if len(e.hostMatcher) > 0 {
+		if ok, _ := e.hostMatcher.MatchWithError(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the rate that applies to r, if any.
+func (c *RateCard) match(r *http.Request) *rateCardEntry {
+	rates := c.rates.Load()
+	if rates == nil {
+		return nil
+	}
+	for _, rate := range *rates {
+		if rate.matches(r) {
+			return rate
+		}
+	}
+	return nil
+}
+
+// apply sets terms to those of the rate.
+func (e *rateCardEntry) apply(terms *paymentTerms) {
+	terms.amount = strings.TrimSpace(string(e.Price))
+	if e.Network != "" {
+		terms.network = e.Network
+		terms.asset = e.Asset
+	} else if e.Asset != "" {
+		terms.asset = e.Asset
+	}
+	if e.PayTo != "" {
+		terms.payTo = e.PayTo
+	}
+	terms.priced = true
+}
@@ -0,0 +1,393 @@
+package x402pay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	// Headers announcing a metered WebSocket session on the 101 response.
+	headerPaymentSessionUnit      = "X-Payment-Session-Unit"
+	headerPaymentSessionAllowance = "X-Payment-Session-Allowance"
+
+	// x402 control messages exchanged over a metered WebSocket session as
+	// JSON text messages.
+	wsPaymentRequired = "x402-payment-required"
+	wsPayment         = "x402-payment"
+	wsPaymentAccepted = "x402-payment-accepted"
+	wsPaymentRejected = "x402-payment-rejected"
+
+	sessionUnitDuration = "duration"
+	sessionUnitMessages = "messages"
+
+	defaultSessionGrace = 10 * time.Second
+
+	// wsControlLimit is the largest text message inspected for x402 control
+	// messages.
+	wsControlLimit = 64 << 10
+
+	// wsClosePolicyViolation is the close code sent when a session runs out
+	// of allowance.
+	wsClosePolicyViolation = 1008
+)
+
+// PaymentSession meters upgraded WebSocket connections. The payment made
+// on the upgrade request buys an allowance of session time or messages;
+// when it is used up, the seller sends an x402-payment-required message
+// and closes the connection unless the client pays again within the grace
+// period, with an x402-payment message carrying a payment payload. Clients
+// may also pay ahead of time. Metered sessions are never compressed, since
+// control messages have to be read off the connection.
+type PaymentSession struct {
+	// Unit is what the allowance is counted in: duration (default) or
+	// messages, which counts data messages in both directions.
+	Unit string `json:"unit,omitempty"`
+
+	// Allowance is the number of messages each payment buys, under the
+	// messages unit.
+	Allowance int64 `json:"allowance,omitempty"`
+
+	// Duration is the session time each payment buys, under the duration
+	// unit.
+	Duration caddy.Duration `json:"duration,omitempty"`
+
+	// Grace is how long the client has to pay once the allowance is used
+	// up. Defaults to 10s.
+	Grace caddy.Duration `json:"grace,omitempty"`
+}
+
+// provision applies defaults and checks the configuration.
+func (s *PaymentSession) provision() error {
+	if s.Unit == "" {
+		s.Unit = sessionUnitDuration
+	}
+	switch s.Unit {
+	case sessionUnitDuration:
+		if s.Duration <= 0 {
+			return fmt.Errorf("session allowance must be a positive duration")
+		}
+	case sessionUnitMessages:
+		if s.Allowance <= 0 {
+			return fmt.Errorf("session allowance must be a positive number of messages")
+		}
+	default:
+		return fmt.Errorf("unknown session unit %q: expected duration or messages", s.Unit)
+	}
+	if s.Grace <= 0 {
+		s.Grace = caddy.Duration(defaultSessionGrace)
+	}
+	return nil
+}
+
+// allowance describes what one payment buys, as announced to the client.
+func (s *PaymentSession) allowance() string {
+	if s.Unit == sessionUnitDuration {
+		return time.Duration(s.Duration).String()
+	}
+	return strconv.FormatInt(s.Allowance, 10)
+}
+
+// serveSession serves a paid WebSocket upgrade, metering the connection
+// once it is switched.
+func (m *X402SellerMiddleware) serveSession(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, terms paymentTerms) error {
+	if r.ProtoMajor != 1 {
+		return caddyhttp.Error(http.StatusHTTPVersionNotSupported,
+			fmt.Errorf("metered WebSocket sessions require HTTP/1.1"))
+	}
+	// Compressed frames cannot be inspected, so extensions such as
+	// permessage-deflate are kept from being negotiated
+	r.Header.Del("Sec-WebSocket-Extensions")
+	w.Header().Set(headerPaymentSessionUnit, m.Session.Unit)
+	w.Header().Set(headerPaymentSessionAllowance, m.Session.allowance())
+	return next.ServeHTTP(&sessionHijacker{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		m:                     m,
+		terms:                 terms,
+	}, r)
+}
+
+// sessionHijacker hands out a metered connection when the response is
+// switched to WebSocket.
+type sessionHijacker struct {
+	*caddyhttp.ResponseWriterWrapper
+	m     *X402SellerMiddleware
+	terms paymentTerms
+}
+
+// Hijack takes over the connection and meters it.
+func (h *sessionHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(h.ResponseWriterWrapper.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	session := newSessionConn(h.m, h.terms, conn)
+
+	// Bytes the client sent right after the upgrade request have to go
+	// through the meter as well
+	if buffered := brw.Reader.Buffered(); buffered > 0 {
+		data, _ := brw.Peek(buffered)
+		session.pending = session.in.feed(data)
+	}
+	if err := brw.Writer.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return session, bufio.NewReadWriter(bufio.NewReader(session), bufio.NewWriter(session)), nil
+}
+
+// sessionConn is the client side of a metered WebSocket session.
+type sessionConn struct {
+	net.Conn
+	m       *X402SellerMiddleware
+	session *PaymentSession
+	logger  *zap.Logger
+
+	// terms are what each payment for the session pays
+	terms paymentTerms
+
+	// in follows what the client sends; pending is what is left of it to
+	// pass on
+	in      wsFrameFilter
+	pending []byte
+
+	// out follows what is sent to the client; queued are our own frames
+	// waiting for a message boundary. writeMu guards both.
+	writeMu sync.Mutex
+	out     wsFrameFilter
+	queued  [][]byte
+
+	mu        sync.Mutex
+	remaining int64
+	paidUntil time.Time
+	requested bool
+	expiry    *time.Timer
+	grace     *time.Timer
+	closed    bool
+}
+
+func newSessionConn(m *X402SellerMiddleware, terms paymentTerms, conn net.Conn) *sessionConn {
+	s := &sessionConn{
+		Conn:    conn,
+		m:       m,
+		terms:   terms,
+		session: m.Session,
+		logger:  m.ctx.Logger(m),
+	}
+	s.in = wsFrameFilter{holdLimit: wsControlLimit, inspect: s.control}
+	if s.session.Unit == sessionUnitMessages {
+		s.remaining = s.session.Allowance
+		s.in.onMessage = s.countMessage
+		s.out.onMessage = s.countMessage
+	} else {
+		s.paidUntil = time.Now().Add(time.Duration(s.session.Duration))
+		s.expiry = time.AfterFunc(time.Duration(s.session.Duration), s.requestPayment)
+	}
+	return s
+}
+
+// Read passes on what the client sends, minus control messages.
+func (s *sessionConn) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		n, err := s.Conn.Read(p)
+		if n > 0 {
+			s.pending = s.in.feed(p[:n])
+		}
+		if err != nil && len(s.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Write passes on what is sent to the client, followed by our own frames
+// once the stream is between messages.
+func (s *sessionConn) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.Conn.Write(s.out.feed(p)); err != nil {
+		return 0, err
+	}
+	return len(p), s.flushQueued()
+}
+
+// Close ends the session.
+func (s *sessionConn) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	if s.grace != nil {
+		s.grace.Stop()
+	}
+	s.mu.Unlock()
+	return s.Conn.Close()
+}
+
+// send queues one of our own messages to the client and sends it as soon
+// as the stream allows.
+func (s *sessionConn) send(message any) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.queued = append(s.queued, wsControlFrame(message, false))
+	if err := s.flushQueued(); err != nil {
+		s.logger.Debug("failed to send session control message", zap.Error(err))
+	}
+}
+
+// flushQueued sends queued frames if the stream is between messages. The
+// caller must hold writeMu.
+func (s *sessionConn) flushQueued() error {
+	if len(s.queued) == 0 || !s.out.atMessageBoundary() {
+		return nil
+	}
+	for _, frame := range s.queued {
+		if _, err := s.Conn.Write(frame); err != nil {
+			return err
+		}
+	}
+	s.queued = nil
+	return nil
+}
+
+// countMessage charges a data message against the allowance.
+func (s *sessionConn) countMessage() {
+	s.mu.Lock()
+	s.remaining--
+	exhausted := s.remaining <= 0
+	s.mu.Unlock()
+	if exhausted {
+		// Not from within Write, which holds writeMu
+		go s.requestPayment()
+	}
+}
+
+// requestPayment asks the client to pay for more of the session and closes
+// the session if it does not within the grace period.
+func (s *sessionConn) requestPayment() {
+	s.mu.Lock()
+	if s.requested || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.requested = true
+	s.grace = time.AfterFunc(time.Duration(s.session.Grace), s.expire)
+	s.mu.Unlock()
+
+	requirements, err := s.m.paymentRequirements(s.terms)
+	if err != nil {
+		s.logger.Error("failed to create session payment requirements", zap.Error(err))
+		return
+	}
+	s.send(map[string]any{
+		"type":                wsPaymentRequired,
+		"unit":                s.session.Unit,
+		"allowance":           s.session.allowance(),
+		"graceSeconds":        time.Duration(s.session.Grace).Seconds(),
+		"paymentRequirements": requirements,
+	})
+}
+
+// expire closes a session that was not paid for in time.
+func (s *sessionConn) expire() {
+	s.mu.Lock()
+	unpaid := s.requested && !s.closed
+	s.mu.Unlock()
+	if !unpaid {
+		return
+	}
+	s.logger.Info("closing WebSocket session that ran out of allowance",
+		zap.String("resource", s.m.Resource),
+		zap.String("remote", s.RemoteAddr().String()),
+	)
+	s.writeMu.Lock()
+	if s.out.atFrameBoundary() {
+		_, _ = s.Conn.Write(wsFrame(wsOpClose, wsCloseMessage(wsClosePolicyViolation, "payment required"), false))
+	}
+	s.writeMu.Unlock()
+	s.Close()
+}
+
+// control takes x402 control messages out of what the client sends.
+func (s *sessionConn) control(payload []byte) bool {
+	if wsControlType(payload) != wsPayment {
+		return false
+	}
+	var message struct {
+		Payment json.RawMessage `json:"payment"`
+	}
+	if err := json.Unmarshal(payload, &message); err != nil || len(message.Payment) == 0 {
+		go s.send(map[string]any{"type": wsPaymentRejected, "error": "x402-payment message without a payment"})
+		return true
+	}
+	// Settling may take a while; the session goes on meanwhile
+	go s.pay(string(message.Payment))
+	return true
+}
+
+// pay verifies and settles a payment made over the session and extends the
+// allowance by what it buys.
+func (s *sessionConn) pay(paymentHeader string) {
+	verifyReq, payer, err := s.m.verifyPayment(paymentHeader, s.terms)
+	if err == nil {
+		err = s.m.settlePayment(verifyReq, payer)
+	}
+	if err != nil {
+		s.logger.Warn("session payment failed", zap.Error(err))
+		s.send(map[string]any{"type": wsPaymentRejected, "error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	status := map[string]any{"type": wsPaymentAccepted, "unit": s.session.Unit}
+	exhausted := false
+	if s.session.Unit == sessionUnitMessages {
+		s.remaining += s.session.Allowance
+		status["remaining"] = s.remaining
+		exhausted = s.remaining <= 0
+	} else {
+		now := time.Now()
+		if s.paidUntil.Before(now) {
+			s.paidUntil = now
+		}
+		s.paidUntil = s.paidUntil.Add(time.Duration(s.session.Duration))
+		s.expiry.Reset(time.Until(s.paidUntil))
+		status["paidUntil"] = s.paidUntil.UTC().Format(time.RFC3339)
+	}
+	s.requested = false
+	if s.grace != nil {
+		s.grace.Stop()
+		s.grace = nil
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("session topped up",
+		zap.String("resource", s.m.Resource),
+		zap.String("payer", payer),
+	)
+	s.send(status)
+
+	// Messages sent while the payment was settling may have used it up
+	// already
+	if exhausted {
+		s.requestPayment()
+	}
+}
+
+// Interface guards
+var (
+	_ http.Hijacker = (*sessionHijacker)(nil)
+	_ net.Conn      = (*sessionConn)(nil)
+)
@@ -0,0 +1,125 @@
+package x402pay
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	splitTransfer = "transfer"
+	splitContract = "contract"
+)
+
+// RevenueSplit shares each payment for a resource between several payees,
+// such as a marketplace taking a platform fee from what its providers
+// earn. Payees take their share in the order listed, and pay_to gets what
+// is left.
+//
+// In transfer mode, payments are made to the facilitator, which pays each
+// payee its share with a transfer of its own once the payment is final. In
+// contract mode, payments are made to a splitter contract that shares them
+// out itself. Either way the settlement queue records every share as a leg
+// of the payment, so it is required.
+type RevenueSplit struct {
+	// Mode is transfer (default) or contract.
+	Mode string `json:"mode,omitempty"`
+
+	// Contract is the address of the splitter contract paid in contract
+	// mode. Its own configuration decides the shares; the payees listed
+	// here should match it.
+	Contract string `json:"contract,omitempty"`
+
+	// Payees are who get a share of each payment besides pay_to.
+	Payees []SplitPayee `json:"payees,omitempty"`
+}
+
+// SplitPayee is a payee of a revenue split.
+type SplitPayee struct {
+	// Address is where the payee's share is paid.
+	Address string `json:"address"`
+
+	// Percent is the payee's share of each payment, such as 10 or 2.5.
+	Percent string `json:"percent,omitempty"`
+
+	// Amount is a fixed share of each payment, in the token's smallest
+	// unit. Payments smaller than what payees listed before have taken
+	// plus Amount give the payee what is left of them.
+	Amount string `json:"amount,omitempty"`
+}
+
+// paymentSplit is a revenue split as carried in the extra field of payment
+// requirements, where the facilitator finds it.
+type paymentSplit struct {
+	Mode      string       `json:"mode"`
+	Payees    []SplitPayee `json:"payees"`
+	Remainder string       `json:"remainder"`
+}
+
+// provision checks the split.
+func (s *RevenueSplit) provision() error {
+	if s.Mode == "" {
+		s.Mode = splitTransfer
+	}
+	switch s.Mode {
+	case splitTransfer:
+		if s.Contract != "" {
+			return fmt.Errorf("split contract requires the contract mode")
+		}
+	case splitContract:
+		if !common.IsHexAddress(s.Contract) {
+			return fmt.Errorf("invalid split contract address %q", s.Contract)
+		}
+	default:
+		return fmt.Errorf("unknown split mode %q: expected transfer or contract", s.Mode)
+	}
+	if len(s.Payees) == 0 {
+		return fmt.Errorf("split requires at least one payee")
+	}
+
+	percents := new(big.Rat)
+	for _, payee := range s.Payees {
+		if err := validatePayTo(payee.Address); err != nil {
+			return fmt.Errorf("split payee: %w", err)
+		}
+		switch {
+		case (payee.Percent == "") == (payee.Amount == ""):
+			return fmt.Errorf("split payee %s needs either a percent or an amount", payee.Address)
+		case payee.Amount != "":
+			if err := validateAmount(payee.Amount); err != nil {
+				return fmt.Errorf("split payee %s: %w", payee.Address, err)
+			}
+		default:
+			percent, ok := new(big.Rat).SetString(strings.TrimSpace(payee.Percent))
+			if !ok || percent.Sign() <= 0 {
+				return fmt.Errorf("split payee %s: invalid percent %q", payee.Address, payee.Percent)
+			}
+			percents.Add(percents, percent)
+		}
+	}
+	if percents.Cmp(big.NewRat(100, 1)) > 0 {
+		return fmt.Errorf("split percents add up to more than 100")
+	}
+	return nil
+}
+
+// apply directs a payment made on requirements, for which payTo would
+// otherwise be paid, through the split.
+func (s *RevenueSplit) apply(requirements *types.PaymentRequirements, payTo string, facilitator common.Address) {
+	if s.Mode == splitContract {
+		requirements.PayTo = common.HexToAddress(s.Contract).Hex()
+	} else {
+		requirements.PayTo = facilitator.Hex()
+	}
+	if requirements.Extra == nil {
+		requirements.Extra = make(map[string]interface{})
+	}
+	requirements.Extra["split"] = paymentSplit{
+		Mode:      s.Mode,
+		Payees:    s.Payees,
+		Remainder: payTo,
+	}
+}
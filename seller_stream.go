@@ -0,0 +1,408 @@
+package x402pay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	// Headers announcing a metered stream to the buyer. Top-up payments
+	// for the stream are sent to the same resource with the stream ID in
+	// X-Payment-Stream.
+	headerPaymentStream          = "X-Payment-Stream"
+	headerPaymentStreamUnit      = "X-Payment-Stream-Unit"
+	headerPaymentStreamAllowance = "X-Payment-Stream-Allowance"
+
+	// streamPaymentRequiredEvent is the SSE event that pauses a stream
+	// until the buyer tops up.
+	streamPaymentRequiredEvent = "x402-payment-required"
+
+	streamUnitBytes  = "bytes"
+	streamUnitEvents = "events"
+
+	defaultTopUpTimeout = 30 * time.Second
+)
+
+// errTopUpTimeout ends a stream whose buyer did not top up in time.
+var errTopUpTimeout = errors.New("stream paused for payment and no top-up arrived")
+
+// PaymentStream meters a paid response as it is written and pauses it
+// whenever the allowance bought so far runs out, until the buyer tops up
+// with another payment of the same price. Server-sent event streams are
+// paused with an x402-payment-required event; other responses simply stop
+// until the top-up arrives.
+type PaymentStream struct {
+	// Unit is what the allowance is counted in: bytes (default) or events.
+	// Events are server-sent events; blocks starting with a comment, such
+	// as keep-alives, are free. Responses that are not event streams are
+	// always metered in bytes.
+	Unit string `json:"unit,omitempty"`
+
+	// Allowance is the number of units each payment buys.
+	Allowance int64 `json:"allowance,omitempty"`
+
+	// TopUpTimeout is how long a paused stream waits for a top-up before
+	// it is ended. Defaults to 30s.
+	TopUpTimeout caddy.Duration `json:"topup_timeout,omitempty"`
+}
+
+// provision applies defaults and checks the configuration.
+func (s *PaymentStream) provision() error {
+	if s.Unit == "" {
+		s.Unit = streamUnitBytes
+	}
+	if s.Unit != streamUnitBytes && s.Unit != streamUnitEvents {
+		return fmt.Errorf("unknown stream unit %q: expected bytes or events", s.Unit)
+	}
+	if s.Allowance <= 0 {
+		return fmt.Errorf("stream allowance must be positive")
+	}
+	if s.TopUpTimeout <= 0 {
+		s.TopUpTimeout = caddy.Duration(defaultTopUpTimeout)
+	}
+	return nil
+}
+
+// streamRegistry holds the streams being served, by ID, so that top-ups
+// can find them.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*paidStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[string]*paidStream)}
+}
+
+// open registers a new stream.
+func (s *streamRegistry) open() (*paidStream, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	stream := &paidStream{
+		id:     hex.EncodeToString(id[:]),
+		topUps: make(chan *streamTopUp),
+		done:   make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.streams[stream.id] = stream
+	s.mu.Unlock()
+	return stream, nil
+}
+
+// close ends a stream; pending top-ups are turned away.
+func (s *streamRegistry) close(stream *paidStream) {
+	s.mu.Lock()
+	delete(s.streams, stream.id)
+	s.mu.Unlock()
+	close(stream.done)
+}
+
+// get returns the stream with the given ID, or nil.
+func (s *streamRegistry) get(id string) *paidStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// paidStream is a response being metered.
+type paidStream struct {
+	id     string
+	topUps chan *streamTopUp
+	done   chan struct{}
+}
+
+// streamTopUp is a verified top-up payment handed to a paused stream,
+// which settles it and reports the outcome on result.
+type streamTopUp struct {
+	req    *types.VerifyRequest
+	payer  string
+	result chan error
+}
+
+// serveStream serves a paid request through a meter that keeps the
+// response within the allowance paid for.
+func (m *X402SellerMiddleware) serveStream(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, terms paymentTerms) error {
+	stream, err := m.streams.open()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	defer m.streams.close(stream)
+
+	meter := &streamMeter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		m:                     m,
+		r:                     r,
+		terms:                 terms,
+		stream:                stream,
+		remaining:             m.Stream.Allowance,
+	}
+	err = next.ServeHTTP(meter, r)
+	if meter.topUps > 0 {
+		m.ctx.Logger(m).Info("metered stream ended",
+			zap.String("resource", m.Resource),
+			zap.String("stream", stream.id),
+			zap.Int("top_ups", meter.topUps),
+		)
+	}
+	return err
+}
+
+// serveTopUp accepts a top-up payment for a stream being served. The
+// payment is verified right away but only settled once the stream needs
+// it, so a top-up sent as the stream ends costs nothing.
+func (m *X402SellerMiddleware) serveTopUp(w http.ResponseWriter, r *http.Request, id, paymentHeader string) error {
+	stream := m.streams.get(id)
+	if stream == nil {
+		return m.writeStreamGone(w, id)
+	}
+	if paymentHeader == "" {
+		return m.returnPaymentRequired(w, m.resourceTerms(r))
+	}
+	verifyReq, payer, err := m.verifyPayment(paymentHeader, m.resourceTerms(r))
+	if err != nil {
+		m.paymentFailed(w, err)
+		return nil
+	}
+
+	topUp := &streamTopUp{req: verifyReq, payer: payer, result: make(chan error, 1)}
+	select {
+	case stream.topUps <- topUp:
+	case <-stream.done:
+		return m.writeStreamGone(w, id)
+	case <-r.Context().Done():
+		return nil
+	}
+	if err := <-topUp.result; err != nil {
+		m.paymentFailed(w, err)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]any{
+		"stream":    id,
+		"allowance": m.Stream.Allowance,
+		"unit":      m.Stream.Unit,
+	})
+}
+
+// writeStreamGone answers a top-up for a stream that is not being served.
+func (m *X402SellerMiddleware) writeStreamGone(w http.ResponseWriter, id string) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	return json.NewEncoder(w).Encode(types.ErrorResponse{
+		Error:   "stream_not_found",
+		Message: fmt.Sprintf("stream %s has ended or does not exist", id),
+		Code:    http.StatusGone,
+	})
+}
+
+// streamMeter counts what a response writes against the allowance paid for
+// and pauses it for a top-up when the allowance runs out.
+type streamMeter struct {
+	*caddyhttp.ResponseWriterWrapper
+	m      *X402SellerMiddleware
+	r      *http.Request
+	stream *paidStream
+
+	// terms are what each top-up pays
+	terms paymentTerms
+
+	wroteHeader bool
+	sse         bool
+	unit        string
+	remaining   int64
+	topUps      int
+
+	// Event stream parsing state
+	inEvent   bool
+	lineEmpty bool
+}
+
+// WriteHeader announces the stream to the buyer.
+func (s *streamMeter) WriteHeader(status int) {
+	if s.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		s.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	s.wroteHeader = true
+	s.sse = strings.HasPrefix(s.Header().Get("Content-Type"), "text/event-stream")
+	s.unit = s.m.Stream.Unit
+	if !s.sse {
+		s.unit = streamUnitBytes
+	}
+	s.lineEmpty = true
+
+	s.Header().Set(headerPaymentStream, s.stream.id)
+	s.Header().Set(headerPaymentStreamUnit, s.unit)
+	s.Header().Set(headerPaymentStreamAllowance, strconv.FormatInt(s.m.Stream.Allowance, 10))
+	s.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// Write writes p, pausing for top-ups as the allowance runs out.
+func (s *streamMeter) Write(p []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.sse {
+		return s.writeEvents(p)
+	}
+
+	// Other responses are cut exactly at the allowance
+	var written int
+	for len(p) > 0 {
+		if s.remaining <= 0 {
+			if err := s.topUp(); err != nil {
+				return written, err
+			}
+		}
+		n := int64(len(p))
+		if n > s.remaining {
+			n = s.remaining
+		}
+		w, err := s.ResponseWriterWrapper.Write(p[:n])
+		written += w
+		s.remaining -= int64(w)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// writeEvents writes part of an event stream. The stream is only paused
+// between events, so an event that starts within the allowance is written
+// in full.
+func (s *streamMeter) writeEvents(p []byte) (int, error) {
+	var written, start int
+	for i, c := range p {
+		switch c {
+		case '\n':
+			if s.lineEmpty {
+				s.inEvent = false
+			}
+			s.lineEmpty = true
+			continue
+		case '\r':
+			continue
+		}
+		s.lineEmpty = false
+		if s.inEvent {
+			continue
+		}
+		s.inEvent = true
+		if c == ':' {
+			// Comments are free
+			continue
+		}
+		if s.remaining <= 0 {
+			w, err := s.ResponseWriterWrapper.Write(p[start:i])
+			written += w
+			if err != nil {
+				return written, err
+			}
+			s.chargeBytes(w)
+			start = i
+			if err := s.topUp(); err != nil {
+				return written, err
+			}
+		}
+		if s.unit == streamUnitEvents {
+			s.remaining--
+		}
+	}
+	w, err := s.ResponseWriterWrapper.Write(p[start:])
+	s.chargeBytes(w)
+	return written + w, err
+}
+
+// chargeBytes counts bytes of an event stream metered in bytes.
+func (s *streamMeter) chargeBytes(n int) {
+	if s.unit == streamUnitBytes {
+		s.remaining -= int64(n)
+	}
+}
+
+// ReadFrom copies through Write, so that the copy is metered.
+func (s *streamMeter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{s}, r)
+}
+
+// topUp pauses the stream until the buyer's top-up is settled, asking for
+// it in-band if the response is an event stream.
+func (s *streamMeter) topUp() error {
+	if s.sse {
+		requirements, err := s.m.paymentRequirements(s.terms)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(map[string]any{
+			"stream":              s.stream.id,
+			"paymentRequirements": requirements,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(s.ResponseWriterWrapper, "event: %s\ndata: %s\n\n", streamPaymentRequiredEvent, data); err != nil {
+			return err
+		}
+	}
+	// Whatever was paid for has to reach the buyer before it pays more
+	_ = http.NewResponseController(s.ResponseWriterWrapper).Flush()
+
+	timer := time.NewTimer(time.Duration(s.m.Stream.TopUpTimeout))
+	defer timer.Stop()
+	for {
+		var topUp *streamTopUp
+		select {
+		case topUp = <-s.stream.topUps:
+		case <-timer.C:
+			s.m.ctx.Logger(s.m).Warn("metered stream ended without a top-up",
+				zap.String("resource", s.m.Resource),
+				zap.String("stream", s.stream.id),
+			)
+			return errTopUpTimeout
+		case <-s.r.Context().Done():
+			return s.r.Context().Err()
+		}
+
+		err := s.m.settlePayment(topUp.req, topUp.payer)
+		topUp.result <- err
+		if err != nil {
+			// Another top-up may still arrive in time
+			s.m.ctx.Logger(s.m).Warn("stream top-up failed",
+				zap.String("stream", s.stream.id),
+				zap.Error(err),
+			)
+			continue
+		}
+		s.remaining += s.m.Stream.Allowance
+		s.topUps++
+		return nil
+	}
+}
+
+// writerOnly hides everything but Write, so that io.Copy does not hand the
+// copy back to ReadFrom.
+type writerOnly struct {
+	io.Writer
+}
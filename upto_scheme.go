@@ -0,0 +1,411 @@
+package x402pay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+const (
+	schemeExact = "exact"
+	schemeUpto  = "upto"
+
+	// uptoPermitValidity is how long a permit signed by the buyer stays
+	// valid. It has to cover the response and a settlement that may be
+	// queued and retried.
+	uptoPermitValidity = time.Hour
+)
+
+// erc2612ABI is the part of the ERC20 and EIP-2612 ABI used to settle
+// upto payments and pay the legs of split payments.
+const erc2612ABI = `[
+{"inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"},{"name":"value","type":"uint256"},{"name":"deadline","type":"uint256"},{"name":"v","type":"uint8"},{"name":"r","type":"bytes32"},{"name":"s","type":"bytes32"}],"name":"permit","outputs":[],"stateMutability":"nonpayable","type":"function"},
+{"inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"name":"transferFrom","outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable","type":"function"},
+{"inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable","type":"function"},
+{"inputs":[{"name":"owner","type":"address"}],"name":"nonces","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"}],"name":"allowance","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"account","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"}
+]`
+
+var erc2612 = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(erc2612ABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// uptoPermit is an EIP-2612 permit letting the facilitator move up to
+// Value of the owner's tokens.
+type uptoPermit struct {
+	Owner    string `json:"owner"`
+	Spender  string `json:"spender"`
+	Value    string `json:"value"`
+	Nonce    string `json:"nonce"`
+	Deadline string `json:"deadline"`
+}
+
+// uptoEVMPayload is the payload of an upto scheme payment: the buyer
+// permits the facilitator to spend the maximum price, and the facilitator
+// transfers only what the response actually cost.
+type uptoEVMPayload struct {
+	Signature string     `json:"signature"`
+	Permit    uptoPermit `json:"permit"`
+}
+
+// uptoPayloadOf extracts the permit of an upto scheme payment payload.
+func uptoPayloadOf(payload types.PaymentPayload) (uptoEVMPayload, bool) {
+	data, err := json.Marshal(payload.Payload)
+	if err != nil {
+		return uptoEVMPayload{}, false
+	}
+	var upto uptoEVMPayload
+	if err := json.Unmarshal(data, &upto); err != nil || upto.Permit.Owner == "" {
+		return uptoEVMPayload{}, false
+	}
+	return upto, true
+}
+
+// permitTypedData builds the EIP-712 typed data of a permit for the token
+// with the given domain.
+func permitTypedData(permit uptoPermit, chainID uint64, token, name, version string) apitypes.TypedData {
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+			"Permit": {
+				{Name: "owner", Type: "address"},
+				{Name: "spender", Type: "address"},
+				{Name: "value", Type: "uint256"},
+				{Name: "nonce", Type: "uint256"},
+				{Name: "deadline", Type: "uint256"},
+			},
+		},
+		PrimaryType: "Permit",
+		Domain: apitypes.TypedDataDomain{
+			Name:              name,
+			Version:           version,
+			ChainId:           math.NewHexOrDecimal256(int64(chainID)),
+			VerifyingContract: common.HexToAddress(token).Hex(),
+		},
+		Message: apitypes.TypedDataMessage{
+			"owner":    common.HexToAddress(permit.Owner).Hex(),
+			"spender":  common.HexToAddress(permit.Spender).Hex(),
+			"value":    permit.Value,
+			"nonce":    permit.Nonce,
+			"deadline": permit.Deadline,
+		},
+	}
+}
+
+// signPermit signs a permit with key.
+func signPermit(permit uptoPermit, chainID uint64, token, name, version string, key *ecdsa.PrivateKey) (string, error) {
+	hash, _, err := apitypes.TypedDataAndHash(permitTypedData(permit, chainID, token, name, version))
+	if err != nil {
+		return "", err
+	}
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		return "", err
+	}
+	sig[64] += 27
+	return hexutil.Encode(sig), nil
+}
+
+// recoverPermitSigner returns the address that signed a permit.
+func recoverPermitSigner(permit uptoPermit, signature string, chainID uint64, token, name, version string) (common.Address, error) {
+	hash, _, err := apitypes.TypedDataAndHash(permitTypedData(permit, chainID, token, name, version))
+	if err != nil {
+		return common.Address{}, err
+	}
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != 65 {
+		return common.Address{}, fmt.Errorf("malformed signature")
+	}
+	sig = append([]byte(nil), sig...)
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// callUint calls a uint256 view function of the token.
+func callUint(ctx context.Context, client *ethclient.Client, token common.Address, method string, args ...any) (*big.Int, error) {
+	data, err := erc2612.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s(): %w", method, err)
+	}
+	values, err := erc2612.Unpack(method, out)
+	if err != nil || len(values) != 1 {
+		return nil, fmt.Errorf("decoding %s(): %v", method, err)
+	}
+	value, ok := values[0].(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("decoding %s(): unexpected %T", method, values[0])
+	}
+	return value, nil
+}
+
+// permitNonce returns the owner's current EIP-2612 nonce on the token.
+func permitNonce(ctx context.Context, client *ethclient.Client, token, owner string) (*big.Int, error) {
+	return callUint(ctx, client, common.HexToAddress(token), "nonces", common.HexToAddress(owner))
+}
+
+// verifyUpto verifies an upto payment for the amount in its requirements,
+// which is the maximum when serving and the actual cost when settling.
+// A permit that was already executed is only accepted when settling, and
+// only if the allowance it granted still covers the amount.
+func (m *X402FacilitatorApp) verifyUpto(ctx context.Context, req *types.VerifyRequest, settling bool) *types.VerifyResponse {
+	invalid := func(reason, payer string) *types.VerifyResponse {
+		return &types.VerifyResponse{IsValid: false, InvalidReason: reason, Payer: payer}
+	}
+	requirements := req.PaymentRequirements
+
+	chainNetwork, ok := m.findChainNetwork(requirements.Network)
+	if !ok {
+		return invalid("unsupported_network", "")
+	}
+	if reason := m.refusalReason(requirements.Network); reason != "" {
+		return invalid(reason, "")
+	}
+	asset, ok := chainNetwork.asset(requirements.Asset)
+	if !ok {
+		return invalid("unsupported_asset", "")
+	}
+	upto, ok := uptoPayloadOf(req.PaymentPayload)
+	if !ok || req.PaymentPayload.Scheme != schemeUpto {
+		return invalid("invalid_payload_format", "")
+	}
+	permit := upto.Permit
+	payer := permit.Owner
+
+	if !common.IsHexAddress(permit.Owner) {
+		return invalid("invalid_payload_format", "")
+	}
+	if common.HexToAddress(permit.Spender) != m.facilitatorAddress() {
+		return invalid("invalid_spender", payer)
+	}
+	value, ok := new(big.Int).SetString(permit.Value, 10)
+	nonce, okNonce := new(big.Int).SetString(permit.Nonce, 10)
+	deadline, okDeadline := new(big.Int).SetString(permit.Deadline, 10)
+	amount, okAmount := new(big.Int).SetString(requirements.MaxAmountRequired, 10)
+	if !ok || !okNonce || !okDeadline || !okAmount {
+		return invalid("invalid_payload_format", payer)
+	}
+	if value.Cmp(amount) < 0 {
+		return invalid("insufficient_value", payer)
+	}
+	if deadline.Cmp(big.NewInt(time.Now().Unix())) <= 0 {
+		return invalid("permit_expired", payer)
+	}
+
+	signer, err := recoverPermitSigner(permit, upto.Signature, chainNetwork.ID, asset.Address, asset.Name, asset.Version)
+	if err != nil || signer != common.HexToAddress(permit.Owner) {
+		return invalid("invalid_signature", payer)
+	}
+
+	client, ok := m.clients[chainNetwork.Name]
+	if !ok {
+		return invalid("unsupported_network", payer)
+	}
+	current, err := permitNonce(ctx, client, asset.Address, permit.Owner)
+	if err != nil {
+		return invalid("verification_failed: "+err.Error(), payer)
+	}
+	if current.Cmp(nonce) != 0 {
+		if !settling {
+			return invalid("payment_already_used", payer)
+		}
+		allowance, err := callUint(ctx, client, common.HexToAddress(asset.Address), "allowance",
+			common.HexToAddress(permit.Owner), m.facilitatorAddress())
+		if err != nil {
+			return invalid("verification_failed: "+err.Error(), payer)
+		}
+		if allowance.Cmp(amount) < 0 {
+			return invalid("payment_already_used", payer)
+		}
+	}
+
+	balance, err := callUint(ctx, client, common.HexToAddress(asset.Address), "balanceOf", common.HexToAddress(permit.Owner))
+	if err != nil {
+		return invalid("verification_failed: "+err.Error(), payer)
+	}
+	if balance.Cmp(amount) < 0 {
+		return invalid("insufficient_funds", payer)
+	}
+	return &types.VerifyResponse{IsValid: true, Payer: payer}
+}
+
+// uptoReservations are the upto payments being served, which are held
+// from their verification until they are settled.
+type uptoReservations struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+// reserveUpto holds an upto payment from its verification until it is
+// settled, reporting false if it is held already or was journaled. The
+// permit stays unused until it is settled after the response, so without
+// the hold concurrent requests carrying it would all pass verification.
+// Every successful call must be followed by a call to releaseUpto.
+func (m *X402FacilitatorApp) reserveUpto(ctx context.Context, req *types.VerifyRequest) bool {
+	id := settlementID(req)
+	m.upto.mu.Lock()
+	if m.upto.held[id] {
+		m.upto.mu.Unlock()
+		return false
+	}
+	m.upto.held[id] = true
+	m.upto.mu.Unlock()
+
+	// Payments are released once journaled, so the journal is only looked
+	// at while holding the payment
+	if q := m.SettlementQueue; q != nil {
+		q.mu.Lock()
+		_, queued := q.records[id]
+		q.mu.Unlock()
+		if queued || q.storage.Exists(ctx, settlementKey(id)) {
+			m.releaseUpto(req)
+			return false
+		}
+	}
+	return true
+}
+
+// releaseUpto releases an upto payment held by reserveUpto.
+func (m *X402FacilitatorApp) releaseUpto(req *types.VerifyRequest) {
+	m.upto.mu.Lock()
+	delete(m.upto.held, settlementID(req))
+	m.upto.mu.Unlock()
+}
+
+// settleUpto collects the amount in the requirements of an upto payment:
+// the permit is executed unless the allowance already covers the amount,
+// and the amount is then transferred to the seller. Nothing is sent for a
+// zero amount.
+func (m *X402FacilitatorApp) settleUpto(ctx context.Context, req *types.VerifyRequest) batchResult {
+	verifyResp := m.verifyUpto(ctx, req, true)
+	result := batchResult{Payer: verifyResp.Payer}
+	if !verifyResp.IsValid {
+		result.Err = errors.New(verifyResp.InvalidReason)
+		return result
+	}
+
+	requirements := req.PaymentRequirements
+	amount, _ := new(big.Int).SetString(requirements.MaxAmountRequired, 10)
+	if amount.Sign() == 0 {
+		return result
+	}
+	transactor, ok := m.transactors[requirements.Network]
+	if !ok {
+		result.Err = fmt.Errorf("unsupported_network: %s", requirements.Network)
+		return result
+	}
+	upto, _ := uptoPayloadOf(req.PaymentPayload)
+	permit := upto.Permit
+	owner := common.HexToAddress(permit.Owner)
+	token := common.HexToAddress(m.tokenAddress(requirements))
+
+	var permitTx *ethtypes.Transaction
+	allowance, err := callUint(ctx, transactor.client, token, "allowance", owner, transactor.from)
+	if err != nil {
+		result.Err = fmt.Errorf("transaction_failed: %w", err)
+		return result
+	}
+	if allowance.Cmp(amount) < 0 {
+		data, err := packPermit(permit, upto.Signature)
+		if err != nil {
+			result.Err = fmt.Errorf("invalid_payload: %w", err)
+			return result
+		}
+		if permitTx, err = transactor.send(ctx, token, data); err != nil {
+			result.Err = fmt.Errorf("transaction_failed: %w", err)
+			return result
+		}
+	}
+
+	// The transfer is sent right behind the permit, with the next nonce
+	data, err := erc2612.Pack("transferFrom", owner, common.HexToAddress(requirements.PayTo), amount)
+	if err != nil {
+		result.Err = fmt.Errorf("invalid_payload: %w", err)
+		return result
+	}
+	transferTx, err := transactor.send(ctx, token, data)
+	if err != nil {
+		result.Err = fmt.Errorf("transaction_failed: %w", err)
+		return result
+	}
+	result.Transaction = transferTx.Hash().Hex()
+
+	if permitTx != nil {
+		receipt, err := transactor.wait(ctx, permitTx)
+		if err != nil {
+			result.Err = fmt.Errorf("confirmation_failed: %w", err)
+			return result
+		}
+		if receipt.Status != ethtypes.ReceiptStatusSuccessful {
+			result.Err = errors.New("transaction_reverted: permit failed")
+			return result
+		}
+	}
+	receipt, err := transactor.wait(ctx, transferTx)
+	if err != nil {
+		result.Err = fmt.Errorf("confirmation_failed: %w", err)
+		return result
+	}
+	if receipt.Status != ethtypes.ReceiptStatusSuccessful {
+		result.Err = errors.New("transaction_reverted")
+		return result
+	}
+	result.BlockNumber = receipt.BlockNumber.Uint64()
+	result.BlockHash = receipt.BlockHash.Hex()
+	return result
+}
+
+// packPermit encodes the call executing a signed permit.
+func packPermit(permit uptoPermit, signature string) ([]byte, error) {
+	value, _ := new(big.Int).SetString(permit.Value, 10)
+	deadline, _ := new(big.Int).SetString(permit.Deadline, 10)
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != 65 {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	v := sig[64]
+	if v < 27 {
+		v += 27
+	}
+	var r, s [32]byte
+	copy(r[:], sig[:32])
+	copy(s[:], sig[32:64])
+	return erc2612.Pack("permit", common.HexToAddress(permit.Owner), common.HexToAddress(permit.Spender),
+		value, deadline, v, r, s)
+}
@@ -0,0 +1,88 @@
+package x402pay
+
+import (
+	"context"
+	"testing"
+
+	"github.com/agent-guide/go-x402-facilitator/pkg/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestPermitSignatureRoundTrip(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := crypto.PubkeyToAddress(key.PublicKey)
+	permit := uptoPermit{
+		Owner:    owner.Hex(),
+		Spender:  "0x1111111111111111111111111111111111111111",
+		Value:    "1000000",
+		Nonce:    "7",
+		Deadline: "1900000000",
+	}
+	const token = "0x036CbD53842c5426634e7929541eC2318f3dCF7e"
+
+	signature, err := signPermit(permit, 84532, token, "USDC", "2", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := recoverPermitSigner(permit, signature, 84532, token, "USDC", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != owner {
+		t.Errorf("recovered %s, want %s", signer.Hex(), owner.Hex())
+	}
+
+	// Anything the signature covers must change the recovered signer
+	altered := permit
+	altered.Value = "2000000"
+	for name, recover := range map[string]func() (string, error){
+		"value": func() (string, error) {
+			a, err := recoverPermitSigner(altered, signature, 84532, token, "USDC", "2")
+			return a.Hex(), err
+		},
+		"chain": func() (string, error) {
+			a, err := recoverPermitSigner(permit, signature, 8453, token, "USDC", "2")
+			return a.Hex(), err
+		},
+		"domain": func() (string, error) {
+			a, err := recoverPermitSigner(permit, signature, 84532, token, "USD Coin", "2")
+			return a.Hex(), err
+		},
+	} {
+		if got, err := recover(); err == nil && got == owner.Hex() {
+			t.Errorf("altered %s still recovers the owner", name)
+		}
+	}
+
+	if _, err := recoverPermitSigner(permit, "0x1234", 84532, token, "USDC", "2"); err == nil {
+		t.Error("expected an error for a malformed signature")
+	}
+}
+
+func TestReserveUpto(t *testing.T) {
+	m := &X402FacilitatorApp{upto: &uptoReservations{held: make(map[string]bool)}}
+	req := &types.VerifyRequest{
+		PaymentPayload: types.PaymentPayload{
+			Scheme: schemeUpto,
+			Payload: map[string]any{
+				"signature": "0x",
+				"permit":    map[string]any{"owner": "0xAbc", "nonce": "3"},
+			},
+		},
+		PaymentRequirements: types.PaymentRequirements{Network: "base-sepolia"},
+	}
+
+	if !m.reserveUpto(context.Background(), req) {
+		t.Fatal("first reservation refused")
+	}
+	if m.reserveUpto(context.Background(), req) {
+		t.Fatal("duplicate reservation accepted")
+	}
+	m.releaseUpto(req)
+	if !m.reserveUpto(context.Background(), req) {
+		t.Fatal("reservation refused after release")
+	}
+}
@@ -0,0 +1,292 @@
+package x402pay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&X402WalletsApp{})
+}
+
+// X402WalletsApp is an app-level module holding buyer wallets that can be
+// shared by any number of x402buyer handlers. Sharing a wallet means sharing
+// its spending budget and its limit on concurrent authorizations.
+type X402WalletsApp struct {
+	Wallets []WalletConfig `json:"wallets,omitempty"`
+
+	// Runtime fields
+	wallets map[string]*buyerWallet
+}
+
+// WalletConfig represents a named buyer wallet.
+type WalletConfig struct {
+	Name       string `json:"name,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+
+	// Budget is the maximum amount, in token base units, the wallet may
+	// authorize per budget window. Empty means unlimited.
+	Budget string `json:"budget,omitempty"`
+
+	// BudgetWindow is the period after which spending is reset. Zero means
+	// the budget applies for as long as the config is loaded.
+	BudgetWindow caddy.Duration `json:"budget_window,omitempty"`
+
+	// MaxConcurrent limits how many payments may be authorized and awaiting
+	// an answer from the upstream at the same time. Zero means unlimited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (X402WalletsApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "x402.wallets",
+		New: func() caddy.Module { return new(X402WalletsApp) },
+	}
+}
+
+// Provision sets up the module.
+func (m *X402WalletsApp) Provision(ctx caddy.Context) error {
+	m.wallets = make(map[string]*buyerWallet, len(m.Wallets))
+	for _, cfg := range m.Wallets {
+		if _, exists := m.wallets[cfg.Name]; exists {
+			return fmt.Errorf("duplicate wallet %q", cfg.Name)
+		}
+		wallet, err := newBuyerWalletFromConfig(cfg)
+		if err != nil {
+			return fmt.Errorf("wallet %q: %w", cfg.Name, err)
+		}
+		m.wallets[cfg.Name] = wallet
+	}
+
+	ctx.Logger(m).Info("provisioning x402 wallets app",
+		zap.Int("wallets_count", len(m.wallets)),
+	)
+	return nil
+}
+
+// Validate validates the module configuration.
+func (m *X402WalletsApp) Validate() error {
+	for _, cfg := range m.Wallets {
+		if cfg.Name == "" {
+			return fmt.Errorf("wallet name is required")
+		}
+		if cfg.PrivateKey == "" {
+			return fmt.Errorf("wallet %q: private_key is required", cfg.Name)
+		}
+		if cfg.MaxConcurrent < 0 {
+			return fmt.Errorf("wallet %q: max_concurrent must not be negative", cfg.Name)
+		}
+	}
+	return nil
+}
+
+// Start starts the application.
+func (m *X402WalletsApp) Start() error {
+	return nil
+}
+
+// Stop stops the application.
+func (m *X402WalletsApp) Stop() error {
+	return nil
+}
+
+// getWallet returns the wallet with the given name.
+func (m *X402WalletsApp) getWallet(name string) (*buyerWallet, error) {
+	wallet, ok := m.wallets[name]
+	if !ok {
+		return nil, fmt.Errorf("wallet %q is not defined in x402.wallets", name)
+	}
+	return wallet, nil
+}
+
+// buyerWallet is a signing key together with the spending policy applied to
+// every payment made with it.
+type buyerWallet struct {
+	name       string
+	privateKey *ecdsa.PrivateKey
+	budget     *big.Int
+	window     time.Duration
+	slots      chan struct{}
+
+	mu          sync.Mutex
+	windowStart time.Time
+	spent       *big.Int
+	pending     *big.Int
+	payments    uint64
+	rejected    uint64
+}
+
+// newBuyerWallet creates a wallet around privateKey. A nil budget and zero
+// maxConcurrent leave the wallet unrestricted.
+func newBuyerWallet(name string, privateKey *ecdsa.PrivateKey, budget *big.Int, window time.Duration, maxConcurrent int) *buyerWallet {
+	w := &buyerWallet{
+		name:        name,
+		privateKey:  privateKey,
+		budget:      budget,
+		window:      window,
+		windowStart: time.Now(),
+		spent:       new(big.Int),
+		pending:     new(big.Int),
+	}
+	if maxConcurrent > 0 {
+		w.slots = make(chan struct{}, maxConcurrent)
+	}
+	return w
+}
+
+// newBuyerWalletFromConfig creates a wallet from its configuration.
+func newBuyerWalletFromConfig(cfg WalletConfig) (*buyerWallet, error) {
+	privateKey, err := crypto.HexToECDSA(trimHexPrefix(cfg.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	var budget *big.Int
+	if cfg.Budget != "" {
+		var ok bool
+		budget, ok = new(big.Int).SetString(cfg.Budget, 10)
+		if !ok || budget.Sign() < 0 {
+			return nil, fmt.Errorf("invalid budget: %s", cfg.Budget)
+		}
+	}
+
+	return newBuyerWallet(cfg.Name, privateKey, budget, time.Duration(cfg.BudgetWindow), cfg.MaxConcurrent), nil
+}
+
+// address returns the wallet's account address.
+func (w *buyerWallet) address() string {
+	return crypto.PubkeyToAddress(w.privateKey.PublicKey).Hex()
+}
+
+// authorize reserves amount against the wallet's budget and takes one of its
+// concurrency slots, waiting for a slot to free up if necessary. Every
+// successful call must be followed by exactly one call to finish.
+func (w *buyerWallet) authorize(ctx context.Context, amount *big.Int) error {
+	if w.slots != nil {
+		select {
+		case w.slots <- struct{}{}:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for wallet %q: %w", w.name, ctx.Err())
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rollWindow()
+	if w.budget != nil {
+		committed := new(big.Int).Add(w.spent, w.pending)
+		if committed.Add(committed, amount).Cmp(w.budget) > 0 {
+			w.releaseSlot()
+			return errBudgetExceeded
+		}
+	}
+	w.pending.Add(w.pending, amount)
+	return nil
+}
+
+// finish releases an authorization made by authorize, recording amount as
+// spent if the payment went through.
+func (w *buyerWallet) finish(amount *big.Int, spent bool) {
+	w.mu.Lock()
+	w.pending.Sub(w.pending, amount)
+	if spent {
+		w.spent.Add(w.spent, amount)
+		w.payments++
+	} else {
+		w.rejected++
+	}
+	w.mu.Unlock()
+
+	w.releaseSlot()
+}
+
+// releaseSlot frees a concurrency slot taken by authorize.
+func (w *buyerWallet) releaseSlot() {
+	if w.slots != nil {
+		<-w.slots
+	}
+}
+
+// rollWindow resets spending once the budget window has elapsed.
+// The caller must hold w.mu.
+func (w *buyerWallet) rollWindow() {
+	if w.window <= 0 || time.Since(w.windowStart) < w.window {
+		return
+	}
+	w.windowStart = time.Now()
+	w.spent.SetInt64(0)
+}
+
+// walletStatus is the admin API view of a wallet.
+type walletStatus struct {
+	Name          string `json:"name"`
+	Address       string `json:"address"`
+	Budget        string `json:"budget,omitempty"`
+	BudgetWindow  string `json:"budget_window,omitempty"`
+	WindowStart   string `json:"window_start"`
+	Spent         string `json:"spent"`
+	Pending       string `json:"pending"`
+	Payments      uint64 `json:"payments"`
+	Rejected      uint64 `json:"rejected"`
+	InFlight      int    `json:"in_flight"`
+	MaxConcurrent int    `json:"max_concurrent,omitempty"`
+}
+
+// status returns a snapshot of the wallet's spending.
+func (w *buyerWallet) status() walletStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rollWindow()
+	st := walletStatus{
+		Name:        w.name,
+		Address:     w.address(),
+		WindowStart: w.windowStart.UTC().Format(time.RFC3339),
+		Spent:       w.spent.String(),
+		Pending:     w.pending.String(),
+		Payments:    w.payments,
+		Rejected:    w.rejected,
+	}
+	if w.budget != nil {
+		st.Budget = w.budget.String()
+	}
+	if w.window > 0 {
+		st.BudgetWindow = w.window.String()
+	}
+	if w.slots != nil {
+		st.InFlight = len(w.slots)
+		st.MaxConcurrent = cap(w.slots)
+	}
+	return st
+}
+
+// errBudgetExceeded is returned by authorize when a payment would exceed the
+// wallet's budget.
+var errBudgetExceeded = fmt.Errorf("wallet budget exceeded")
+
+// trimHexPrefix strips an optional 0x prefix from a hex string.
+func trimHexPrefix(s string) string {
+	if len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		return s[2:]
+	}
+	return s
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*X402WalletsApp)(nil)
+	_ caddy.Validator       = (*X402WalletsApp)(nil)
+	_ caddy.App             = (*X402WalletsApp)(nil)
+	_ caddyfile.Unmarshaler = (*X402WalletsApp)(nil)
+)
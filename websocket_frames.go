@@ -0,0 +1,229 @@
+package x402pay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// WebSocket opcodes (RFC 6455, section 5.2).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+)
+
+// wsCloseMessage builds the payload of a close frame.
+func wsCloseMessage(code uint16, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	return append(payload, reason...)
+}
+
+// wsFrame encodes a single-frame message. Frames sent by the client side
+// of a connection must be masked.
+func wsFrame(opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	var key [4]byte
+	_, _ = rand.Read(key[:])
+	frame = append(frame, key[:]...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[start+i] ^= key[i%4]
+	}
+	return frame
+}
+
+// wsControlFrame encodes an x402 control message as a text frame.
+func wsControlFrame(message any, masked bool) []byte {
+	payload, _ := json.Marshal(message)
+	return wsFrame(wsOpText, payload, masked)
+}
+
+// wsControlType returns the type of an x402 control message, or the empty
+// string if payload is not one.
+func wsControlType(payload []byte) string {
+	if len(payload) == 0 || payload[0] != '{' {
+		return ""
+	}
+	var message struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(payload, &message) != nil || !strings.HasPrefix(message.Type, "x402-") {
+		return ""
+	}
+	return message.Type
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket" {
+		return true
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsFrameFilter follows one direction of a WebSocket connection frame by
+// frame. Small text frames are held until complete so that x402 control
+// messages can be taken out; everything else streams through. It counts
+// data messages and knows when the stream is between messages, where
+// frames of our own may be inserted.
+type wsFrameFilter struct {
+	// holdLimit is the largest text frame held for inspection; zero holds
+	// nothing.
+	holdLimit int
+
+	// inspect is called with every held frame's unmasked payload, and
+	// drops the frame by returning true.
+	inspect func(payload []byte) bool
+
+	// onMessage is called as each data message starts its final frame.
+	onMessage func()
+
+	buf       []byte
+	remaining uint64
+	inMessage bool
+}
+
+// feed takes the next bytes of the stream and returns those to pass on.
+func (f *wsFrameFilter) feed(p []byte) []byte {
+	var out []byte
+	for len(p) > 0 || len(f.buf) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			out = append(out, p[:n]...)
+			f.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		f.buf = append(f.buf, p...)
+		p = nil
+		headerLen, payloadLen, ok := wsParseHeader(f.buf)
+		if !ok {
+			break
+		}
+		opcode := f.buf[0] & 0x0f
+		fin := f.buf[0]&0x80 != 0
+		compressed := f.buf[0]&0x40 != 0
+
+		hold := f.inspect != nil && opcode == wsOpText && fin && !compressed && payloadLen <= uint64(f.holdLimit)
+		if hold {
+			total := headerLen + int(payloadLen)
+			if len(f.buf) < total {
+				break
+			}
+			frame := f.buf[:total]
+			p = f.buf[total:]
+			f.buf = nil
+			// Control messages taken out do not count as messages
+			if !f.inspect(wsPayload(frame, headerLen)) {
+				f.track(opcode, fin)
+				out = append(out, frame...)
+			}
+			continue
+		}
+
+		out = append(out, f.buf[:headerLen]...)
+		p = f.buf[headerLen:]
+		f.buf = nil
+		f.remaining = payloadLen
+		f.track(opcode, fin)
+	}
+	return out
+}
+
+// track follows message boundaries as a frame starts.
+func (f *wsFrameFilter) track(opcode byte, fin bool) {
+	switch opcode {
+	case wsOpText, wsOpBinary, wsOpContinuation:
+		f.inMessage = !fin
+		if fin && f.onMessage != nil {
+			f.onMessage()
+		}
+	}
+}
+
+// atFrameBoundary reports whether the stream is between frames.
+func (f *wsFrameFilter) atFrameBoundary() bool {
+	return f.remaining == 0 && len(f.buf) == 0
+}
+
+// atMessageBoundary reports whether the stream is between messages.
+func (f *wsFrameFilter) atMessageBoundary() bool {
+	return f.atFrameBoundary() && !f.inMessage
+}
+
+// wsParseHeader parses the frame header at the start of b.
+func wsParseHeader(b []byte) (headerLen int, payloadLen uint64, ok bool) {
+	if len(b) < 2 {
+		return 0, 0, false
+	}
+	headerLen = 2
+	payloadLen = uint64(b[1] & 0x7f)
+	switch payloadLen {
+	case 126:
+		headerLen += 2
+	case 127:
+		headerLen += 8
+	}
+	if b[1]&0x80 != 0 {
+		headerLen += 4
+	}
+	if len(b) < headerLen {
+		return 0, 0, false
+	}
+	switch payloadLen {
+	case 126:
+		payloadLen = uint64(binary.BigEndian.Uint16(b[2:4]))
+	case 127:
+		payloadLen = binary.BigEndian.Uint64(b[2:10])
+	}
+	return headerLen, payloadLen, true
+}
+
+// wsPayload returns the unmasked payload of a complete frame.
+func wsPayload(frame []byte, headerLen int) []byte {
+	payload := append([]byte(nil), frame[headerLen:]...)
+	if frame[1]&0x80 != 0 {
+		key := frame[headerLen-4 : headerLen]
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return payload
+}